@@ -0,0 +1,188 @@
+package can
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// RawBlobFormat is implemented by Formats that encode blobs as a fixed size
+// prefix followed by the unmodified blob data, which allows reading parts of
+// a blob without decoding all of it.
+type RawBlobFormat interface {
+	// BlobPrefixLen returns the size of the prefix of encoded blobs.
+	BlobPrefixLen() int64
+}
+
+// BlobPrefixLen is part of the RawBlobFormat interface.
+func (f *defaultFormat) BlobPrefixLen() int64 {
+	return int64(len(blobPrefix))
+}
+
+// BlobRange returns a ReadCloser for length bytes of the blob with the given
+// id, starting at off. An error is returned if the range exceeds the blob.
+// Unlike Blob, BlobRange does not verify the id of the blob, as that requires
+// reading all of it. For Formats that don't implement RawBlobFormat, the blob
+// is decoded up to the end of the range, and a range exceeding the blob is
+// only detected while reading.
+func (d *DirRepo) BlobRange(id ID, off, length int64) (io.ReadCloser, error) {
+	if off < 0 || length < 0 {
+		return nil, fmt.Errorf("bad range: off=%d length=%d", off, length)
+	}
+	raw, ok := d.Format.(RawBlobFormat)
+	if !ok {
+		return d.blobRangeDecode(id, off, length)
+	}
+	file, err := os.Open(d.path(id))
+	if err != nil {
+		return nil, err
+	}
+	prefixLen := raw.BlobPrefixLen()
+	if info, err := file.Stat(); err != nil {
+		file.Close()
+		return nil, err
+	} else if _, err := d.Format.DecodeBlob(io.NewSectionReader(file, 0, prefixLen)); err != nil {
+		file.Close()
+		return nil, err
+	} else if size := info.Size() - prefixLen; off+length > size {
+		file.Close()
+		return nil, fmt.Errorf("range out of bounds: off=%d length=%d size=%d", off, length, size)
+	}
+	return NewReadCloser(io.NewSectionReader(file, prefixLen+off, length), file), nil
+}
+
+// BlobSize returns the size of the blob with the given id, which is computed
+// from the size of its file. It returns -1 if the Format does not implement
+// RawBlobFormat, or if it is a Sealer, as the size is unknown without decoding
+// the blob then.
+func (d *DirRepo) BlobSize(id ID) (int64, error) {
+	raw, ok := d.Format.(RawBlobFormat)
+	if _, sealed := d.Format.(Sealer); !ok || sealed {
+		return -1, nil
+	}
+	info, err := os.Stat(d.path(id))
+	if err != nil {
+		return -1, err
+	}
+	return info.Size() - raw.BlobPrefixLen(), nil
+}
+
+// blobSizer is implemented by Repos that can tell the size of a blob without
+// reading it.
+type blobSizer interface {
+	BlobSize(id ID) (int64, error)
+}
+
+// blobRangeDecode implements BlobRange by decoding the blob.
+func (d *DirRepo) blobRangeDecode(id ID, off, length int64) (io.ReadCloser, error) {
+	rc, err := d.Blob(id)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := io.CopyN(ioutil.Discard, rc, off); err == io.EOF {
+		rc.Close()
+		return nil, fmt.Errorf("range out of bounds: off=%d length=%d size=%d", off, length, n)
+	} else if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return NewReadCloser(&rangeReader{r: rc, n: length}, rc), nil
+}
+
+// rangeReader reads n bytes from r, and returns io.ErrUnexpectedEOF if r
+// ends before that.
+type rangeReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *rangeReader) Read(p []byte) (int, error) {
+	if r.n <= 0 {
+		return 0, io.EOF
+	} else if int64(len(p)) > r.n {
+		p = p[:r.n]
+	}
+	n, err := r.r.Read(p)
+	r.n -= int64(n)
+	if err == io.EOF && r.n > 0 {
+		err = io.ErrUnexpectedEOF
+	} else if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// BlobReaderAt provides random access to the data of a blob, see
+// DirRepo.BlobReaderAt.
+type BlobReaderAt struct {
+	file      *os.File
+	prefixLen int64
+	size      int64
+	id        ID
+	newHash   func() hash.Hash
+}
+
+// BlobReaderAt returns a BlobReaderAt for the blob with the given id, and the
+// size of the blob. The object file is kept open until the BlobReaderAt is
+// closed. Random access does not allow verifying the id of the blob while
+// reading it, so the blob is not verified unless Verify is called. An error is
+// returned if the Format does not implement RawBlobFormat, or is a Sealer.
+func (d *DirRepo) BlobReaderAt(id ID) (*BlobReaderAt, int64, error) {
+	raw, ok := d.Format.(RawBlobFormat)
+	if _, sealed := d.Format.(Sealer); !ok || sealed {
+		return nil, 0, fmt.Errorf("format does not support random access to blobs")
+	}
+	file, err := os.Open(d.path(id))
+	if err != nil {
+		return nil, 0, err
+	}
+	prefixLen := raw.BlobPrefixLen()
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	} else if _, err := d.Format.DecodeBlob(io.NewSectionReader(file, 0, prefixLen)); err != nil {
+		file.Close()
+		return nil, 0, corruptError(id, err)
+	}
+	size := info.Size() - prefixLen
+	return &BlobReaderAt{file: file, prefixLen: prefixLen, size: size, id: id, newHash: d.newHash}, size, nil
+}
+
+// ReadAt implements the io.ReaderAt interface.
+func (b *BlobReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset: %d", off)
+	} else if off >= b.size {
+		return 0, io.EOF
+	}
+	if max := b.size - off; int64(len(p)) > max {
+		p = p[:max]
+		n, err := b.file.ReadAt(p, b.prefixLen+off)
+		if err == nil {
+			err = io.EOF
+		}
+		return n, err
+	}
+	return b.file.ReadAt(p, b.prefixLen+off)
+}
+
+// Size returns the size of the blob.
+func (b *BlobReaderAt) Size() int64 {
+	return b.size
+}
+
+// Verify reads the whole object and returns a *CorruptError if it does not
+// match its id.
+func (b *BlobReaderAt) Verify() error {
+	r := newIDVerifier(io.NewSectionReader(b.file, 0, b.prefixLen+b.size), b.id, b.newHash())
+	_, err := io.Copy(ioutil.Discard, r)
+	return err
+}
+
+// Close closes the object file.
+func (b *BlobReaderAt) Close() error {
+	return b.file.Close()
+}
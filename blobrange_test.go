@@ -0,0 +1,103 @@
+package can
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestDirRepo_BlobRange(t *testing.T) {
+	for name, rp := range map[string]*DirRepo{"raw": tmpDirRepo(), "decoded": tmpEncryptedRepo(t)} {
+		id, err := rp.WriteBlob(strings.NewReader("Hello World"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		tests := []struct {
+			Off, Length int64
+			Want        string
+		}{
+			{Off: 0, Length: 5, Want: "Hello"},
+			{Off: 6, Length: 5, Want: "World"},
+			{Off: 4, Length: 3, Want: "o W"},
+			{Off: 11, Length: 0, Want: ""},
+		}
+		for _, test := range tests {
+			rc, err := rp.BlobRange(id, test.Off, test.Length)
+			if err != nil {
+				t.Fatalf("%s: %s", name, err)
+			}
+			got, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatalf("%s: %s", name, err)
+			} else if string(got) != test.Want {
+				t.Fatalf("%s: got=%q want=%q", name, got, test.Want)
+			}
+		}
+		for _, r := range [][2]int64{{12, 0}, {6, 6}, {-1, 2}} {
+			rc, err := rp.BlobRange(id, r[0], r[1])
+			if err == nil {
+				_, err = ioutil.ReadAll(rc)
+				rc.Close()
+			}
+			if err == nil {
+				t.Fatalf("%s: expected error for range %v", name, r)
+			} else if name == "decoded" && r[0] == 6 && err != io.ErrUnexpectedEOF {
+				t.Fatalf("%s: expected io.ErrUnexpectedEOF, got: %v", name, err)
+			}
+		}
+	}
+}
+
+func TestDirRepo_BlobReaderAt(t *testing.T) {
+	rp := tmpDirRepo()
+	data := strings.Repeat("0123456789abcdef", 1000)
+	id, err := rp.WriteBlob(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ra, size, err := rp.BlobReaderAt(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ra.Close()
+	if size != int64(len(data)) || ra.Size() != size {
+		t.Fatalf("bad size: got=%d want=%d", size, len(data))
+	}
+	for _, off := range []int64{8000, 0, 15990, 123, 4096} {
+		buf := make([]byte, 10)
+		if n, err := ra.ReadAt(buf, off); err != nil {
+			t.Fatalf("%d: %s", off, err)
+		} else if got, want := string(buf[:n]), data[off:off+10]; got != want {
+			t.Fatalf("%d: got=%q want=%q", off, got, want)
+		}
+	}
+	buf := make([]byte, 10)
+	if n, err := ra.ReadAt(buf, size-4); err != io.EOF || string(buf[:n]) != data[size-4:] {
+		t.Fatalf("bad read at end: n=%d err=%v", n, err)
+	} else if _, err := ra.ReadAt(buf, size); err != io.EOF {
+		t.Fatalf("expected io.EOF, got: %v", err)
+	}
+	got, err := ioutil.ReadAll(io.NewSectionReader(ra, 0, size))
+	if err != nil {
+		t.Fatal(err)
+	} else if string(got) != data {
+		t.Fatal("bad blob data")
+	} else if err := ra.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(rp.path(id), []byte("blob\nJello"), 0600); err != nil {
+		t.Fatal(err)
+	} else if corrupt, _, err := rp.BlobReaderAt(id); err != nil {
+		t.Fatal(err)
+	} else if err := corrupt.Verify(); !IsCorrupt(err) {
+		t.Fatalf("expected corrupt error, got: %v", err)
+	} else if err := corrupt.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := tmpEncryptedRepo(t).BlobReaderAt(id); err == nil {
+		t.Fatal("expected error for sealed format")
+	}
+}
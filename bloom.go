@@ -0,0 +1,218 @@
+package can
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sync"
+)
+
+// bloomHeader is the first line of an encoded Bloom filter, followed by the
+// number of hash functions and bits, and the bits themselves.
+const bloomHeader = "can-bloom 1"
+
+const (
+	// bloomBitsPerID and bloomHashes give a false positive rate of about 1%.
+	bloomBitsPerID = 10
+	bloomHashes    = 7
+	// bloomMaxBits limits the size of decoded filters to 64 MiB.
+	bloomMaxBits = 1 << 29
+)
+
+// Bloom is a Bloom filter for object ids. Has never returns false for an id
+// that was added, but may return true for ids that were not. A Bloom is not
+// safe for concurrent use.
+type Bloom struct {
+	k    uint32
+	bits []byte
+}
+
+// NewBloom returns an empty Bloom sized for n ids.
+func NewBloom(n int) *Bloom {
+	m := n * bloomBitsPerID
+	if m < 64 {
+		m = 64
+	}
+	return &Bloom{k: bloomHashes, bits: make([]byte, (m+7)/8)}
+}
+
+// BuildBloom returns a Bloom containing the ids of all objects stored in rp,
+// if it is a *DirRepo, or of all objects reachable from its head and refs
+// otherwise.
+func BuildBloom(rp Repo) (*Bloom, error) {
+	var ids []ID
+	var err error
+	if d, ok := rp.(*DirRepo); ok {
+		ids, err = d.Objects()
+	} else {
+		ids, err = reachableIDs(rp)
+	}
+	if err != nil {
+		return nil, err
+	}
+	b := NewBloom(len(ids))
+	for _, id := range ids {
+		b.Add(id)
+	}
+	return b, nil
+}
+
+// reachableIDs returns the ids of all objects reachable from the head and refs
+// of rp.
+func reachableIDs(rp Repo) ([]ID, error) {
+	var roots []ID
+	if head, err := rp.Head(); err == nil {
+		roots = append(roots, head)
+	} else if !IsNotFound(err) {
+		return nil, err
+	}
+	refs, err := rp.Refs()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range refs {
+		roots = append(roots, id)
+	}
+	var ids []ID
+	err = walkReachable(rp, roots, func(id ID, kind Kind) error {
+		ids = append(ids, id)
+		return nil
+	})
+	return ids, err
+}
+
+// Add adds id to the filter.
+func (b *Bloom) Add(id ID) {
+	b.each(id, func(bit uint32) bool {
+		b.bits[bit/8] |= 1 << (bit % 8)
+		return true
+	})
+}
+
+// Has returns false if id was not added to the filter, and true if it may
+// have been.
+func (b *Bloom) Has(id ID) bool {
+	return b.each(id, func(bit uint32) bool {
+		return b.bits[bit/8]&(1<<(bit%8)) != 0
+	})
+}
+
+// each calls fn with the k bits of id, derived from two halves of a single
+// hash, and returns false as soon as fn does.
+func (b *Bloom) each(id ID, fn func(bit uint32) bool) bool {
+	h := fnv.New64a()
+	h.Write(id)
+	sum := h.Sum64()
+	h1, h2 := uint32(sum), uint32(sum>>32)|1
+	m := uint32(len(b.bits) * 8)
+	for i := uint32(0); i < b.k; i++ {
+		if !fn((h1 + i*h2) % m) {
+			return false
+		}
+	}
+	return true
+}
+
+// Encode writes the filter to w as a "can-bloom 1 <k> <bits>\n" line followed
+// by the bits.
+func (b *Bloom) Encode(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "%s %d %d\n", bloomHeader, b.k, len(b.bits)*8); err != nil {
+		return err
+	}
+	_, err := w.Write(b.bits)
+	return err
+}
+
+// DecodeBloom reads a filter written by Bloom.Encode from r.
+func DecodeBloom(r io.Reader) (*Bloom, error) {
+	br := bufio.NewReader(r)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("bad bloom header: %s", err)
+	}
+	var k, m uint32
+	if _, err := fmt.Sscanf(line, bloomHeader+" %d %d\n", &k, &m); err != nil {
+		return nil, fmt.Errorf("bad bloom header: %q", line)
+	} else if k == 0 || m == 0 || m%8 != 0 || m > bloomMaxBits {
+		return nil, fmt.Errorf("bad bloom size: k=%d bits=%d", k, m)
+	}
+	b := &Bloom{k: k, bits: make([]byte, m/8)}
+	if _, err := io.ReadFull(br, b.bits); err != nil {
+		return nil, fmt.Errorf("bad bloom bits: %s", err)
+	}
+	return b, nil
+}
+
+// bloomer is implemented by repos that can load a Bloom published by their
+// server.
+type bloomer interface {
+	bloom() (*Bloom, error)
+}
+
+// NewBloomBackend returns a BloomBackend for rp. Its Bloom is fetched from the
+// server if rp was returned by NewHTTPRepo, and built with BuildBloom
+// otherwise.
+func NewBloomBackend(rp Repo) (*BloomBackend, error) {
+	var b *Bloom
+	var err error
+	if br, ok := rp.(bloomer); ok {
+		b, err = br.bloom()
+	} else {
+		b, err = BuildBloom(rp)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &BloomBackend{Repo: rp, Bloom: b}, nil
+}
+
+// BloomBackend is a Repo that answers Exists from its Bloom for ids that are
+// not in it, and only asks the inner Repo for ids that are, to rule out false
+// positives. This saves a round trip for every missing object of a remote
+// repo. Objects written through the BloomBackend are added to the Bloom, but
+// objects written to the inner Repo otherwise are reported as missing. It is
+// safe for concurrent use if the inner Repo is.
+type BloomBackend struct {
+	Repo
+	Bloom *Bloom
+
+	mu sync.RWMutex
+}
+
+// Exists is part of the Repo interface.
+func (b *BloomBackend) Exists(id ID) (bool, error) {
+	b.mu.RLock()
+	ok := b.Bloom.Has(id)
+	b.mu.RUnlock()
+	if !ok {
+		return false, nil
+	}
+	return b.Repo.Exists(id)
+}
+
+// WriteBlob is part of the Repo interface.
+func (b *BloomBackend) WriteBlob(r io.Reader) (ID, error) {
+	return b.add(b.Repo.WriteBlob(r))
+}
+
+// WriteTree is part of the Repo interface.
+func (b *BloomBackend) WriteTree(t Tree) (ID, error) {
+	return b.add(b.Repo.WriteTree(t))
+}
+
+// WriteCommit is part of the Repo interface.
+func (b *BloomBackend) WriteCommit(c Commit) (ID, error) {
+	return b.add(b.Repo.WriteCommit(c))
+}
+
+// add passes through the results of a write, and adds the written id to the
+// Bloom.
+func (b *BloomBackend) add(id ID, err error) (ID, error) {
+	if err == nil {
+		b.mu.Lock()
+		b.Bloom.Add(id)
+		b.mu.Unlock()
+	}
+	return id, err
+}
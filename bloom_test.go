@@ -0,0 +1,105 @@
+package can
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestBloom(t *testing.T) {
+	rp := NewMemRepo()
+	var added, missing []ID
+	for i := 0; i < 2000; i++ {
+		id, err := rp.WriteBlob(strings.NewReader(fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		} else if i%2 == 0 {
+			added = append(added, id)
+		} else {
+			missing = append(missing, id)
+		}
+	}
+	b := NewBloom(len(added))
+	for _, id := range added {
+		b.Add(id)
+	}
+	buf := &bytes.Buffer{}
+	if err := b.Encode(buf); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := DecodeBloom(buf)
+	if err != nil {
+		t.Fatal(err)
+	} else if diff := pretty.Compare(decoded, b); diff != "" {
+		t.Fatal(diff)
+	}
+	for _, id := range added {
+		if !decoded.Has(id) {
+			t.Fatalf("added id not found: %s", id)
+		}
+	}
+	positives := 0
+	for _, id := range missing {
+		if decoded.Has(id) {
+			positives++
+		}
+	}
+	if positives > len(missing)/20 {
+		t.Fatalf("too many false positives: %d of %d", positives, len(missing))
+	}
+	if _, err := DecodeBloom(strings.NewReader("can-bloom 1 7 64\nshort")); err == nil {
+		t.Fatal("expected error for truncated bloom")
+	}
+}
+
+func TestBloomBackend(t *testing.T) {
+	server := tmpRepo()
+	head := testCommitSet(t, server, []string{"foo"}, "a")
+	var heads int64
+	handler := &HTTPHandler{Repo: server, Writable: true}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			atomic.AddInt64(&heads, 1)
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	bb, err := NewBloomBackend(NewHTTPRepo(ts.URL, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists := func(id ID, want bool, wantHeads int64) {
+		t.Helper()
+		if ok, err := bb.Exists(id); err != nil {
+			t.Fatal(err)
+		} else if ok != want {
+			t.Fatalf("%s: got=%t want=%t", id, ok, want)
+		} else if got := atomic.SwapInt64(&heads, 0); got != wantHeads {
+			t.Fatalf("%s: got=%d HEAD requests want=%d", id, got, wantHeads)
+		}
+	}
+	exists(head, true, 1)
+	// Find a missing id that is not in the filter, and one that is.
+	var missing, positive ID
+	for i := 0; missing == nil; i++ {
+		id := ID(fmt.Sprintf("missing-%020d", i))
+		if !bb.Bloom.Has(id) {
+			missing = id
+		}
+	}
+	positive = ID(bytes.Repeat([]byte{0xff}, 20))
+	bb.Bloom.Add(positive)
+	exists(missing, false, 0)
+	exists(positive, false, 1)
+	id, err := bb.WriteBlob(strings.NewReader("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exists(id, true, 1)
+}
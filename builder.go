@@ -0,0 +1,165 @@
+package can
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// NewCommitBuilder returns a CommitBuilder for a commit on top of the commit
+// with the given parent id, or for a root commit if parent is nil.
+func NewCommitBuilder(rp Repo, parent ID) *CommitBuilder {
+	return &CommitBuilder{rp: rp, parent: parent, root: &builderNode{}}
+}
+
+// CommitBuilder collects many keys and commits them at once, which writes
+// every modified tree only once instead of once per key like Set does.
+type CommitBuilder struct {
+	rp     Repo
+	parent ID
+	root   *builderNode
+}
+
+// builderNode is a key component of a CommitBuilder. It holds either the id
+// of a blob, or the nodes below it.
+type builderNode struct {
+	blob     ID
+	children map[string]*builderNode
+}
+
+// Set writes the given blob and sets it as the value of key. It's an error to
+// set a key below another key, e.g. "a/b" and "a".
+func (b *CommitBuilder) Set(key []string, blob io.Reader) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+	node := b.root
+	for i, name := range key {
+		if node.blob != nil {
+			return fmt.Errorf("key %#v is below the key %#v", key, key[:i])
+		} else if node.children == nil {
+			node.children = map[string]*builderNode{}
+		}
+		child := node.children[name]
+		if child == nil {
+			child = &builderNode{}
+			node.children[name] = child
+		}
+		node = child
+	}
+	if node.children != nil {
+		return fmt.Errorf("key %#v has other keys below it", key)
+	}
+	id, err := b.rp.WriteBlob(blob)
+	if err != nil {
+		return err
+	}
+	node.blob = id
+	return nil
+}
+
+// SetMap calls Set for every key and blob of kv. Keys are split into their
+// components at slashes, e.g. "a/b" becomes []string{"a", "b"}.
+func (b *CommitBuilder) SetMap(kv map[string]io.Reader) error {
+	for key, blob := range kv {
+		if err := b.Set(strings.Split(key, "/"), blob); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Commit writes the trees for all keys that were set on top of the parent's
+// tree and a commit for them, and returns the id of the commit. Trees that
+// don't contain any of the keys are reused from the parent. The head is not
+// changed.
+func (b *CommitBuilder) Commit(msg []byte, t time.Time) (ID, error) {
+	commit := Commit{Time: t, Message: msg}
+	var treeID ID
+	if b.parent != nil {
+		parent, err := b.rp.Commit(b.parent)
+		if err != nil {
+			return nil, err
+		}
+		treeID = parent.Tree
+		commit.Parents = []ID{b.parent}
+	}
+	var err error
+	if commit.Tree, err = b.writeTree(treeID, b.root); err != nil {
+		return nil, err
+	}
+	return b.rp.WriteCommit(commit)
+}
+
+// writeTree writes the tree resulting from adding the keys below node to the
+// tree with the given id, which may be nil, and returns its id.
+func (b *CommitBuilder) writeTree(treeID ID, node *builderNode) (ID, error) {
+	var tree Tree
+	if treeID != nil {
+		existing, err := b.rp.Tree(treeID)
+		if err != nil {
+			return nil, err
+		}
+		tree = sortedTree(existing)
+	}
+	for name, child := range node.children {
+		if child.blob != nil {
+			tree = tree.Add(&Entry{Kind: KindBlob, Name: name, ID: child.blob})
+			continue
+		}
+		var subtreeID ID
+		if entry := tree.Get(name); entry != nil && entry.Kind == KindTree {
+			subtreeID = entry.ID
+		}
+		id, err := b.writeTree(subtreeID, child)
+		if err != nil {
+			return nil, err
+		}
+		tree = tree.Add(&Entry{Kind: KindTree, Name: name, ID: id})
+	}
+	return b.rp.WriteTree(tree)
+}
+
+// Batch collects keys like a CommitBuilder and commits them as a single
+// commit that becomes the new head.
+type Batch struct {
+	rp     Repo
+	root   *builderNode
+	prefix []string
+}
+
+// Batch returns an empty Batch for the repo.
+func (s *sugar) Batch() *Batch {
+	return &Batch{rp: s.Repo, root: &builderNode{}}
+}
+
+// Set writes the given blob and sets it as the value of key, see
+// CommitBuilder.Set.
+func (b *Batch) Set(key []string, blob io.Reader) error {
+	if len(b.prefix) > 0 {
+		if err := checkKey(key); err != nil {
+			return err
+		}
+		key = append(append([]string(nil), b.prefix...), key...)
+	}
+	return b.builder(nil).Set(key, blob)
+}
+
+// Commit writes the trees for all keys that were set on top of the tree of
+// the given parent commit, or of an empty tree if parent is nil, and a commit
+// for them. The head is set to the commit, whose id is returned.
+func (b *Batch) Commit(msg []byte, parent ID) (ID, error) {
+	id, err := b.builder(parent).Commit(msg, time.Now())
+	if err != nil {
+		return nil, err
+	} else if err := b.rp.WriteHead(id); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// builder returns a CommitBuilder for the keys of the batch.
+func (b *Batch) builder(parent ID) *CommitBuilder {
+	return &CommitBuilder{rp: b.rp, parent: parent, root: b.root}
+}
@@ -0,0 +1,108 @@
+package can
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCommitBuilder(t *testing.T) {
+	rp := tmpRepo()
+	first := testCommitSet(t, rp, []string{"keep", "me"}, "kept")
+	observed, m := NewObservedRepo(rp)
+	b := NewCommitBuilder(observed, first)
+	kv := map[string]string{
+		"a":       "1",
+		"b/c":     "2",
+		"b/d":     "3",
+		"b/e/f":   "4",
+		"b/e/g":   "5",
+		"keep/us": "6",
+	}
+	readers := map[string]io.Reader{}
+	for key, val := range kv {
+		readers[key] = strings.NewReader(val)
+	}
+	if err := b.SetMap(readers); err != nil {
+		t.Fatal(err)
+	}
+	id, err := b.Commit([]byte("batch"), time.Unix(1234, 0))
+	if err != nil {
+		t.Fatal(err)
+	} else if got := m.Calls("WriteTree"); got != 4 {
+		t.Fatalf("expected 4 tree writes, got: %d", got)
+	} else if err := rp.WriteHead(id); err != nil {
+		t.Fatal(err)
+	}
+	kv["keep/me"] = "kept"
+	s := NewSugar(rp)
+	for key, want := range kv {
+		rc, err := s.Get(strings.Split(key, "/"))
+		if err != nil {
+			t.Fatalf("%s: %s", key, err)
+		}
+		got, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		} else if string(got) != want {
+			t.Fatalf("bad value for %s: got=%q want=%q", key, got, want)
+		}
+	}
+	if commit, err := rp.Commit(id); err != nil {
+		t.Fatal(err)
+	} else if len(commit.Parents) != 1 || !commit.Parents[0].Equal(first) {
+		t.Fatalf("bad parents: %v", commit.Parents)
+	} else if string(commit.Message) != "batch" {
+		t.Fatalf("bad message: %q", commit.Message)
+	}
+	b = NewCommitBuilder(rp, nil)
+	if err := b.Set([]string{"a"}, strings.NewReader("1")); err != nil {
+		t.Fatal(err)
+	} else if err := b.Set([]string{"a", "b"}, strings.NewReader("2")); err == nil {
+		t.Fatal("expected error for key below another key")
+	} else if err := b.Set(nil, strings.NewReader("3")); err == nil {
+		t.Fatal("expected error for empty key")
+	}
+}
+
+func TestSugar_Batch(t *testing.T) {
+	rp := tmpRepo()
+	first := testCommitSet(t, rp, []string{"keep"}, "kept")
+	s := NewSugar(rp)
+	b := s.Batch()
+	kv := map[string]string{"a": "1", "b/c": "2", "b/d": "3"}
+	for key, val := range kv {
+		if err := b.Set(strings.Split(key, "/"), strings.NewReader(val)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	id, err := b.Commit([]byte("batch"), first)
+	if err != nil {
+		t.Fatal(err)
+	} else if head, err := rp.Head(); err != nil {
+		t.Fatal(err)
+	} else if !head.Equal(id) {
+		t.Fatalf("bad head: got=%s want=%s", head, id)
+	} else if commit, err := rp.Commit(id); err != nil {
+		t.Fatal(err)
+	} else if len(commit.Parents) != 1 || !commit.Parents[0].Equal(first) {
+		t.Fatalf("expected a single commit on top of %s, got parents: %v", first, commit.Parents)
+	}
+	kv["keep"] = "kept"
+	for key, want := range kv {
+		rc, err := s.Get(strings.Split(key, "/"))
+		if err != nil {
+			t.Fatalf("%s: %s", key, err)
+		}
+		got, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		} else if string(got) != want {
+			t.Fatalf("bad value for %s: got=%q want=%q", key, got, want)
+		}
+	}
+}
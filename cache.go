@@ -0,0 +1,289 @@
+package can
+
+import (
+	"bytes"
+	"container/list"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// NewBlobCache returns a Repo that caches the blobs read from inner in memory.
+// Once the cached blobs exceed maxBytes in total, the least recently used ones
+// are evicted. Blobs larger than maxBytes are never cached.
+func NewBlobCache(inner Repo, maxBytes int64) *BlobCache {
+	return &BlobCache{Repo: inner, lru: newLRU(maxBytes)}
+}
+
+// BlobCache is a Repo that caches blobs, see NewBlobCache. It is safe for
+// concurrent use if the inner Repo is.
+type BlobCache struct {
+	Repo
+	mu    sync.Mutex
+	lru   *lru
+	stats CacheStats
+}
+
+// CacheStats holds cache statistics.
+type CacheStats struct {
+	// Hits is the number of reads served from the cache.
+	Hits int64
+	// Misses is the number of reads passed through to the inner Repo.
+	Misses int64
+	// Bytes is the total size of the cached objects.
+	Bytes int64
+}
+
+// Stats returns the current cache statistics.
+func (c *BlobCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := c.stats
+	stats.Bytes = c.lru.size
+	return stats
+}
+
+// Blob is part of the Repo interface.
+func (c *BlobCache) Blob(id ID) (io.ReadCloser, error) {
+	c.mu.Lock()
+	val, ok := c.lru.Get(cacheKey(KindBlob, id))
+	if ok {
+		c.stats.Hits++
+	} else {
+		c.stats.Misses++
+	}
+	c.mu.Unlock()
+	if ok {
+		return ioutil.NopCloser(bytes.NewReader(val.([]byte))), nil
+	}
+	rc, err := c.Repo.Blob(id)
+	if err != nil {
+		return nil, err
+	}
+	// Read at most one byte more than fits into the cache. If that reaches
+	// the end of the blob, it has been verified and can be cached.
+	data, err := ioutil.ReadAll(io.LimitReader(rc, c.lru.maxBytes+1))
+	if err != nil {
+		rc.Close()
+		return nil, err
+	} else if int64(len(data)) > c.lru.maxBytes {
+		return NewReadCloser(io.MultiReader(bytes.NewReader(data), rc), rc), nil
+	} else if err := rc.Close(); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	c.lru.Add(cacheKey(KindBlob, id), data, int64(len(data)))
+	c.mu.Unlock()
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// cacheKey returns the lru key of the object with the given kind and id.
+// Objects are cached by kind, so reading an id as the wrong kind, e.g. when
+// probing for the kind of an object, is passed through to the inner Repo
+// instead of returning a cached object of another kind.
+func cacheKey(kind Kind, id ID) string {
+	return string(kind) + " " + string(id)
+}
+
+// newLRU returns an lru that holds at most maxBytes.
+func newLRU(maxBytes int64) *lru {
+	return &lru{
+		maxBytes: maxBytes,
+		list:     list.New(),
+		items:    map[string]*list.Element{},
+	}
+}
+
+// lru is a least recently used cache that accounts for the size of its
+// values. It is not safe for concurrent use.
+type lru struct {
+	maxBytes int64
+	size     int64
+	list     *list.List
+	items    map[string]*list.Element
+}
+
+type lruItem struct {
+	key  string
+	val  interface{}
+	size int64
+}
+
+// Get returns the value for the given key and marks it as recently used.
+func (l *lru) Get(key string) (interface{}, bool) {
+	if e, ok := l.items[key]; ok {
+		l.list.MoveToFront(e)
+		return e.Value.(*lruItem).val, true
+	}
+	return nil, false
+}
+
+// Add adds the given value of the given size and evicts the least recently
+// used values until the cache fits into maxBytes. Values larger than maxBytes
+// are not added, in which case Add returns false.
+func (l *lru) Add(key string, val interface{}, size int64) bool {
+	if size > l.maxBytes {
+		return false
+	} else if e, ok := l.items[key]; ok {
+		l.remove(e)
+	}
+	l.items[key] = l.list.PushFront(&lruItem{key: key, val: val, size: size})
+	l.size += size
+	for l.size > l.maxBytes {
+		l.remove(l.list.Back())
+	}
+	return true
+}
+
+func (l *lru) remove(e *list.Element) {
+	item := l.list.Remove(e).(*lruItem)
+	delete(l.items, item.key)
+	l.size -= item.size
+}
+
+// NewCachedRepo returns a Repo that caches blobs like NewBlobCache, as well as
+// decoded trees and commits. Blobs get one half of maxBytes, and trees and
+// commits the other, so reading large blobs does not evict the trees and
+// commits needed to find them. Written trees and commits are added to the
+// cache, as they are likely to be read soon, e.g. when walking the history.
+func NewCachedRepo(inner Repo, maxBytes int64) *CachedRepo {
+	return &CachedRepo{
+		BlobCache: NewBlobCache(inner, maxBytes/2),
+		objects:   newLRU(maxBytes - maxBytes/2),
+	}
+}
+
+// CachedRepo is a Repo that caches objects, see NewCachedRepo. Objects are
+// immutable, so cached objects are only removed when they are evicted. It is
+// safe for concurrent use if the inner Repo is.
+type CachedRepo struct {
+	*BlobCache
+	// objects holds trees and commits, guarded by the mutex of BlobCache.
+	objects *lru
+}
+
+// Stats returns the current cache statistics.
+func (c *CachedRepo) Stats() CacheStats {
+	stats := c.BlobCache.Stats()
+	c.mu.Lock()
+	stats.Bytes += c.objects.size
+	c.mu.Unlock()
+	return stats
+}
+
+// objectOverhead is the estimated size of an object, excluding its contents.
+const objectOverhead = 64
+
+// Tree is part of the Repo interface.
+func (c *CachedRepo) Tree(id ID) (Tree, error) {
+	if val, ok := c.get(KindTree, id); ok {
+		return copyTree(val.(Tree)), nil
+	}
+	tree, err := c.Repo.Tree(id)
+	if err != nil {
+		return nil, err
+	}
+	c.addTree(id, tree)
+	return tree, nil
+}
+
+// WriteTree is part of the Repo interface.
+func (c *CachedRepo) WriteTree(t Tree) (ID, error) {
+	id, err := c.Repo.WriteTree(t)
+	if err != nil {
+		return nil, err
+	}
+	c.addTree(id, t)
+	return id, nil
+}
+
+// Commit is part of the Repo interface.
+func (c *CachedRepo) Commit(id ID) (Commit, error) {
+	if val, ok := c.get(KindCommit, id); ok {
+		return copyCommit(val.(Commit)), nil
+	}
+	commit, err := c.Repo.Commit(id)
+	if err != nil {
+		return Commit{}, err
+	}
+	c.addCommit(id, commit)
+	return commit, nil
+}
+
+// WriteCommit is part of the Repo interface.
+func (c *CachedRepo) WriteCommit(commit Commit) (ID, error) {
+	id, err := c.Repo.WriteCommit(commit)
+	if err != nil {
+		return nil, err
+	}
+	c.addCommit(id, commit)
+	return id, nil
+}
+
+// get returns the cached object with the given kind and id and updates the
+// stats.
+func (c *CachedRepo) get(kind Kind, id ID) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	val, ok := c.objects.Get(cacheKey(kind, id))
+	if ok {
+		c.stats.Hits++
+	} else {
+		c.stats.Misses++
+	}
+	return val, ok
+}
+
+func (c *CachedRepo) addTree(id ID, tree Tree) {
+	size := int64(objectOverhead)
+	for _, entry := range tree {
+		size += objectOverhead + int64(len(entry.Name)+len(entry.ID))
+	}
+	c.mu.Lock()
+	c.objects.Add(cacheKey(KindTree, id), copyTree(tree), size)
+	c.mu.Unlock()
+}
+
+func (c *CachedRepo) addCommit(id ID, commit Commit) {
+	size := int64(objectOverhead + len(commit.Tree) + len(commit.Author) + len(commit.Committer) + len(commit.Signature) + len(commit.Message))
+	for _, parent := range commit.Parents {
+		size += int64(len(parent))
+	}
+	c.mu.Lock()
+	c.objects.Add(cacheKey(KindCommit, id), copyCommit(commit), size)
+	c.mu.Unlock()
+}
+
+// copyTree returns a deep copy of t, so cached trees can't be modified by
+// callers.
+func copyTree(t Tree) Tree {
+	if t == nil {
+		return nil
+	}
+	cp := make(Tree, len(t))
+	for i, entry := range t {
+		e := *entry
+		e.ID = append(ID(nil), entry.ID...)
+		cp[i] = &e
+	}
+	return cp
+}
+
+// copyCommit returns a deep copy of c, see copyTree.
+func copyCommit(c Commit) Commit {
+	c.Tree = append(ID(nil), c.Tree...)
+	if c.Parents != nil {
+		parents := make([]ID, len(c.Parents))
+		for i, parent := range c.Parents {
+			parents[i] = append(ID(nil), parent...)
+		}
+		c.Parents = parents
+	}
+	if c.Signature != nil {
+		c.Signature = append([]byte(nil), c.Signature...)
+	}
+	if c.Message != nil {
+		c.Message = append([]byte(nil), c.Message...)
+	}
+	return c
+}
@@ -0,0 +1,190 @@
+package can
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestBlobCache(t *testing.T) {
+	var (
+		rp     = NewBlobCache(tmpRepo(), 10)
+		ids    = map[string]ID{}
+		checks = []struct {
+			Data string
+			Hit  bool
+		}{
+			{Data: "aaaa", Hit: false},
+			{Data: "aaaa", Hit: true},
+			{Data: "bbbb", Hit: false},
+			{Data: "aaaa", Hit: true},
+			// Evicts bbbb, the least recently used blob.
+			{Data: "cccc", Hit: false},
+			{Data: "aaaa", Hit: true},
+			{Data: "cccc", Hit: true},
+			{Data: "bbbb", Hit: false},
+			// Larger than the cache, so it is never cached.
+			{Data: "xxxxxxxxxxx", Hit: false},
+			{Data: "xxxxxxxxxxx", Hit: false},
+		}
+	)
+	for _, check := range checks {
+		if ids[check.Data] != nil {
+			continue
+		}
+		id, err := rp.WriteBlob(strings.NewReader(check.Data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[check.Data] = id
+	}
+	for i, check := range checks {
+		before := rp.Stats()
+		if rc, err := rp.Blob(ids[check.Data]); err != nil {
+			t.Fatal(err)
+		} else if data, err := ioutil.ReadAll(rc); err != nil {
+			t.Fatal(err)
+		} else if err := rc.Close(); err != nil {
+			t.Fatal(err)
+		} else if string(data) != check.Data {
+			t.Fatalf("check %d: bad data: got=%q want=%q", i, data, check.Data)
+		}
+		after := rp.Stats()
+		if hit := after.Hits > before.Hits; hit != check.Hit {
+			t.Errorf("check %d: got hit=%t want hit=%t", i, hit, check.Hit)
+		} else if after.Bytes > 10 {
+			t.Errorf("check %d: cache too large: %d", i, after.Bytes)
+		}
+	}
+	if stats := rp.Stats(); stats.Hits != 4 || stats.Misses != 6 || stats.Bytes != 8 {
+		t.Fatalf("bad stats: %#v", stats)
+	}
+}
+
+// readCountingRepo counts the trees and commits read from the wrapped Repo.
+type readCountingRepo struct {
+	Repo
+	Trees   int
+	Commits int
+}
+
+func (r *readCountingRepo) Tree(id ID) (Tree, error) {
+	r.Trees++
+	return r.Repo.Tree(id)
+}
+
+func (r *readCountingRepo) Commit(id ID) (Commit, error) {
+	r.Commits++
+	return r.Repo.Commit(id)
+}
+
+func TestCachedRepo(t *testing.T) {
+	inner := &readCountingRepo{Repo: tmpRepo()}
+	head := testCommitSet(t, inner, []string{"foo"}, "a")
+	commit, err := inner.Repo.Commit(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inner.Trees, inner.Commits = 0, 0
+	rp := NewCachedRepo(inner, 1024)
+	for i := 0; i < 2; i++ {
+		tree, err := rp.Tree(commit.Tree)
+		if err != nil {
+			t.Fatal(err)
+		} else if len(tree) != 1 || tree[0].Name != "foo" {
+			t.Fatalf("bad tree: %#v", tree)
+		}
+		// Modifying a returned tree must not affect the cache.
+		tree[0].Name = "modified"
+		if _, err := rp.Commit(head); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if inner.Trees != 1 || inner.Commits != 1 {
+		t.Fatalf("bad inner reads: trees=%d commits=%d", inner.Trees, inner.Commits)
+	} else if stats := rp.Stats(); stats.Hits != 2 || stats.Misses != 2 {
+		t.Fatalf("bad stats: %#v", stats)
+	}
+	treeID, err := rp.WriteTree(Tree{{Kind: KindBlob, Name: "bar", ID: MustID("0123")}})
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := rp.Tree(treeID); err != nil {
+		t.Fatal(err)
+	} else if inner.Trees != 1 {
+		t.Fatal("written tree was not cached")
+	}
+}
+
+func TestCachedRepo_LargeBlob(t *testing.T) {
+	inner := &readCountingRepo{Repo: tmpRepo()}
+	head := testCommitSet(t, inner, []string{"foo"}, "a")
+	commit, err := inner.Repo.Commit(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobID, err := inner.WriteBlob(strings.NewReader(strings.Repeat("x", 1000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp := NewCachedRepo(inner, 1024)
+	if _, err := rp.Commit(head); err != nil {
+		t.Fatal(err)
+	} else if _, err := rp.Tree(commit.Tree); err != nil {
+		t.Fatal(err)
+	}
+	inner.Trees, inner.Commits = 0, 0
+	// The blob fits into the whole budget, but must not evict the tree and
+	// commit.
+	if rc, err := rp.Blob(blobID); err != nil {
+		t.Fatal(err)
+	} else {
+		rc.Close()
+	}
+	if _, err := rp.Commit(head); err != nil {
+		t.Fatal(err)
+	} else if _, err := rp.Tree(commit.Tree); err != nil {
+		t.Fatal(err)
+	} else if inner.Trees != 0 || inner.Commits != 0 {
+		t.Fatalf("blob evicted cached objects: trees=%d commits=%d", inner.Trees, inner.Commits)
+	}
+}
+
+func TestCachedRepo_Kinds(t *testing.T) {
+	inner := tmpRepo()
+	head := testCommitSet(t, inner, []string{"foo"}, "a")
+	commit, err := inner.Commit(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := inner.Tree(commit.Tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp := NewCachedRepo(inner, 1024)
+	// Cache each object as its own kind, then read it as the other kinds.
+	if _, err := rp.Commit(head); err != nil {
+		t.Fatal(err)
+	} else if _, err := rp.Tree(commit.Tree); err != nil {
+		t.Fatal(err)
+	} else if rc, err := rp.Blob(tree[0].ID); err != nil {
+		t.Fatal(err)
+	} else {
+		rc.Close()
+	}
+	for _, id := range []ID{head, commit.Tree, tree[0].ID} {
+		kind, err := objectKind(rp, id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rp.Tree(id); (err == nil) != (kind == KindTree) {
+			t.Fatalf("Tree of %s %s: %v", kind, id, err)
+		} else if _, err := rp.Commit(id); (err == nil) != (kind == KindCommit) {
+			t.Fatalf("Commit of %s %s: %v", kind, id, err)
+		}
+	}
+	if refs, err := References(rp, head); err != nil {
+		t.Fatal(err)
+	} else if len(refs) != 1 || !refs[0].Equal(commit.Tree) {
+		t.Fatalf("bad references: %v", refs)
+	}
+}
@@ -1,8 +1,16 @@
 package can
 
-import "io/ioutil"
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
 
 func tmpRepo() Repo {
+	return tmpDirRepo()
+}
+
+func tmpDirRepo() *DirRepo {
 	dir, err := ioutil.TempDir("", "")
 	if err != nil {
 		panic(err)
@@ -13,3 +21,35 @@ func tmpRepo() Repo {
 	}
 	return rp
 }
+
+// testCommitSet sets key to val on top of the head of rp, commits the
+// resulting tree and advances the head. It returns the ID of the new head.
+func testCommitSet(t *testing.T, rp Repo, key []string, val string) ID {
+	s := NewSugar(rp)
+	var commit Commit
+	head, err := rp.Head()
+	if err == nil {
+		if commit, err = rp.Commit(head); err != nil {
+			t.Fatal(err)
+		}
+	} else if !IsNotFound(err) {
+		t.Fatal(err)
+	}
+	treeID, err := s.Set(commit.Tree, key, strings.NewReader(val))
+	if err != nil {
+		t.Fatal(err)
+	} else if treeID == nil {
+		return head
+	}
+	commit = Commit{Tree: treeID, Message: []byte(strings.Join(key, "/") + "=" + val)}
+	if head != nil {
+		commit.Parents = []ID{head}
+	}
+	id, err := rp.WriteCommit(commit)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := rp.WriteHead(id); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
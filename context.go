@@ -0,0 +1,40 @@
+package can
+
+import (
+	"context"
+	"io"
+)
+
+// BlobContext is like Blob, but reading from the returned ReadCloser fails
+// with the error of ctx once ctx is done.
+func (d *DirRepo) BlobContext(ctx context.Context, id ID) (io.ReadCloser, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	rc, err := d.Blob(id)
+	if err != nil {
+		return nil, err
+	}
+	return NewReadCloser(&ctxReader{ctx: ctx, r: rc}, rc), nil
+}
+
+// WriteBlobContext is like WriteBlob, but stops reading from r once ctx is
+// done, in which case the blob is not stored and the error of ctx is
+// returned.
+func (d *DirRepo) WriteBlobContext(ctx context.Context, r io.Reader) (ID, error) {
+	return d.write(&ctxReader{ctx: ctx, r: r})
+}
+
+// ctxReader is an io.Reader that returns the error of ctx instead of reading
+// from r once ctx is done.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
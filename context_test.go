@@ -0,0 +1,67 @@
+package can
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// cancelReader reads from r and calls cancel after the first read.
+type cancelReader struct {
+	r      io.Reader
+	cancel context.CancelFunc
+}
+
+func (c *cancelReader) Read(p []byte) (int, error) {
+	defer c.cancel()
+	return c.r.Read(p[:1])
+}
+
+func TestDirRepo_WriteBlobContext(t *testing.T) {
+	rp := tmpDirRepo()
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &cancelReader{r: strings.NewReader("Hello"), cancel: cancel}
+	if _, err := rp.WriteBlobContext(ctx, r); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got: %v", err)
+	}
+	if ids, err := rp.Objects(); err != nil {
+		t.Fatal(err)
+	} else if len(ids) != 0 {
+		t.Fatalf("canceled blob was stored: %s", ids)
+	} else if files, err := ioutil.ReadDir(rp.tmp); err != nil {
+		t.Fatal(err)
+	} else if len(files) != 0 {
+		t.Fatalf("temp files left behind: %d", len(files))
+	}
+	id, err := rp.WriteBlobContext(context.Background(), strings.NewReader("Hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlob(t, rp, []byte("Hello"), id)
+}
+
+func TestDirRepo_BlobContext(t *testing.T) {
+	rp := tmpDirRepo()
+	id, err := rp.WriteBlob(strings.NewReader("Hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	rc, err := rp.BlobContext(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(rc, buf); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, err := ioutil.ReadAll(rc); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got: %v", err)
+	} else if _, err := rp.BlobContext(ctx, id); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got: %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package can
+
+import (
+	"bufio"
+	"bytes"
+	"hash/fnv"
+	"io"
+)
+
+// ChangeType describes how a blob differs between two trees.
+type ChangeType string
+
+const (
+	ChangeAdded    ChangeType = "added"
+	ChangeRemoved  ChangeType = "removed"
+	ChangeModified ChangeType = "modified"
+)
+
+// Change describes a blob that differs between two trees, either by its id or
+// by its mode. Old is nil for added blobs, and New is nil for removed blobs.
+type Change struct {
+	Path []string
+	Type ChangeType
+	Old  ID
+	New  ID
+}
+
+// Diff returns the changes needed to turn the tree with the id a into the tree
+// with the id b, ordered by path. A nil id is treated as an empty tree.
+// Subtrees with the same id on both sides are not read. Adding or removing a
+// subtree produces a change for every blob below it.
+func Diff(rp Repo, a, b ID) ([]Change, error) {
+	var changes []Change
+	if err := diffTrees(rp, nil, a, b, &changes); err != nil {
+		return nil, err
+	}
+	return changes, nil
+}
+
+// diffTrees appends the changes between the trees a and b, found below path,
+// to changes.
+func diffTrees(rp Repo, path []string, a, b ID, changes *[]Change) error {
+	if a.Equal(b) {
+		return nil
+	}
+	var treeA, treeB Tree
+	var err error
+	if a != nil {
+		if treeA, err = rp.Tree(a); err != nil {
+			return err
+		}
+	}
+	if b != nil {
+		if treeB, err = rp.Tree(b); err != nil {
+			return err
+		}
+	}
+	for len(treeA) > 0 || len(treeB) > 0 {
+		var entryA, entryB *Entry
+		switch {
+		case len(treeB) == 0 || (len(treeA) > 0 && treeA[0].Name < treeB[0].Name):
+			entryA, treeA = treeA[0], treeA[1:]
+		case len(treeA) == 0 || treeB[0].Name < treeA[0].Name:
+			entryB, treeB = treeB[0], treeB[1:]
+		default:
+			entryA, treeA = treeA[0], treeA[1:]
+			entryB, treeB = treeB[0], treeB[1:]
+		}
+		if err := diffEntries(rp, path, entryA, entryB, changes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// diffEntries appends the changes between the entries a and b, which have the
+// same name and either of which may be nil, to changes.
+func diffEntries(rp Repo, path []string, a, b *Entry, changes *[]Change) error {
+	var name string
+	var blobA, blobB, subtreeA, subtreeB ID
+	var modeA, modeB uint32
+	if a != nil {
+		name, modeA = a.Name, a.Mode
+		if a.Kind == KindTree {
+			subtreeA = a.ID
+		} else {
+			blobA = a.ID
+		}
+	}
+	if b != nil {
+		name, modeB = b.Name, b.Mode
+		if b.Kind == KindTree {
+			subtreeB = b.ID
+		} else {
+			blobB = b.ID
+		}
+	}
+	entryPath := make([]string, len(path)+1)
+	copy(entryPath, path)
+	entryPath[len(path)] = name
+	switch {
+	case blobA != nil && blobB != nil:
+		if !blobA.Equal(blobB) || modeA != modeB {
+			*changes = append(*changes, Change{Path: entryPath, Type: ChangeModified, Old: blobA, New: blobB})
+		}
+	case blobA != nil:
+		*changes = append(*changes, Change{Path: entryPath, Type: ChangeRemoved, Old: blobA})
+	case blobB != nil:
+		*changes = append(*changes, Change{Path: entryPath, Type: ChangeAdded, New: blobB})
+	}
+	return diffTrees(rp, entryPath, subtreeA, subtreeB, changes)
+}
+
+// Stat summarizes the changes between two trees, like the last line printed by
+// git diff --stat.
+type Stat struct {
+	FilesChanged int
+	Insertions   int
+	Deletions    int
+}
+
+// DiffStat returns the Stat of the changes Diff returns for the trees with the
+// ids a and b. Lines are counted for text blobs, which are read one line at a
+// time. A line of a modified blob counts as inserted or deleted if it occurs
+// more often in the new or old blob respectively, so unlike git, moved lines
+// are not counted. Binary blobs count as one inserted and/or deleted line.
+func DiffStat(rp Repo, a, b ID) (Stat, error) {
+	changes, err := Diff(rp, a, b)
+	if err != nil {
+		return Stat{}, err
+	}
+	stat := Stat{FilesChanged: len(changes)}
+	for _, c := range changes {
+		if c.Old.Equal(c.New) {
+			// Only the mode changed.
+			continue
+		}
+		lines := map[uint64]int{}
+		binary := false
+		for _, side := range []struct {
+			id    ID
+			delta int
+		}{{c.Old, 1}, {c.New, -1}} {
+			if side.id == nil {
+				continue
+			}
+			text, err := countLines(rp, side.id, side.delta, lines)
+			if err != nil {
+				return Stat{}, err
+			}
+			binary = binary || !text
+		}
+		if binary {
+			if c.Old != nil {
+				stat.Deletions++
+			}
+			if c.New != nil {
+				stat.Insertions++
+			}
+			continue
+		}
+		for _, n := range lines {
+			if n > 0 {
+				stat.Deletions += n
+			} else {
+				stat.Insertions -= n
+			}
+		}
+	}
+	return stat, nil
+}
+
+// binaryCheckSize is the number of bytes at the start of a blob that are
+// checked by isText, like git does.
+const binaryCheckSize = 8000
+
+// countLines adds delta to the count of every line of the blob with the given
+// id in lines, keyed by the hash of the line, and returns true. It returns
+// false without counting anything if the blob is not text.
+func countLines(rp Repo, id ID, delta int, lines map[uint64]int) (bool, error) {
+	rc, err := rp.Blob(id)
+	if err != nil {
+		return false, err
+	}
+	defer rc.Close()
+	br := bufio.NewReaderSize(rc, binaryCheckSize)
+	if head, err := br.Peek(binaryCheckSize); err != nil && err != io.EOF {
+		return false, err
+	} else if !isText(head) {
+		return false, nil
+	}
+	h := fnv.New64a()
+	for n := 0; ; {
+		line, err := br.ReadSlice('\n')
+		if err != nil && err != bufio.ErrBufferFull && err != io.EOF {
+			return false, err
+		}
+		h.Write(line)
+		n += len(line)
+		if err == bufio.ErrBufferFull {
+			// Lines longer than the buffer are hashed in several parts.
+			continue
+		} else if n > 0 {
+			lines[h.Sum64()] += delta
+			h.Reset()
+			n = 0
+		}
+		if err == io.EOF {
+			return true, nil
+		}
+	}
+}
+
+// isText returns true if data, the start of a blob, does not contain a NUL
+// byte.
+func isText(data []byte) bool {
+	return bytes.IndexByte(data, 0) == -1
+}
@@ -0,0 +1,92 @@
+package can
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestDiff(t *testing.T) {
+	rp := tmpRepo()
+	s := NewSugar(rp)
+	blobs := map[string]ID{}
+	set := func(treeID ID, key, val string) ID {
+		id, err := s.Set(treeID, strings.Split(key, "/"), strings.NewReader(val))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if blobs[val], err = rp.WriteBlob(strings.NewReader(val)); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	a := set(nil, "a/b/c", "1")
+	a = set(a, "a/b/d", "2")
+	a = set(a, "a/e", "3")
+	a = set(a, "same/x", "4")
+	a = set(a, "kind", "5")
+	b := set(nil, "a/b/c", "1")
+	b = set(b, "a/b/d", "6")
+	b = set(b, "a/f/g", "7")
+	b = set(b, "same/x", "4")
+	b = set(b, "kind/h", "8")
+	got, err := Diff(rp, a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Change{
+		{Path: []string{"a", "b", "d"}, Type: ChangeModified, Old: blobs["2"], New: blobs["6"]},
+		{Path: []string{"a", "e"}, Type: ChangeRemoved, Old: blobs["3"]},
+		{Path: []string{"a", "f", "g"}, Type: ChangeAdded, New: blobs["7"]},
+		{Path: []string{"kind"}, Type: ChangeRemoved, Old: blobs["5"]},
+		{Path: []string{"kind", "h"}, Type: ChangeAdded, New: blobs["8"]},
+	}
+	if diff := pretty.Compare(got, want); diff != "" {
+		t.Fatal(diff)
+	}
+	if got, err := Diff(rp, a, a); err != nil {
+		t.Fatal(err)
+	} else if len(got) != 0 {
+		t.Fatalf("expected no changes, got: %#v", got)
+	}
+	if got, err := Diff(rp, nil, b); err != nil {
+		t.Fatal(err)
+	} else if len(got) != 5 {
+		t.Fatalf("expected 5 added blobs, got: %#v", got)
+	}
+}
+
+func TestDiffStat(t *testing.T) {
+	rp := tmpRepo()
+	s := NewSugar(rp)
+	set := func(treeID ID, key, val string) ID {
+		id, err := s.Set(treeID, strings.Split(key, "/"), strings.NewReader(val))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	long := strings.Repeat("x", 3*binaryCheckSize)
+	a := set(nil, "removed", "1\n2\n3")
+	a = set(a, "dir/modified", "a\nb\nc\n"+long+"\n")
+	a = set(a, "same", "same\n")
+	a = set(a, "binary", "\x00a")
+	b := set(nil, "added", "1\n2\n")
+	b = set(b, "dir/modified", "a\nB\nc\nd\n"+long+"\n")
+	b = set(b, "same", "same\n")
+	b = set(b, "binary", "\x00b")
+	got, err := DiffStat(rp, a, b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Stat{FilesChanged: 4, Insertions: 2 + 2 + 1, Deletions: 3 + 1 + 1}
+	if diff := pretty.Compare(got, want); diff != "" {
+		t.Fatal(diff)
+	}
+	if got, err := DiffStat(rp, a, a); err != nil {
+		t.Fatal(err)
+	} else if got != (Stat{}) {
+		t.Fatalf("expected empty stat, got: %#v", got)
+	}
+}
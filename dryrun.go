@@ -0,0 +1,78 @@
+package can
+
+import (
+	"crypto/sha1"
+	"hash"
+	"io"
+	"io/ioutil"
+)
+
+// SetDryRun is like Set, but does not store any objects. It reports whether
+// Set would change the tree with the given id, and the id of the tree Set
+// would return, or treeID if nothing would change. The ids of new objects are
+// computed with the Format and hash of the repo if it is a *DirRepo, and with
+// the default format and sha1 otherwise, so they are only an estimate for
+// other repos.
+func (s *sugar) SetDryRun(treeID ID, key []string, blob io.Reader) (bool, ID, error) {
+	dry := &sugar{Repo: newDryRunRepo(s.Repo)}
+	newID, err := dry.Set(treeID, key, blob)
+	if err != nil {
+		return false, nil, err
+	} else if newID == nil {
+		return false, treeID, nil
+	}
+	return true, newID, nil
+}
+
+// newDryRunRepo returns a Repo that reads from rp, but discards all objects
+// written to it after computing their ids.
+func newDryRunRepo(rp Repo) Repo {
+	dr := &dryRunRepo{Repo: rp, format: NewDefaultFormat(), newHash: sha1.New}
+	if d, ok := rp.(*DirRepo); ok {
+		dr.format, dr.newHash = d.Format, d.newHash
+	}
+	// Sealed formats are hashed before sealing, see Sealer.
+	if s, ok := dr.format.(Sealer); ok {
+		dr.format = s.Unsealed()
+	}
+	return dr
+}
+
+// dryRunRepo implements the Repo interface.
+type dryRunRepo struct {
+	Repo
+	format  Format
+	newHash func() hash.Hash
+}
+
+func (d *dryRunRepo) WriteBlob(r io.Reader) (ID, error) {
+	iw := newIDWriter(ioutil.Discard, d.newHash())
+	if err := d.format.EncodeBlob(iw, r); err != nil {
+		return nil, err
+	}
+	return iw.ID(), nil
+}
+
+func (d *dryRunRepo) WriteTree(t Tree) (ID, error) {
+	iw := newIDWriter(ioutil.Discard, d.newHash())
+	if err := d.format.EncodeTree(iw, t); err != nil {
+		return nil, err
+	}
+	return iw.ID(), nil
+}
+
+func (d *dryRunRepo) WriteCommit(c Commit) (ID, error) {
+	iw := newIDWriter(ioutil.Discard, d.newHash())
+	if err := d.format.EncodeCommit(iw, c); err != nil {
+		return nil, err
+	}
+	return iw.ID(), nil
+}
+
+func (d *dryRunRepo) WriteHead(id ID) error {
+	return nil
+}
+
+func (d *dryRunRepo) WriteRef(name string, id ID) error {
+	return checkRefName(name)
+}
@@ -0,0 +1,64 @@
+package can
+
+import (
+	"crypto"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestSugar_SetDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha256Repo := NewDirRepo(dir)
+	sha256Repo.Hash = crypto.SHA256
+	if err := sha256Repo.Init(); err != nil {
+		t.Fatal(err)
+	}
+	for _, rp := range []*DirRepo{tmpDirRepo(), sha256Repo} {
+		s := NewSugar(rp)
+		treeID, err := s.Set(nil, []string{"a", "b"}, strings.NewReader("1"))
+		if err != nil {
+			t.Fatal(err)
+		} else if len(treeID) != rp.Hash.Size() {
+			t.Fatalf("bad id length: %s", treeID)
+		}
+		tests := []struct {
+			Key  []string
+			Val  string
+			Want bool
+		}{
+			{Key: []string{"a", "b"}, Val: "1", Want: false},
+			{Key: []string{"a", "b"}, Val: "2", Want: true},
+			{Key: []string{"a", "c"}, Val: "1", Want: true},
+			{Key: []string{"d"}, Val: "3", Want: true},
+		}
+		for _, test := range tests {
+			before, err := rp.Objects()
+			if err != nil {
+				t.Fatal(err)
+			}
+			changed, estimate, err := s.SetDryRun(treeID, test.Key, strings.NewReader(test.Val))
+			if err != nil {
+				t.Fatal(err)
+			} else if changed != test.Want {
+				t.Fatalf("%#v=%q: got=%t want=%t", test.Key, test.Val, changed, test.Want)
+			} else if after, err := rp.Objects(); err != nil {
+				t.Fatal(err)
+			} else if len(after) != len(before) {
+				t.Fatalf("dry run stored %d objects", len(after)-len(before))
+			}
+			want, err := s.Set(treeID, test.Key, strings.NewReader(test.Val))
+			if err != nil {
+				t.Fatal(err)
+			} else if want == nil {
+				want = treeID
+			}
+			if !estimate.Equal(want) {
+				t.Fatalf("%#v=%q: got=%s want=%s", test.Key, test.Val, estimate, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package can
+
+import (
+	"crypto/sha1"
+	"hash"
+	"io/ioutil"
+)
+
+// EmptyTreeID returns the id of the empty tree for the given Format and hash
+// function without storing it. A nil newHash defaults to sha1, like DirRepo.
+func EmptyTreeID(f Format, newHash func() hash.Hash) (ID, error) {
+	if newHash == nil {
+		newHash = sha1.New
+	}
+	// Sealed formats are hashed before sealing, see Sealer.
+	if s, ok := f.(Sealer); ok {
+		f = s.Unsealed()
+	}
+	iw := newIDWriter(ioutil.Discard, newHash())
+	if err := f.EncodeTree(iw, nil); err != nil {
+		return nil, err
+	}
+	return iw.ID(), nil
+}
+
+// EmptyTree returns the id of the empty tree of the repo without storing it.
+func (d *DirRepo) EmptyTree() (ID, error) {
+	return EmptyTreeID(d.Format, d.newHash)
+}
+
+// WriteEmptyTree stores the empty tree in rp and returns its id.
+func WriteEmptyTree(rp Repo) (ID, error) {
+	return rp.WriteTree(nil)
+}
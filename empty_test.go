@@ -0,0 +1,44 @@
+package can
+
+import (
+	"crypto"
+	"io/ioutil"
+	"testing"
+)
+
+func TestEmptyTree(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha256Repo := NewDirRepo(dir)
+	sha256Repo.Hash = crypto.SHA256
+	if err := sha256Repo.Init(); err != nil {
+		t.Fatal(err)
+	}
+	repos := map[string]*DirRepo{
+		"default":   tmpDirRepo(),
+		"encrypted": tmpEncryptedRepo(t),
+		"sha256":    sha256Repo,
+	}
+	for name, rp := range repos {
+		want, err := rp.EmptyTree()
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		} else if ok, err := rp.Exists(want); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		} else if ok {
+			t.Fatalf("%s: EmptyTree stored the tree", name)
+		}
+		if got, err := WriteEmptyTree(rp); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		} else if !got.Equal(want) {
+			t.Fatalf("%s: got=%s want=%s", name, got, want)
+		}
+	}
+	if id, err := EmptyTreeID(NewDefaultFormat(), nil); err != nil {
+		t.Fatal(err)
+	} else if want := MustID("7a1e081e78d460b482b7d71436a46811e7ebd091"); !id.Equal(want) {
+		t.Fatalf("got=%s want=%s", id, want)
+	}
+}
@@ -0,0 +1,146 @@
+package can
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+)
+
+// NewEncryptedFormat returns a Format that encrypts the output of inner with
+// AES-GCM, using the given 16, 24 or 32 byte key. Every object is sealed with
+// a random nonce that is stored in front of its ciphertext.
+//
+// The returned Format implements Sealer, so repos compute object IDs over the
+// unencrypted encoding produced by inner. This keeps objects content
+// addressable and allows deduplication despite the random nonces.
+func NewEncryptedFormat(inner Format, key []byte) (Format, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptedFormat{inner: inner, aead: aead}, nil
+}
+
+// AuthError is returned when an encrypted object can not be authenticated,
+// e.g. because it has been tampered with or the wrong key was used.
+type AuthError string
+
+func (a AuthError) Error() string { return string(a) }
+
+// encryptedFormat implements the Format and Sealer interfaces.
+type encryptedFormat struct {
+	inner Format
+	aead  cipher.AEAD
+}
+
+// FormatInfo is part of the FormatDescriber interface.
+func (f *encryptedFormat) FormatInfo() (string, int) {
+	name, version := formatInfo(f.inner)
+	return "aes-gcm+" + name, version
+}
+
+// Unsealed is part of the Sealer interface.
+func (f *encryptedFormat) Unsealed() Format {
+	return f.inner
+}
+
+// Seal is part of the Sealer interface.
+func (f *encryptedFormat) Seal(w io.Writer) io.WriteCloser {
+	return &sealWriter{aead: f.aead, w: w}
+}
+
+// Unseal is part of the Sealer interface.
+func (f *encryptedFormat) Unseal(r io.Reader) (io.Reader, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	size := f.aead.NonceSize()
+	if len(data) < size {
+		return nil, AuthError("encrypted object too short")
+	}
+	plain, err := f.aead.Open(nil, data[:size], data[size:], nil)
+	if err != nil {
+		return nil, AuthError("encrypted object failed authentication: " + err.Error())
+	}
+	return bytes.NewReader(plain), nil
+}
+
+// EncodeBlob is part of the Format interface.
+func (f *encryptedFormat) EncodeBlob(w io.Writer, r io.Reader) error {
+	return f.seal(w, func(w io.Writer) error { return f.inner.EncodeBlob(w, r) })
+}
+
+// DecodeBlob is part of the Format interface.
+func (f *encryptedFormat) DecodeBlob(r io.Reader) (io.Reader, error) {
+	if r, err := f.Unseal(r); err != nil {
+		return nil, err
+	} else {
+		return f.inner.DecodeBlob(r)
+	}
+}
+
+// EncodeTree is part of the Format interface.
+func (f *encryptedFormat) EncodeTree(w io.Writer, t Tree) error {
+	return f.seal(w, func(w io.Writer) error { return f.inner.EncodeTree(w, t) })
+}
+
+// DecodeTree is part of the Format interface.
+func (f *encryptedFormat) DecodeTree(r io.Reader) (Tree, error) {
+	if r, err := f.Unseal(r); err != nil {
+		return nil, err
+	} else {
+		return f.inner.DecodeTree(r)
+	}
+}
+
+// EncodeCommit is part of the Format interface.
+func (f *encryptedFormat) EncodeCommit(w io.Writer, c Commit) error {
+	return f.seal(w, func(w io.Writer) error { return f.inner.EncodeCommit(w, c) })
+}
+
+// DecodeCommit is part of the Format interface.
+func (f *encryptedFormat) DecodeCommit(r io.Reader) (Commit, error) {
+	if r, err := f.Unseal(r); err != nil {
+		return Commit{}, err
+	} else {
+		return f.inner.DecodeCommit(r)
+	}
+}
+
+// seal calls encode with a writer that seals its output into w.
+func (f *encryptedFormat) seal(w io.Writer, encode func(io.Writer) error) error {
+	sw := f.Seal(w)
+	if err := encode(sw); err != nil {
+		return err
+	}
+	return sw.Close()
+}
+
+// sealWriter buffers all data written to it, and writes it to w as a single
+// nonce prefixed ciphertext when closed.
+type sealWriter struct {
+	aead cipher.AEAD
+	w    io.Writer
+	buf  bytes.Buffer
+}
+
+func (s *sealWriter) Write(p []byte) (int, error) {
+	return s.buf.Write(p)
+}
+
+func (s *sealWriter) Close() error {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	_, err := s.w.Write(s.aead.Seal(nonce, nonce, s.buf.Bytes(), nil))
+	return err
+}
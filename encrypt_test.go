@@ -0,0 +1,142 @@
+package can
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func tmpEncryptedRepo(t *testing.T) *DirRepo {
+	format, err := NewEncryptedFormat(NewDefaultFormat(), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp := NewDirRepo(dir)
+	rp.Format = format
+	if err := rp.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return rp
+}
+
+func TestEncryptedFormat(t *testing.T) {
+	rp := tmpEncryptedRepo(t)
+	// IDs are computed over the plaintext, so they match the default format.
+	data := []byte("Hello")
+	blobID := MustID("0cd5a7d8dc5a48bb59c0205146e4aac675dfe74a")
+	testBlob(t, rp, data, blobID)
+	if raw, err := ioutil.ReadFile(rp.path(blobID)); err != nil {
+		t.Fatal(err)
+	} else if bytes.Contains(raw, data) {
+		t.Fatalf("object is stored unencrypted: %q", raw)
+	}
+	tree := Tree{{Kind: KindBlob, Name: "hello", ID: blobID}}
+	treeID, err := rp.WriteTree(tree)
+	if err != nil {
+		t.Fatal(err)
+	} else if got, err := rp.Tree(treeID); err != nil {
+		t.Fatal(err)
+	} else if diff := pretty.Compare(got, tree); diff != "" {
+		t.Fatalf("%s", diff)
+	}
+	commit := Commit{
+		Tree:    treeID,
+		Time:    time.Date(2015, 2, 20, 13, 14, 33, 0, time.FixedZone("", 3600)),
+		Message: []byte("secret"),
+	}
+	commitID, err := rp.WriteCommit(commit)
+	if err != nil {
+		t.Fatal(err)
+	} else if got, err := rp.Commit(commitID); err != nil {
+		t.Fatal(err)
+	} else if diff := pretty.Compare(got, commit); diff != "" {
+		t.Fatalf("%s", diff)
+	}
+}
+
+func TestEncryptedFormat_Tampered(t *testing.T) {
+	rp := tmpEncryptedRepo(t)
+	id, err := rp.WriteBlob(bytes.NewReader([]byte("Hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadFile(rp.path(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[len(raw)-1] ^= 1
+	if err := ioutil.WriteFile(rp.path(id), raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rp.Blob(id); err == nil {
+		t.Fatal("expected error for tampered object")
+	} else if _, ok := err.(AuthError); !ok {
+		t.Fatalf("expected AuthError, got: %#v", err)
+	}
+	os.Remove(rp.path(id))
+	if _, err := rp.Blob(id); !IsNotFound(err) {
+		t.Fatalf("expected not found error, got: %v", err)
+	}
+}
+
+func TestEncryptedFormat_Wrapped(t *testing.T) {
+	encrypted, err := NewEncryptedFormat(NewDefaultFormat(), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		Format Format
+		Plain  Format
+	}{
+		{Format: NewGzipFormat(encrypted), Plain: NewDefaultFormat()},
+		{Format: NewSortedParentsFormat(encrypted), Plain: NewSortedParentsFormat(NewDefaultFormat())},
+	}
+	for _, test := range tests {
+		if _, ok := test.Format.(Sealer); !ok {
+			t.Fatalf("%T: not a Sealer", test.Format)
+		}
+		var repos []*DirRepo
+		for _, format := range []Format{test.Format, test.Plain} {
+			dir, err := ioutil.TempDir("", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			rp := NewDirRepo(dir)
+			rp.Format = format
+			if err := rp.Init(); err != nil {
+				t.Fatal(err)
+			}
+			repos = append(repos, rp)
+		}
+		rp, plain := repos[0], repos[1]
+		// IDs are computed over the plaintext, so they match the plain format.
+		want := testCommitSet(t, plain, []string{"foo"}, "secret")
+		if got := testCommitSet(t, rp, []string{"foo"}, "secret"); !got.Equal(want) {
+			t.Fatalf("%T: got=%s want=%s", test.Format, got, want)
+		}
+		objects, err := rp.Objects()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range objects {
+			if raw, err := ioutil.ReadFile(rp.path(id)); err != nil {
+				t.Fatal(err)
+			} else if bytes.Contains(raw, []byte("secret")) {
+				t.Fatalf("%T: object is stored unencrypted: %q", test.Format, raw)
+			}
+		}
+		if errs := rp.Fsck(); len(errs) != 0 {
+			t.Fatalf("%T: %v", test.Format, errs)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package can
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// ExportTar writes the tree of the commit with the given id to w as a tar
+// archive. Blobs become files at their slash separated keys and trees become
+// directories, in ascending order of their names. Executable blobs keep their
+// mode, symlink blobs become symlinks, and KindRef entries become files or
+// directories holding the blob or tree they refer to. Refs leading to one of
+// their own parent trees are an error. All entries have the time of the
+// commit. The size of a file must be written before its data, so blobs are
+// buffered in memory unless the repo is a DirRepo whose BlobSize knows it.
+// This includes all blobs of a MemRepo, CachedRepo or ObservedRepo.
+func (s *sugar) ExportTar(commitID ID, w io.Writer) error {
+	return s.exportTar(commitID, nil, w)
+}
+
+// exportTar implements ExportTar for the tree below the given prefix of the
+// commit's tree, which is omitted from the names in the archive. The prefix
+// may contain KindRef entries.
+func (s *sugar) exportTar(commitID ID, prefix []string, w io.Writer) error {
+	commit, err := s.Commit(commitID)
+	if err != nil {
+		return err
+	}
+	treeID := commit.Tree
+	if len(prefix) > 0 {
+		if entry, err := s.resolve(commit.Tree, prefix); err != nil {
+			return err
+		} else if entry == nil || entry.Kind != KindTree {
+			return notFoundError(fmt.Sprintf("tree not found for prefix: %#v", prefix))
+		} else {
+			treeID = entry.ID
+		}
+	}
+	e := &tarExporter{
+		s:       s,
+		tw:      tar.NewWriter(w),
+		root:    commit.Tree,
+		time:    commit.Time,
+		prefix:  prefix,
+		parents: map[string]bool{},
+	}
+	if err := e.tree(treeID, nil); err != nil {
+		return err
+	}
+	return e.tw.Close()
+}
+
+// tarExporter writes the entries of a tree to a tar archive.
+type tarExporter struct {
+	s      *sugar
+	tw     *tar.Writer
+	root   ID
+	time   time.Time
+	prefix []string
+	// parents holds the ids of the trees being written, which a ref must not
+	// lead back to.
+	parents map[string]bool
+}
+
+// tree writes the entries of the tree with the given id, which is found at the
+// given key.
+func (e *tarExporter) tree(id ID, key []string) error {
+	if e.parents[string(id)] {
+		return fmt.Errorf("ref cycle at key %#v", append(append([]string(nil), e.prefix...), key...))
+	}
+	e.parents[string(id)] = true
+	defer delete(e.parents, string(id))
+	tree, err := e.s.Tree(id)
+	if err != nil {
+		return err
+	}
+	for _, entry := range sortedTree(tree) {
+		entryKey := append(append([]string(nil), key...), entry.Name)
+		name := strings.Join(entryKey, "/")
+		if entry.Kind == KindRef {
+			fullKey := append(append([]string(nil), e.prefix...), entryKey...)
+			target, err := e.s.resolve(e.root, fullKey)
+			if err != nil {
+				return err
+			} else if target == nil {
+				return notFoundError(fmt.Sprintf("ref target not found for key %#v", fullKey))
+			}
+			// Keep the mode of the ref's target, but the name of the ref.
+			entry = &Entry{Kind: target.Kind, Mode: target.Mode, Name: entry.Name, ID: target.ID}
+		}
+		switch entry.Kind {
+		case KindTree:
+			hdr := &tar.Header{Typeflag: tar.TypeDir, Name: name + "/", Mode: 0755, ModTime: e.time}
+			if err := e.tw.WriteHeader(hdr); err != nil {
+				return err
+			} else if err := e.tree(entry.ID, entryKey); err != nil {
+				return err
+			}
+		case KindBlob:
+			if err := e.blob(name, entry.ID, entry.Mode); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown kind %q for entry %q", entry.Kind, name)
+		}
+	}
+	return nil
+}
+
+// blob writes the blob with the given id as a file with the given name and
+// entry mode.
+func (e *tarExporter) blob(name string, id ID, mode uint32) error {
+	size := int64(-1)
+	if bs, ok := e.s.Repo.(blobSizer); ok {
+		var err error
+		if size, err = bs.BlobSize(id); err != nil {
+			return err
+		}
+	}
+	rc, err := e.s.Blob(id)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	var r io.Reader = rc
+	if size < 0 || mode == ModeSymlink {
+		// The size must be known before writing the header.
+		data, err := ioutil.ReadAll(rc)
+		if err != nil {
+			return err
+		} else if mode == ModeSymlink {
+			hdr := &tar.Header{Typeflag: tar.TypeSymlink, Name: name, Linkname: string(data), Mode: 0777, ModTime: e.time}
+			return e.tw.WriteHeader(hdr)
+		}
+		size, r = int64(len(data)), bytes.NewReader(data)
+	}
+	hdr := &tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644, Size: size, ModTime: e.time}
+	if mode == ModeExecutable {
+		hdr.Mode = 0755
+	}
+	if err := e.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err = io.Copy(e.tw, r)
+	return err
+}
@@ -0,0 +1,124 @@
+package can
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestSugar_ExportTar(t *testing.T) {
+	for _, rp := range []Repo{tmpDirRepo(), NewMemRepo()} {
+		blob := func(data string) ID {
+			id, err := rp.WriteBlob(strings.NewReader(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return id
+		}
+		sub, err := rp.WriteTree(Tree{
+			{Kind: KindBlob, Name: "run", ID: blob("#!/bin/sh"), Mode: ModeExecutable},
+			{Kind: KindRef, Name: "alias", ID: blob("a")},
+			{Kind: KindBlob, Name: "link", ID: blob("../a"), Mode: ModeSymlink},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		root, err := rp.WriteTree(Tree{
+			{Kind: KindTree, Name: "b", ID: sub},
+			{Kind: KindBlob, Name: "a", ID: blob("hello")},
+			{Kind: KindRef, Name: "c", ID: blob("b")},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		commitTime := time.Unix(1424434473, 0)
+		commitID, err := rp.WriteCommit(Commit{Tree: root, Time: commitTime})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s := NewSugar(rp)
+		for _, test := range []struct {
+			Sugar Sugar
+			Want  []string
+		}{
+			{
+				Sugar: s,
+				Want: []string{
+					`a 0 644 "hello"`,
+					`b/ 5 755 ""`,
+					`b/alias 0 644 "hello"`,
+					`b/link 2 777 "../a"`,
+					`b/run 0 755 "#!/bin/sh"`,
+					`c/ 5 755 ""`,
+					`c/alias 0 644 "hello"`,
+					`c/link 2 777 "../a"`,
+					`c/run 0 755 "#!/bin/sh"`,
+				},
+			},
+			{
+				Sugar: s.Sub([]string{"b"}),
+				Want: []string{
+					`alias 0 644 "hello"`,
+					`link 2 777 "../a"`,
+					`run 0 755 "#!/bin/sh"`,
+				},
+			},
+			{
+				Sugar: s.Sub([]string{"c"}),
+				Want: []string{
+					`alias 0 644 "hello"`,
+					`link 2 777 "../a"`,
+					`run 0 755 "#!/bin/sh"`,
+				},
+			},
+		} {
+			var buf bytes.Buffer
+			if err := test.Sugar.ExportTar(commitID, &buf); err != nil {
+				t.Fatalf("%T: %s", rp, err)
+			}
+			var got []string
+			tr := tar.NewReader(&buf)
+			for {
+				hdr, err := tr.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				data, err := ioutil.ReadAll(tr)
+				if err != nil {
+					t.Fatal(err)
+				} else if !hdr.ModTime.Equal(commitTime) {
+					t.Errorf("%s: bad time: %s", hdr.Name, hdr.ModTime)
+				}
+				if hdr.Typeflag == tar.TypeSymlink {
+					data = []byte(hdr.Linkname)
+				}
+				got = append(got, fmt.Sprintf("%s %c %o %q", hdr.Name, hdr.Typeflag, hdr.Mode, data))
+			}
+			if diff := pretty.Compare(got, test.Want); diff != "" {
+				t.Fatalf("%T: %s", rp, diff)
+			}
+		}
+		if err := s.Sub([]string{"nope"}).ExportTar(commitID, ioutil.Discard); !IsNotFound(err) {
+			t.Fatalf("expected not found error, got: %v", err)
+		}
+		loop, err := rp.WriteTree(Tree{{Kind: KindRef, Name: "up", ID: blob("d")}})
+		if err != nil {
+			t.Fatal(err)
+		} else if root, err = rp.WriteTree(Tree{{Kind: KindTree, Name: "d", ID: loop}}); err != nil {
+			t.Fatal(err)
+		} else if commitID, err = rp.WriteCommit(Commit{Tree: root}); err != nil {
+			t.Fatal(err)
+		} else if err := s.ExportTar(commitID, ioutil.Discard); err == nil || !strings.Contains(err.Error(), "ref cycle") {
+			t.Fatalf("expected ref cycle error, got: %v", err)
+		}
+	}
+}
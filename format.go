@@ -2,6 +2,8 @@ package can
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/base64"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -13,6 +15,8 @@ import (
 
 // Format defines a serialization format. Encode/Decode pairs are guaranteed to
 // produce symmetrical output as determined by reflect.DeepEqual.
+// Implementations must be safe for concurrent use, as a single Format is
+// shared by all operations of a Repo.
 type Format interface {
 	// EncodeBlob encodes a blob to the given Writer.
 	EncodeBlob(io.Writer, io.Reader) error
@@ -28,6 +32,71 @@ type Format interface {
 	DecodeCommit(io.Reader) (Commit, error)
 }
 
+// Sealer is implemented by Formats that transform encoded objects before they
+// are stored, e.g. to encrypt them. Repos compute and verify object IDs over
+// the unsealed encoding, so sealing does not affect the ID of an object.
+type Sealer interface {
+	// Unsealed returns the Format used to encode objects before sealing.
+	Unsealed() Format
+	// Seal returns a WriteCloser that seals the data written to it into w. The
+	// data may be buffered until Close is called.
+	Seal(w io.Writer) io.WriteCloser
+	// Unseal returns a Reader for the unsealed contents of r.
+	Unseal(r io.Reader) (io.Reader, error)
+}
+
+// FormatDescriber is implemented by Formats that can describe their encoding
+// by name and version. Repos record this information so that a repo written
+// with a different Format can be detected.
+type FormatDescriber interface {
+	FormatInfo() (name string, version int)
+}
+
+// formatInfo returns the name and version of f, or "unknown" and 0 if f does
+// not implement FormatDescriber.
+func formatInfo(f Format) (string, int) {
+	if d, ok := f.(FormatDescriber); ok {
+		return d.FormatInfo()
+	}
+	return "unknown", 0
+}
+
+// CommitStreamer is implemented by Formats that can decode the fields of a
+// commit without reading its message into memory.
+type CommitStreamer interface {
+	// DecodeCommitHeader decodes a commit from the given Reader, except for its
+	// message, and returns a Reader for the message.
+	DecodeCommitHeader(io.Reader) (Commit, io.Reader, error)
+}
+
+// TreeStreamer is implemented by Formats that can decode the entries of a tree
+// one at a time, without holding the whole tree in memory.
+type TreeStreamer interface {
+	// DecodeTreeEntries decodes a tree from the given Reader and calls fn for
+	// each of its entries in the order they were encoded. Decoding stops at the
+	// first error returned by fn, which is returned.
+	DecodeTreeEntries(r io.Reader, fn func(*Entry) error) error
+}
+
+// DecodeTreeEntries decodes a tree from r using f and calls fn for each of its
+// entries. If f does not implement TreeStreamer, the tree is decoded with
+// DecodeTree first.
+func DecodeTreeEntries(f Format, r io.Reader, fn func(*Entry) error) error {
+	if s, ok := f.(TreeStreamer); ok {
+		return s.DecodeTreeEntries(r, fn)
+	}
+	tree, err := f.DecodeTree(r)
+	if err != nil {
+		return err
+	}
+	for _, entry := range tree {
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // NewDefaultFormat returns the default format.
 func NewDefaultFormat() Format {
 	return &defaultFormat{}
@@ -39,9 +108,58 @@ const (
 	commitPrefix = "commit\n"
 )
 
-// defaultFormat implements the Format interface.
+// prefixKind returns the Kind of the object whose encoding by the default
+// format starts with data, or "" if data does not start with a known prefix.
+func prefixKind(data []byte) Kind {
+	switch {
+	case bytes.HasPrefix(data, []byte(blobPrefix)):
+		return KindBlob
+	case bytes.HasPrefix(data, []byte(treePrefix)):
+		return KindTree
+	case bytes.HasPrefix(data, []byte(commitPrefix)):
+		return KindCommit
+	}
+	return ""
+}
+
+// decodePrefix reads the prefix of an object of the given kind from b. A
+// *KindError is returned if b holds an object of another kind.
+func decodePrefix(b *bufio.Reader, want Kind) error {
+	data, err := b.Peek(len(commitPrefix))
+	if err != nil && err != io.EOF {
+		return err
+	}
+	switch got := prefixKind(data); got {
+	case want:
+		_, err := b.Discard(len(want) + 1)
+		return err
+	case "":
+		return fmt.Errorf("bad %s prefix: %q", want, data)
+	default:
+		return &KindError{Want: want, Got: got}
+	}
+}
+
+// KindError is returned by Format decoders for objects of another Kind than
+// the one being decoded, e.g. when DecodeBlob is given a tree.
+type KindError struct {
+	Want Kind
+	Got  Kind
+}
+
+func (k *KindError) Error() string {
+	return fmt.Sprintf("object is a %s, not a %s", k.Got, k.Want)
+}
+
+// defaultFormat implements the Format interface. It holds no state and is
+// therefore safe for concurrent use.
 type defaultFormat struct{}
 
+// FormatInfo is part of the FormatDescriber interface.
+func (f *defaultFormat) FormatInfo() (string, int) {
+	return "default", 1
+}
+
 // EncodeBlob is part of the Format interface.
 func (f *defaultFormat) EncodeBlob(w io.Writer, r io.Reader) error {
 	b := bufio.NewWriter(w)
@@ -56,10 +174,8 @@ func (f *defaultFormat) EncodeBlob(w io.Writer, r io.Reader) error {
 // DecodeBlob is part of the Format interface.
 func (f *defaultFormat) DecodeBlob(r io.Reader) (io.Reader, error) {
 	b := bufio.NewReader(r)
-	if prefix, err := ioutil.ReadAll(io.LimitReader(b, int64(len(blobPrefix)))); err != nil {
+	if err := decodePrefix(b, KindBlob); err != nil {
 		return nil, err
-	} else if sp := string(prefix); sp != blobPrefix {
-		return nil, fmt.Errorf("bad blob prefix: %q", sp)
 	}
 	return b, nil
 }
@@ -72,7 +188,13 @@ func (f *defaultFormat) EncodeTree(w io.Writer, t Tree) error {
 	}
 	sort.Sort(t)
 	for _, entry := range t {
-		if _, err := fmt.Fprintf(b, "%s %s %d %s\n", entry.Kind, entry.ID, len(entry.Name), entry.Name); err != nil {
+		// The mode is omitted for the default mode, so trees without modes keep
+		// their ids.
+		kind := string(entry.Kind)
+		if entry.Mode != ModeDefault {
+			kind += ":" + strconv.FormatUint(uint64(entry.Mode), 8)
+		}
+		if _, err := fmt.Fprintf(b, "%s %s %d %s\n", kind, entry.ID, len(entry.Name), entry.Name); err != nil {
 			return err
 		}
 	}
@@ -81,37 +203,79 @@ func (f *defaultFormat) EncodeTree(w io.Writer, t Tree) error {
 
 // DecodeTree is part of the Format interface.
 func (f *defaultFormat) DecodeTree(r io.Reader) (Tree, error) {
+	var tree Tree
+	if err := f.DecodeTreeEntries(r, func(entry *Entry) error {
+		tree = append(tree, entry)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
+
+// DecodeTreeEntries is part of the TreeStreamer interface.
+func (f *defaultFormat) DecodeTreeEntries(r io.Reader, fn func(*Entry) error) error {
 	b := bufio.NewReader(r)
-	if prefix, err := ioutil.ReadAll(io.LimitReader(b, int64(len(treePrefix)))); err != nil {
-	} else if sp := string(prefix); sp != treePrefix {
-		return nil, fmt.Errorf("bad tree prefix: %q", sp)
+	if err := decodePrefix(b, KindTree); err != nil {
+		return err
 	}
-	var tree Tree
 	for {
 		if kind, err := b.ReadString(' '); err == io.EOF && len(kind) == 0 {
-			return tree, nil
+			return nil
 		} else if err != nil {
-			return nil, err
+			return unexpectedEOF(err)
+		} else if kind, mode, err := decodeKindMode(kind[:len(kind)-1]); err != nil {
+			return err
 		} else if id, err := b.ReadString(' '); err != nil {
-			return nil, err
+			return unexpectedEOF(err)
 		} else if id, err := ParseID(id[:len(id)-1]); err != nil {
-			return nil, err
+			return err
 		} else if nameLen, err := b.ReadString(' '); err != nil {
-			return nil, err
+			return unexpectedEOF(err)
 		} else if nameLen, err := strconv.ParseInt(nameLen[:len(nameLen)-1], 10, 64); err != nil {
-			return nil, err
+			return err
+		} else if nameLen < 0 {
+			return fmt.Errorf("bad name length: %d", nameLen)
 		} else if name, err := ioutil.ReadAll(io.LimitReader(b, nameLen+1)); err != nil {
-			return nil, err
-		} else {
-			tree = append(tree, &Entry{
-				Kind: Kind(kind[:len(kind)-1]),
-				ID:   id,
-				Name: string(name[:len(name)-1]),
-			})
+			return err
+		} else if int64(len(name)) != nameLen+1 {
+			return io.ErrUnexpectedEOF
+		} else if name[nameLen] != '\n' {
+			return fmt.Errorf("bad end of entry: got=%q want=%q", name[nameLen], '\n')
+		} else if err := fn(&Entry{
+			Kind: kind,
+			Mode: mode,
+			ID:   id,
+			Name: string(name[:len(name)-1]),
+		}); err != nil {
+			return err
 		}
 	}
 }
 
+// unexpectedEOF returns io.ErrUnexpectedEOF if err is io.EOF, which means
+// that the data ended in the middle of an object, and err otherwise.
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// decodeKindMode decodes the kind of a tree entry, which is optionally
+// followed by a colon and the octal mode of the entry.
+func decodeKindMode(s string) (Kind, uint32, error) {
+	i := strings.IndexByte(s, ':')
+	if i < 0 {
+		return Kind(s), ModeDefault, nil
+	}
+	mode, err := strconv.ParseUint(s[i+1:], 8, 32)
+	if err != nil {
+		return "", 0, fmt.Errorf("bad mode: %q: %s", s, err)
+	}
+	return Kind(s[:i]), uint32(mode), nil
+}
+
 // EncodeCommit is part of the Format interface.
 func (f *defaultFormat) EncodeCommit(w io.Writer, c Commit) error {
 	b := bufio.NewWriter(w)
@@ -127,7 +291,27 @@ func (f *defaultFormat) EncodeCommit(w io.Writer, c Commit) error {
 			return err
 		}
 	}
-	if _, err := fmt.Fprintf(b, "time %d %+d\n", ut, zo); err != nil {
+	// Empty identities are omitted, so commits without them keep their ids.
+	for _, field := range []struct{ name, val string }{{"author", c.Author}, {"committer", c.Committer}} {
+		if field.val == "" {
+			continue
+		} else if strings.ContainsRune(field.val, '\n') {
+			return fmt.Errorf("bad %s: contains newline: %q", field.name, field.val)
+		} else if _, err := fmt.Fprintf(b, "%s %s\n", field.name, field.val); err != nil {
+			return err
+		}
+	}
+	if len(c.Signature) > 0 {
+		if _, err := fmt.Fprintf(b, "signature %s\n", base64.StdEncoding.EncodeToString(c.Signature)); err != nil {
+			return err
+		}
+	}
+	// Nanoseconds are omitted if zero, so commits without them keep their ids.
+	ts := strconv.FormatInt(ut, 10)
+	if ns := c.Time.Nanosecond(); ns != 0 {
+		ts += " " + strconv.Itoa(ns)
+	}
+	if _, err := fmt.Fprintf(b, "time %s %+d\n", ts, zo); err != nil {
 		return err
 	} else if _, err := fmt.Fprintf(b, "\n%s", c.Message); err != nil {
 		return err
@@ -137,47 +321,68 @@ func (f *defaultFormat) EncodeCommit(w io.Writer, c Commit) error {
 
 // DecodeCommit is part of the Format interface.
 func (f *defaultFormat) DecodeCommit(r io.Reader) (Commit, error) {
+	commit, mr, err := f.DecodeCommitHeader(r)
+	if err != nil {
+		return commit, err
+	} else if msg, err := ioutil.ReadAll(mr); err != nil {
+		return commit, err
+	} else {
+		// Empty Message should produce nil to allow symmetry of encoding/decoding
+		// zero Commit value:
+		if len(msg) > 0 {
+			commit.Message = msg
+		}
+		return commit, nil
+	}
+}
+
+// DecodeCommitHeader is part of the CommitStreamer interface.
+func (f *defaultFormat) DecodeCommitHeader(r io.Reader) (Commit, io.Reader, error) {
 	b := bufio.NewReader(r)
-	if prefix, err := ioutil.ReadAll(io.LimitReader(b, int64(len(commitPrefix)))); err != nil {
-	} else if sp := string(prefix); sp != commitPrefix {
-		return Commit{}, fmt.Errorf("bad commit prefix: %q", sp)
+	if err := decodePrefix(b, KindCommit); err != nil {
+		return Commit{}, nil, err
 	}
 	var commit Commit
 fields:
 	for {
 		if field, err := b.ReadString(' '); err != nil {
-			return commit, err
+			return commit, nil, err
 		} else if val, err := b.ReadString('\n'); err != nil {
-			return commit, err
+			return commit, nil, err
 		} else {
 			val = val[:len(val)-1]
 			field = field[:len(field)-1]
 			switch field {
 			case "tree":
 				if id, err := ParseID(val); err != nil {
-					return commit, err
+					return commit, nil, err
 				} else {
 					commit.Tree = id
 				}
 			case "parent":
 				if id, err := ParseID(val); err != nil {
-					return commit, err
+					return commit, nil, err
 				} else {
 					commit.Parents = append(commit.Parents, id)
 				}
+			case "author":
+				commit.Author = val
+			case "committer":
+				commit.Committer = val
+			case "signature":
+				sig, err := base64.StdEncoding.DecodeString(val)
+				if err != nil {
+					return commit, nil, fmt.Errorf("bad signature: %s", err)
+				} else if len(sig) == 0 {
+					return commit, nil, fmt.Errorf("bad signature: empty")
+				}
+				commit.Signature = sig
 			case "time":
-				for i, s := range strings.Split(val, " ") {
-					val, err := strconv.ParseInt(s, 10, 64)
-					if err != nil {
-						return commit, fmt.Errorf("bad time: %s: %s", s, err)
-					}
-					switch i {
-					case 0:
-						commit.Time = time.Unix(val, 0)
-					case 1:
-						commit.Time = commit.Time.In(time.FixedZone("", int(val)))
-					}
+				t, err := decodeTime(val)
+				if err != nil {
+					return commit, nil, err
 				}
+				commit.Time = t
 				// Empty time should produce zero time to allow symmetry of
 				// encoding/decoding zero Commit value:
 				if commit.Time.IsZero() {
@@ -185,22 +390,86 @@ fields:
 				}
 				break fields
 			default:
-				return commit, fmt.Errorf("unknown field: %s", field)
+				return commit, nil, fmt.Errorf("unknown field: %s", field)
 			}
 		}
 	}
 	if c, err := b.ReadByte(); err != nil {
-		return commit, err
+		return commit, nil, err
 	} else if want := byte('\n'); c != want {
-		return commit, fmt.Errorf("bad end of fields: got=%q want=%q", c, want)
-	} else if msg, err := ioutil.ReadAll(b); err != nil {
-		return commit, err
-	} else {
-		// Empty Message should produce nil to allow symmetry of encoding/decoding
-		// zero Commit value:
-		if len(msg) > 0 {
-			commit.Message = msg
+		return commit, nil, fmt.Errorf("bad end of fields: got=%q want=%q", c, want)
+	}
+	return commit, b, nil
+}
+
+// decodeTime decodes the value of the time field of a commit, which holds the
+// unix time in seconds, optionally followed by nanoseconds, and the zone
+// offset in seconds.
+func decodeTime(val string) (time.Time, error) {
+	fields := strings.Split(val, " ")
+	if len(fields) != 2 && len(fields) != 3 {
+		return time.Time{}, fmt.Errorf("bad time: %q", val)
+	}
+	nums := make([]int64, len(fields))
+	for i, s := range fields {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("bad time: %s: %s", s, err)
+		}
+		nums[i] = n
+	}
+	sec, nsec, offset := nums[0], int64(0), nums[len(nums)-1]
+	if len(nums) == 3 {
+		// Zero nanoseconds are omitted, so they are rejected here to keep the
+		// encoding canonical.
+		if nsec = nums[1]; nsec <= 0 || nsec >= int64(time.Second) {
+			return time.Time{}, fmt.Errorf("bad time: nanoseconds out of range: %d", nsec)
 		}
-		return commit, nil
 	}
+	return time.Unix(sec, nsec).In(time.FixedZone("", int(offset))), nil
+}
+
+// NewSortedParentsFormat returns a Format that behaves like inner, except that
+// commit parents are sorted by ID before being encoded. This makes commit IDs
+// independent of the order of their parents. Decoded commits always have
+// sorted parents, so Encode/Decode symmetry only holds for commits whose
+// parents are sorted already. If inner is a Sealer, the returned Format is a
+// Sealer as well, whose Unsealed Format sorts parents.
+func NewSortedParentsFormat(inner Format) Format {
+	if s, ok := inner.(Sealer); ok {
+		return &sealedSortedParentsFormat{sortedParentsFormat: &sortedParentsFormat{Format: inner}, Sealer: s}
+	}
+	return &sortedParentsFormat{Format: inner}
+}
+
+// sealedSortedParentsFormat is a sortedParentsFormat whose inner Format is a
+// Sealer. It implements the Sealer interface.
+type sealedSortedParentsFormat struct {
+	*sortedParentsFormat
+	Sealer
+}
+
+// Unsealed is part of the Sealer interface.
+func (f *sealedSortedParentsFormat) Unsealed() Format {
+	return NewSortedParentsFormat(f.Sealer.Unsealed())
+}
+
+// sortedParentsFormat implements the Format interface.
+type sortedParentsFormat struct {
+	Format
+}
+
+// FormatInfo is part of the FormatDescriber interface.
+func (f *sortedParentsFormat) FormatInfo() (string, int) {
+	name, version := formatInfo(f.Format)
+	return "sorted-parents+" + name, version
+}
+
+// EncodeCommit is part of the Format interface.
+func (f *sortedParentsFormat) EncodeCommit(w io.Writer, c Commit) error {
+	parents := make([]ID, len(c.Parents))
+	copy(parents, c.Parents)
+	sort.Sort(IDs(parents))
+	c.Parents = parents
+	return f.Format.EncodeCommit(w, c)
 }
@@ -2,7 +2,11 @@ package can
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"strings"
 	"testing"
 	"time"
 
@@ -75,6 +79,14 @@ func TestDefaultFormat_Tree(t *testing.T) {
 			},
 			Want: []byte("tree\nblob 1234 2 hi\nblob 8765 12 how are you?\n"),
 		},
+		{
+			Tree: Tree{
+				{Kind: KindBlob, Mode: ModeExecutable, Name: "run.sh", ID: MustID("1234")},
+				{Kind: KindBlob, Mode: ModeDefault, Name: "data", ID: MustID("5678")},
+				{Kind: KindBlob, Mode: ModeSymlink, Name: "link", ID: MustID("8765")},
+			},
+			Want: []byte("tree\nblob 5678 4 data\nblob:120000 8765 4 link\nblob:100755 1234 6 run.sh\n"),
+		},
 	}
 	format := NewDefaultFormat()
 	for _, test := range tests {
@@ -91,6 +103,31 @@ func TestDefaultFormat_Tree(t *testing.T) {
 	}
 }
 
+func TestDefaultFormat_Tree_BadMode(t *testing.T) {
+	format := NewDefaultFormat()
+	if _, err := format.DecodeTree(strings.NewReader("tree\nblob:9 1234 2 hi\n")); err == nil {
+		t.Fatal("expected error for bad mode")
+	}
+}
+
+func TestDefaultFormat_Tree_Truncated(t *testing.T) {
+	format := NewDefaultFormat()
+	data := "tree\nblob 1234 2 hi\ntree 5678 5 there\n"
+	for i := len(treePrefix) + 1; i < len(data); i++ {
+		if data[i-1] == '\n' {
+			// Truncating after a complete entry yields a valid tree.
+			continue
+		} else if _, err := format.DecodeTree(strings.NewReader(data[:i])); err == nil {
+			t.Fatalf("expected error for tree truncated to %q", data[:i])
+		}
+	}
+	for _, data := range []string{"tree\nblob 1234 -1 hi\n", "tree\nblob 1234 1 hi\n"} {
+		if _, err := format.DecodeTree(strings.NewReader(data)); err == nil {
+			t.Fatalf("expected error for %q", data)
+		}
+	}
+}
+
 func TestDefaultFormat_Commit(t *testing.T) {
 	tm := time.Date(2015, 2, 20, 13, 14, 33, 0, time.FixedZone("", 3600))
 	tests := []struct {
@@ -119,6 +156,54 @@ func TestDefaultFormat_Commit(t *testing.T) {
 			},
 			Want: []byte("commit\ntree 0123456789\nparent 6789\nparent 45\ntime 1424434473 -1234\n\nhi,\n\nhow are you?"),
 		},
+		{
+			Commit: Commit{
+				Tree:      MustID("0123456789"),
+				Parents:   []ID{MustID("45")},
+				Author:    "Jane Doe <jane@example.com>",
+				Committer: "John Doe <john@example.com>",
+				Time:      tm,
+				Message:   []byte("hi"),
+			},
+			Want: []byte("commit\ntree 0123456789\nparent 45\nauthor Jane Doe <jane@example.com>\ncommitter John Doe <john@example.com>\ntime 1424434473 +3600\n\nhi"),
+		},
+		{
+			Commit: Commit{
+				Tree:      MustID("0123456789"),
+				Signature: []byte("sig"),
+				Time:      tm,
+			},
+			Want: []byte("commit\ntree 0123456789\nsignature c2ln\ntime 1424434473 +3600\n\n"),
+		},
+		{
+			Commit: Commit{
+				Tree:      MustID("0123456789"),
+				Committer: "John Doe <john@example.com>",
+				Time:      tm,
+			},
+			Want: []byte("commit\ntree 0123456789\ncommitter John Doe <john@example.com>\ntime 1424434473 +3600\n\n"),
+		},
+		{
+			Commit: Commit{
+				Tree: MustID("0123456789"),
+				Time: time.Date(1969, 7, 20, 20, 17, 40, 0, time.FixedZone("", 0)),
+			},
+			Want: []byte("commit\ntree 0123456789\ntime -14182940 +0\n\n"),
+		},
+		{
+			Commit: Commit{
+				Tree: MustID("0123456789"),
+				Time: tm.Add(123456789),
+			},
+			Want: []byte("commit\ntree 0123456789\ntime 1424434473 123456789 +3600\n\n"),
+		},
+		{
+			Commit: Commit{
+				Tree: MustID("0123456789"),
+				Time: time.Date(1969, 12, 31, 22, 59, 59, 500, time.FixedZone("", -3600)),
+			},
+			Want: []byte("commit\ntree 0123456789\ntime -1 500 -3600\n\n"),
+		},
 	}
 	format := NewDefaultFormat()
 	for _, test := range tests {
@@ -134,3 +219,104 @@ func TestDefaultFormat_Commit(t *testing.T) {
 		}
 	}
 }
+
+func TestSortedParentsFormat(t *testing.T) {
+	var (
+		a = Commit{Tree: MustID("0123"), Parents: []ID{MustID("6789"), MustID("45")}}
+		b = Commit{Tree: MustID("0123"), Parents: []ID{MustID("45"), MustID("6789")}}
+	)
+	commitID := func(f Format, c Commit) ID {
+		iw := NewIDWriter(ioutil.Discard)
+		if err := f.EncodeCommit(iw, c); err != nil {
+			t.Fatal(err)
+		}
+		return iw.ID()
+	}
+	format := NewDefaultFormat()
+	if commitID(format, a).Equal(commitID(format, b)) {
+		t.Fatal("default format should preserve parent order")
+	}
+	sorted := NewSortedParentsFormat(format)
+	if idA, idB := commitID(sorted, a), commitID(sorted, b); !idA.Equal(idB) {
+		t.Fatalf("ids differ: a=%s b=%s", idA, idB)
+	} else if !idB.Equal(commitID(format, b)) {
+		t.Fatal("sorted parents should encode like the default format")
+	}
+	buf := bytes.NewBuffer(nil)
+	if err := sorted.EncodeCommit(buf, a); err != nil {
+		t.Fatal(err)
+	} else if got, err := sorted.DecodeCommit(buf); err != nil {
+		t.Fatal(err)
+	} else if diff := pretty.Compare(got, b); diff != "" {
+		t.Fatalf("%s", diff)
+	} else if !a.Parents[0].Equal(MustID("6789")) {
+		t.Fatal("EncodeCommit modified the given parents")
+	}
+}
+
+func TestDefaultFormat_PrefixError(t *testing.T) {
+	format := NewDefaultFormat()
+	want := errors.New("interrupted")
+	prefixReader := func(prefix string) io.Reader {
+		return io.MultiReader(strings.NewReader(prefix[:2]), &errReader{want})
+	}
+	if _, err := format.DecodeTree(prefixReader(treePrefix)); err != want {
+		t.Fatalf("DecodeTree: expected %v, got: %v", want, err)
+	} else if _, err := format.DecodeCommit(prefixReader(commitPrefix)); err != want {
+		t.Fatalf("DecodeCommit: expected %v, got: %v", want, err)
+	} else if _, err := format.DecodeBlob(prefixReader(blobPrefix)); err != want {
+		t.Fatalf("DecodeBlob: expected %v, got: %v", want, err)
+	}
+}
+
+func TestDefaultFormat_DecodeTreeEntries(t *testing.T) {
+	const n = 100000
+	var tree Tree
+	for i := 0; i < n; i++ {
+		tree = append(tree, &Entry{Kind: KindBlob, Name: fmt.Sprintf("%08d", i), ID: MustID("1234")})
+	}
+	format := NewDefaultFormat()
+	buf := bytes.NewBuffer(nil)
+	if err := format.EncodeTree(buf, tree); err != nil {
+		t.Fatal(err)
+	}
+	size := buf.Len()
+	i := 0
+	if err := DecodeTreeEntries(format, buf, func(entry *Entry) error {
+		if i == 0 && buf.Len() < size/2 {
+			t.Fatalf("first entry after reading %d of %d bytes", size-buf.Len(), size)
+		} else if want := tree[i].Name; entry.Name != want {
+			t.Fatalf("entry %d: got=%q want=%q", i, entry.Name, want)
+		}
+		i++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if i != n {
+		t.Fatalf("got %d entries, want %d", i, n)
+	}
+
+	want := errors.New("stop")
+	if err := DecodeTreeEntries(format, strings.NewReader("tree\nblob 1234 2 hi\n"), func(*Entry) error {
+		return want
+	}); err != want {
+		t.Fatalf("expected %v, got: %v", want, err)
+	}
+}
+
+func TestDefaultFormat_Commit_BadTime(t *testing.T) {
+	format := NewDefaultFormat()
+	for _, val := range []string{"1", "1 2 3 4", "1 0 +0", "1 1000000000 +0", "1 x +0"} {
+		r := strings.NewReader("commit\ntree \ntime " + val + "\n\n")
+		if _, err := format.DecodeCommit(r); err == nil {
+			t.Fatalf("expected error for time %q", val)
+		}
+	}
+}
+
+func TestDefaultFormat_Commit_BadAuthor(t *testing.T) {
+	format := NewDefaultFormat()
+	if err := format.EncodeCommit(ioutil.Discard, Commit{Author: "Jane\ntime 0 +0"}); err == nil {
+		t.Fatal("expected error for author with newline")
+	}
+}
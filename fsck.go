@@ -0,0 +1,86 @@
+package can
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// Fsck checks every object stored in the repo and returns an error for each
+// problem found, or no errors if the repo is healthy. Objects are checked
+// for matching their id and being decodable, and commits and trees for
+// referring to existing objects only, even if Verify is disabled. Corrupt
+// objects are reported as *CorruptError.
+func (d *DirRepo) Fsck() []error {
+	var errs []error
+	report := func(id ID, format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf("object %s: %s", id, fmt.Sprintf(format, args...)))
+	}
+	exists := func(id, ref ID, what string) {
+		if ok, err := d.Exists(ref); err != nil {
+			report(id, "%s", err)
+		} else if !ok {
+			report(id, "missing %s %s", what, ref)
+		}
+	}
+	if err := d.WalkObjects(func(id ID) error {
+		// Objects verified by an earlier read may have been corrupted since.
+		d.verified.Delete(string(id))
+		rc, format, err := d.openObject(id, true)
+		if IsCorrupt(err) {
+			errs = append(errs, err)
+			return nil
+		} else if err != nil {
+			report(id, "%s", err)
+			return nil
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if IsCorrupt(err) {
+			errs = append(errs, err)
+			return nil
+		} else if err != nil {
+			report(id, "%s", err)
+			return nil
+		}
+		// Decoding the object as a commit tells its kind by a *KindError if
+		// it is not one.
+		kind := KindCommit
+		commit, err := format.DecodeCommit(bytes.NewReader(data))
+		if ke, ok := err.(*KindError); ok {
+			kind = ke.Got
+		} else if err != nil {
+			errs = append(errs, &CorruptError{ID: id, Reason: err.Error()})
+			return nil
+		}
+		switch kind {
+		case KindCommit:
+			exists(id, commit.Tree, "tree")
+			for _, parent := range commit.Parents {
+				exists(id, parent, "parent")
+			}
+		case KindTree:
+			tree, err := format.DecodeTree(bytes.NewReader(data))
+			if err != nil {
+				errs = append(errs, &CorruptError{ID: id, Reason: err.Error()})
+				return nil
+			}
+			for _, entry := range tree {
+				exists(id, entry.ID, fmt.Sprintf("%s %q", entry.Kind, entry.Name))
+			}
+		case KindBlob:
+			if r, err := format.DecodeBlob(bytes.NewReader(data)); err != nil {
+				errs = append(errs, &CorruptError{ID: id, Reason: err.Error()})
+			} else if _, err := io.Copy(ioutil.Discard, r); err != nil {
+				errs = append(errs, &CorruptError{ID: id, Reason: err.Error()})
+			}
+		default:
+			errs = append(errs, &CorruptError{ID: id, Reason: "unknown object kind"})
+		}
+		return nil
+	}); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
+}
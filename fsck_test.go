@@ -0,0 +1,62 @@
+package can
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDirRepo_Fsck(t *testing.T) {
+	rp := tmpDirRepo()
+	testCommitSet(t, rp, []string{"foo", "bar"}, "a")
+	testCommitSet(t, rp, []string{"baz"}, "b")
+	if errs := rp.Fsck(); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	blobID, err := rp.WriteBlob(strings.NewReader("Hello"))
+	if err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(rp.path(blobID), []byte("blob\nJello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	dangling := MustID("0123456789")
+	treeID, err := rp.WriteTree(Tree{{Kind: KindBlob, Name: "missing", ID: dangling}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Undecodable objects with a matching id are reported by their decoder.
+	raw := []byte("tree\nbad")
+	iw := NewIDWriter(ioutil.Discard)
+	iw.Write(raw)
+	badTreeID := iw.ID()
+	if err := os.MkdirAll(filepath.Dir(rp.path(badTreeID)), 0700); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(rp.path(badTreeID), raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+	errs := rp.Fsck()
+	if len(errs) != 3 {
+		t.Fatalf("expected 3 errors, got: %v", errs)
+	}
+	for _, err := range errs {
+		msg := err.Error()
+		switch {
+		case strings.Contains(msg, blobID.String()):
+			if !IsCorrupt(err) || !strings.Contains(msg, "bad id") {
+				t.Fatalf("bad error for corrupt blob: %s", msg)
+			}
+		case strings.Contains(msg, badTreeID.String()):
+			if !IsCorrupt(err) || strings.Contains(msg, "unknown object kind") {
+				t.Fatalf("bad error for undecodable tree: %s", msg)
+			}
+		case strings.Contains(msg, treeID.String()):
+			if !strings.Contains(msg, dangling.String()) {
+				t.Fatalf("bad error for dangling reference: %s", msg)
+			}
+		default:
+			t.Fatalf("unexpected error: %s", msg)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package can
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+)
+
+// NewGzipFormat returns a Format that gzip compresses the objects encoded by
+// inner. Object ids are computed over the compressed encoding, so the ids
+// differ from those of inner. The compressed encoding is only stable for a
+// given version of compress/flate, so a program built with another Go version
+// may compute other ids for the same objects. Such objects can still be read,
+// but are stored twice and fail a DirRepo's StrictTrees check.
+//
+// If inner is a Sealer, the returned Format is a Sealer as well which
+// compresses objects before sealing them, as sealed objects, e.g. encrypted
+// ones, do not compress. Ids are computed over the unsealed encoding of inner
+// then, so they do not depend on compression.
+func NewGzipFormat(inner Format) Format {
+	f := &gzipFormat{inner: inner}
+	if s, ok := inner.(Sealer); ok {
+		return &sealedGzipFormat{gzipFormat: f, sealer: s}
+	}
+	return f
+}
+
+// gzipFormat implements the Format interface.
+type gzipFormat struct {
+	inner Format
+}
+
+// FormatInfo is part of the FormatDescriber interface.
+func (f *gzipFormat) FormatInfo() (string, int) {
+	name, version := formatInfo(f.inner)
+	return "gzip+" + name, version
+}
+
+// EncodeBlob is part of the Format interface.
+func (f *gzipFormat) EncodeBlob(w io.Writer, r io.Reader) error {
+	return f.encode(w, func(w io.Writer) error { return f.inner.EncodeBlob(w, r) })
+}
+
+// DecodeBlob is part of the Format interface.
+func (f *gzipFormat) DecodeBlob(r io.Reader) (io.Reader, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return f.inner.DecodeBlob(zr)
+}
+
+// EncodeTree is part of the Format interface.
+func (f *gzipFormat) EncodeTree(w io.Writer, t Tree) error {
+	return f.encode(w, func(w io.Writer) error { return f.inner.EncodeTree(w, t) })
+}
+
+// DecodeTree is part of the Format interface.
+func (f *gzipFormat) DecodeTree(r io.Reader) (Tree, error) {
+	var t Tree
+	err := f.decode(r, func(r io.Reader) (err error) {
+		t, err = f.inner.DecodeTree(r)
+		return err
+	})
+	return t, err
+}
+
+// EncodeCommit is part of the Format interface.
+func (f *gzipFormat) EncodeCommit(w io.Writer, c Commit) error {
+	return f.encode(w, func(w io.Writer) error { return f.inner.EncodeCommit(w, c) })
+}
+
+// DecodeCommit is part of the Format interface.
+func (f *gzipFormat) DecodeCommit(r io.Reader) (Commit, error) {
+	var c Commit
+	err := f.decode(r, func(r io.Reader) (err error) {
+		c, err = f.inner.DecodeCommit(r)
+		return err
+	})
+	return c, err
+}
+
+// encode compresses the output of fn into w.
+func (f *gzipFormat) encode(w io.Writer, fn func(io.Writer) error) error {
+	zw := gzip.NewWriter(w)
+	if err := fn(zw); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// decode calls fn with the decompressed contents of r. The remaining contents
+// are read afterwards, so that truncated or corrupted streams are detected
+// even if fn did not read all of its input.
+func (f *gzipFormat) decode(r io.Reader, fn func(io.Reader) error) error {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return err
+	} else if err := fn(zr); err != nil {
+		return err
+	} else if _, err := io.Copy(ioutil.Discard, zr); err != nil {
+		return err
+	}
+	return zr.Close()
+}
+
+// sealedGzipFormat is a gzipFormat whose inner Format is a Sealer. It
+// implements the Sealer interface, and compresses objects before sealing them.
+type sealedGzipFormat struct {
+	*gzipFormat
+	sealer Sealer
+}
+
+// FormatInfo is part of the FormatDescriber interface.
+func (f *sealedGzipFormat) FormatInfo() (string, int) {
+	name, version := formatInfo(f.inner)
+	return "sealed-gzip+" + name, version
+}
+
+// Unsealed is part of the Sealer interface.
+func (f *sealedGzipFormat) Unsealed() Format {
+	return f.sealer.Unsealed()
+}
+
+// Seal is part of the Sealer interface.
+func (f *sealedGzipFormat) Seal(w io.Writer) io.WriteCloser {
+	sw := f.sealer.Seal(w)
+	return &gzipSealWriter{Writer: gzip.NewWriter(sw), sw: sw}
+}
+
+// Unseal is part of the Sealer interface.
+func (f *sealedGzipFormat) Unseal(r io.Reader) (io.Reader, error) {
+	ur, err := f.sealer.Unseal(r)
+	if err != nil {
+		return nil, err
+	}
+	return gzip.NewReader(ur)
+}
+
+// EncodeBlob is part of the Format interface.
+func (f *sealedGzipFormat) EncodeBlob(w io.Writer, r io.Reader) error {
+	return f.seal(w, func(w io.Writer) error { return f.Unsealed().EncodeBlob(w, r) })
+}
+
+// DecodeBlob is part of the Format interface.
+func (f *sealedGzipFormat) DecodeBlob(r io.Reader) (io.Reader, error) {
+	ur, err := f.Unseal(r)
+	if err != nil {
+		return nil, err
+	}
+	return f.Unsealed().DecodeBlob(ur)
+}
+
+// EncodeTree is part of the Format interface.
+func (f *sealedGzipFormat) EncodeTree(w io.Writer, t Tree) error {
+	return f.seal(w, func(w io.Writer) error { return f.Unsealed().EncodeTree(w, t) })
+}
+
+// DecodeTree is part of the Format interface.
+func (f *sealedGzipFormat) DecodeTree(r io.Reader) (Tree, error) {
+	var t Tree
+	err := f.unseal(r, func(r io.Reader) (err error) {
+		t, err = f.Unsealed().DecodeTree(r)
+		return err
+	})
+	return t, err
+}
+
+// EncodeCommit is part of the Format interface.
+func (f *sealedGzipFormat) EncodeCommit(w io.Writer, c Commit) error {
+	return f.seal(w, func(w io.Writer) error { return f.Unsealed().EncodeCommit(w, c) })
+}
+
+// DecodeCommit is part of the Format interface.
+func (f *sealedGzipFormat) DecodeCommit(r io.Reader) (Commit, error) {
+	var c Commit
+	err := f.unseal(r, func(r io.Reader) (err error) {
+		c, err = f.Unsealed().DecodeCommit(r)
+		return err
+	})
+	return c, err
+}
+
+// seal calls encode with a writer that compresses and seals its output into w.
+func (f *sealedGzipFormat) seal(w io.Writer, encode func(io.Writer) error) error {
+	sw := f.Seal(w)
+	if err := encode(sw); err != nil {
+		return err
+	}
+	return sw.Close()
+}
+
+// unseal calls fn with the unsealed and decompressed contents of r, and reads
+// the remaining contents afterwards, see gzipFormat.decode.
+func (f *sealedGzipFormat) unseal(r io.Reader, fn func(io.Reader) error) error {
+	ur, err := f.Unseal(r)
+	if err != nil {
+		return err
+	} else if err := fn(ur); err != nil {
+		return err
+	}
+	_, err = io.Copy(ioutil.Discard, ur)
+	return err
+}
+
+// gzipSealWriter compresses the data written to it and seals the result.
+type gzipSealWriter struct {
+	*gzip.Writer
+	sw io.WriteCloser
+}
+
+// Close flushes the compressor and closes the sealer.
+func (w *gzipSealWriter) Close() error {
+	if err := w.Writer.Close(); err != nil {
+		return err
+	}
+	return w.sw.Close()
+}
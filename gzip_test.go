@@ -0,0 +1,123 @@
+package can
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestGzipFormat(t *testing.T) {
+	format := NewGzipFormat(NewDefaultFormat())
+	tree := Tree{
+		{Kind: KindBlob, ID: MustID("0cd5a7d8dc5a48bb59c0205146e4aac675dfe74a"), Name: "blob 1"},
+		{Kind: KindTree, ID: MustID("29ee187f331966f235b3f67404b71e812f893825"), Name: "tree"},
+	}
+	commit := Commit{
+		Tree:    MustID("0123456789"),
+		Parents: []ID{MustID("0123")},
+		Time:    time.Date(2015, 2, 20, 13, 14, 33, 0, time.FixedZone("", 3600)),
+		Message: []byte(strings.Repeat("hello\n", 100)),
+	}
+	buf := &bytes.Buffer{}
+	if err := format.EncodeTree(buf, tree); err != nil {
+		t.Fatal(err)
+	} else if got, err := format.DecodeTree(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	} else if diff := pretty.Compare(got, tree); diff != "" {
+		t.Fatal(diff)
+	} else if _, err := format.DecodeTree(bytes.NewReader(buf.Bytes()[:buf.Len()-4])); err == nil {
+		t.Fatal("expected error for truncated tree")
+	}
+	buf.Reset()
+	if err := format.EncodeCommit(buf, commit); err != nil {
+		t.Fatal(err)
+	} else if buf.Len() >= len(commit.Message) {
+		t.Fatalf("commit was not compressed: %d bytes", buf.Len())
+	} else if got, err := format.DecodeCommit(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	} else if diff := pretty.Compare(got, commit); diff != "" {
+		t.Fatal(diff)
+	} else if _, err := format.DecodeCommit(bytes.NewReader(buf.Bytes()[:buf.Len()-4])); err == nil {
+		t.Fatal("expected error for truncated commit")
+	}
+	buf.Reset()
+	if err := format.EncodeBlob(buf, strings.NewReader("Hello")); err != nil {
+		t.Fatal(err)
+	}
+	r, err := format.DecodeBlob(bytes.NewReader(buf.Bytes()[:buf.Len()-4]))
+	if err == nil {
+		_, err = ioutil.ReadAll(r)
+	}
+	if err == nil {
+		t.Fatal("expected error for truncated blob")
+	}
+}
+
+func TestGzipFormat_DirRepo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp := NewDirRepo(dir)
+	rp.Format = NewGzipFormat(NewDefaultFormat())
+	if err := rp.Init(); err != nil {
+		t.Fatal(err)
+	}
+	id, err := rp.WriteBlob(strings.NewReader("Hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlob(t, rp, []byte("Hello"), id)
+	testCommitSet(t, rp, []string{"foo", "bar"}, "a")
+	if got, err := NewSugar(rp).Get([]string{"foo", "bar"}); err != nil {
+		t.Fatal(err)
+	} else if data, err := ioutil.ReadAll(got); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "a" {
+		t.Fatalf("bad value: %q", data)
+	}
+}
+
+func TestGzipFormat_Sealed(t *testing.T) {
+	encrypted, err := NewEncryptedFormat(NewDefaultFormat(), testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp := NewDirRepo(dir)
+	rp.Format = NewGzipFormat(encrypted)
+	if err := rp.Init(); err != nil {
+		t.Fatal(err)
+	}
+	data := strings.Repeat("compressible ", 1000)
+	id, err := rp.WriteBlob(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlob(t, rp, []byte(data), id)
+	// Objects are compressed before they are encrypted.
+	if raw, err := ioutil.ReadFile(rp.path(id)); err != nil {
+		t.Fatal(err)
+	} else if len(raw) > len(data)/10 {
+		t.Fatalf("sealed object not compressed: %d bytes", len(raw))
+	}
+	buf := &bytes.Buffer{}
+	if err := rp.Format.EncodeBlob(buf, strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	} else if buf.Len() > len(data)/10 {
+		t.Fatalf("encoded object not compressed: %d bytes", buf.Len())
+	} else if r, err := rp.Format.DecodeBlob(buf); err != nil {
+		t.Fatal(err)
+	} else if got, err := ioutil.ReadAll(r); err != nil {
+		t.Fatal(err)
+	} else if string(got) != data {
+		t.Fatal("bad decoded blob")
+	}
+}
@@ -0,0 +1,95 @@
+package can
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrAlreadyInitialized is returned by FirstCommit if the repo already has a
+// head.
+var ErrAlreadyInitialized = errors.New("repo already has a head")
+
+// ErrHeadMoved is returned by MergeCommits and Reset if the head no longer
+// points at the commit it pointed at when they started.
+var ErrHeadMoved = errors.New("head moved")
+
+// Reset points the head of rp at the given target commit. Unlike WriteHead,
+// Reset refuses to move the head to an object that is missing or not a
+// commit. ErrHeadMoved is returned if the head is moved while the target is
+// checked, see swapHead.
+func Reset(rp Repo, target ID) error {
+	if target == nil {
+		return fmt.Errorf("reset: empty target")
+	}
+	head, err := rp.Head()
+	if err != nil && !IsNotFound(err) {
+		return err
+	}
+	if _, err := rp.Commit(target); err != nil {
+		return fmt.Errorf("reset: bad target: %s: %s", target, err)
+	}
+	return swapHead(rp, head, target)
+}
+
+// FirstCommit writes the root commit of a repo without a head, using the given
+// tree id and commit details, and makes it the head. Any parents set in c are
+// ignored, and a nil c is treated like a zero Commit. ErrAlreadyInitialized is
+// returned if the repo already has a head. The head is created atomically for
+// Repos that support it, e.g. DirRepo.
+func FirstCommit(rp Repo, treeID ID, c *Commit) (ID, error) {
+	if _, err := rp.Head(); err == nil {
+		return nil, ErrAlreadyInitialized
+	} else if !IsNotFound(err) {
+		return nil, err
+	}
+	var commit Commit
+	if c != nil {
+		commit = *c
+	}
+	commit.Tree = treeID
+	commit.Parents = nil
+	id, err := rp.WriteCommit(commit)
+	if err != nil {
+		return nil, err
+	}
+	if hc, ok := rp.(headCreator); ok {
+		err = hc.createHead(id)
+	} else {
+		err = rp.WriteHead(id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// headCreator is implemented by Repos that can atomically create their head.
+type headCreator interface {
+	// createHead sets the head to the given id, or returns
+	// ErrAlreadyInitialized if a head exists.
+	createHead(ID) error
+}
+
+// headSwapper is implemented by Repos that can atomically replace their head
+// if it has an expected value.
+type headSwapper interface {
+	// swapHead sets the head to id, or returns ErrHeadMoved if the head is
+	// not old.
+	swapHead(old, id ID) error
+}
+
+// swapHead sets the head of rp to id if it is old, and returns ErrHeadMoved
+// otherwise. The check and update are atomic for Repos that support it, e.g.
+// DirRepo, while other Repos may lose a concurrent head update.
+func swapHead(rp Repo, old, id ID) error {
+	if hs, ok := rp.(headSwapper); ok {
+		return hs.swapHead(old, id)
+	}
+	head, err := rp.Head()
+	if err != nil && !IsNotFound(err) {
+		return err
+	} else if !head.Equal(old) {
+		return ErrHeadMoved
+	}
+	return rp.WriteHead(id)
+}
@@ -0,0 +1,97 @@
+package can
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReset(t *testing.T) {
+	rp := tmpRepo()
+	first := testCommitSet(t, rp, []string{"foo"}, "a")
+	testCommitSet(t, rp, []string{"foo"}, "b")
+	if err := Reset(rp, first); err != nil {
+		t.Fatal(err)
+	} else if head, err := rp.Head(); err != nil {
+		t.Fatal(err)
+	} else if !head.Equal(first) {
+		t.Fatalf("bad head: got=%s want=%s", head, first)
+	}
+	blobID, err := rp.WriteBlob(strings.NewReader("not a commit"))
+	if err != nil {
+		t.Fatal(err)
+	} else if err := Reset(rp, blobID); err == nil {
+		t.Fatal("expected error when resetting to a blob")
+	} else if err := Reset(rp, MustID("0123456789")); err == nil {
+		t.Fatal("expected error when resetting to a missing object")
+	} else if head, err := rp.Head(); err != nil {
+		t.Fatal(err)
+	} else if !head.Equal(first) {
+		t.Fatalf("bad head after failed reset: got=%s want=%s", head, first)
+	}
+}
+
+// headMovingRepo moves the head to the given commit whenever a commit is
+// read, to simulate a concurrent head update.
+type headMovingRepo struct {
+	*DirRepo
+	move ID
+}
+
+func (r *headMovingRepo) Commit(id ID) (Commit, error) {
+	if err := r.DirRepo.WriteHead(r.move); err != nil {
+		return Commit{}, err
+	}
+	return r.DirRepo.Commit(id)
+}
+
+func TestReset_HeadMoved(t *testing.T) {
+	rp := tmpDirRepo()
+	first := testCommitSet(t, rp, []string{"foo"}, "a")
+	second := testCommitSet(t, rp, []string{"foo"}, "b")
+	third := testCommitSet(t, rp, []string{"foo"}, "c")
+	if err := rp.WriteHead(second); err != nil {
+		t.Fatal(err)
+	} else if err := Reset(&headMovingRepo{DirRepo: rp, move: third}, first); err != ErrHeadMoved {
+		t.Fatalf("expected ErrHeadMoved, got: %v", err)
+	} else if head, err := rp.Head(); err != nil {
+		t.Fatal(err)
+	} else if !head.Equal(third) {
+		t.Fatalf("bad head: got=%s want=%s", head, third)
+	}
+}
+
+func TestFirstCommit(t *testing.T) {
+	rp := tmpRepo()
+	treeID, err := NewSugar(rp).Set(nil, []string{"foo"}, strings.NewReader("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &Commit{Parents: []ID{MustID("0123")}, Message: []byte("first")}
+	id, err := FirstCommit(rp, treeID, c)
+	if err != nil {
+		t.Fatal(err)
+	} else if head, err := rp.Head(); err != nil {
+		t.Fatal(err)
+	} else if !head.Equal(id) {
+		t.Fatalf("bad head: got=%s want=%s", head, id)
+	} else if commit, err := rp.Commit(id); err != nil {
+		t.Fatal(err)
+	} else if !commit.Tree.Equal(treeID) || len(commit.Parents) != 0 {
+		t.Fatalf("bad commit: %#v", commit)
+	}
+	if _, err := FirstCommit(rp, treeID, &Commit{Message: []byte("again")}); err != ErrAlreadyInitialized {
+		t.Fatalf("expected ErrAlreadyInitialized, got: %v", err)
+	} else if head, err := rp.Head(); err != nil {
+		t.Fatal(err)
+	} else if !head.Equal(id) {
+		t.Fatalf("head changed: got=%s want=%s", head, id)
+	}
+	other := tmpRepo()
+	if id, err := FirstCommit(other, treeID, nil); err != nil {
+		t.Fatal(err)
+	} else if commit, err := other.Commit(id); err != nil {
+		t.Fatal(err)
+	} else if !commit.Tree.Equal(treeID) || len(commit.Parents) != 0 || len(commit.Message) != 0 {
+		t.Fatalf("bad commit: %#v", commit)
+	}
+}
@@ -0,0 +1,247 @@
+package can
+
+import (
+	"fmt"
+	"io"
+)
+
+// CommitIterator iterates over commits.
+type CommitIterator interface {
+	// Next returns the id and Commit of the next commit, or io.EOF once there
+	// are no more commits.
+	Next() (ID, Commit, error)
+}
+
+// MissingObjectHandler decides how walks treat a referenced object that does
+// not exist, e.g. a parent at the boundary of a shallow clone or an object
+// lost to corruption. It is called with the id of the missing object and the
+// not found error. Returning nil skips the object as if it was not referenced,
+// i.e. the history is treated as truncated there, while returning an error
+// stops the walk with it. Handlers that record the ids and return nil report
+// missing objects and continue.
+//
+// Walks use the MissingObjects handler of the repo they read from if it is a
+// *DirRepo, and fail on missing objects otherwise. This applies to Walk,
+// WalkAll, MergeBase, Fingerprint, Copy and CopyAll, and to GC, Pack and
+// ReplayWAL of a DirRepo.
+type MissingObjectHandler func(id ID, err error) error
+
+// SkipMissing is a MissingObjectHandler that skips all missing objects, as
+// needed by shallow clones.
+func SkipMissing(id ID, err error) error {
+	return nil
+}
+
+// missingObject returns err unless it is a not found error for the object
+// with the given id that the MissingObjects handler of rp skips.
+func missingObject(rp Repo, id ID, err error) error {
+	if d, ok := rp.(*DirRepo); ok && d.MissingObjects != nil && IsNotFound(err) {
+		return d.MissingObjects(id, err)
+	}
+	return err
+}
+
+// Walk returns an iterator over the commit with the given id and its first
+// parents, newest first.
+func Walk(rp Repo, start ID) CommitIterator {
+	return &walker{rp: rp, queue: []ID{start}, firstParent: true}
+}
+
+// WalkAll returns an iterator over the commit with the given id and all of its
+// ancestors. Parents are visited breadth first, and every commit is only
+// returned once, even if it is reachable through several merges.
+func WalkAll(rp Repo, start ID) CommitIterator {
+	return &walker{rp: rp, queue: []ID{start}, seen: map[string]bool{}}
+}
+
+// MergeBase returns the lowest common ancestor of the commits a and b, i.e. a
+// commit reachable from both that is not an ancestor of another such commit.
+// A commit counts as its own ancestor, so the merge base of a commit and one
+// of its descendants is the commit itself. All parents of merge commits are
+// followed. If several lowest common ancestors exist, e.g. after criss-cross
+// merges, the one closest to b is returned. A nil id is returned if the
+// histories of a and b are disjoint.
+func MergeBase(rp Repo, a, b ID) (ID, error) {
+	ancestors := map[string]bool{}
+	if err := walkCommits(WalkAll(rp, a), func(id ID, _ Commit) error {
+		ancestors[string(id)] = true
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	var (
+		common  []ID
+		parents []ID
+	)
+	if err := walkCommits(WalkAll(rp, b), func(id ID, c Commit) error {
+		if ancestors[string(id)] {
+			common = append(common, id)
+			parents = append(parents, c.Parents...)
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	// Common ancestors reachable from another common ancestor are not lowest.
+	it := &walker{rp: rp, queue: parents, seen: map[string]bool{}}
+	if err := walkCommits(it, nil); err != nil {
+		return nil, err
+	}
+	for _, id := range common {
+		if !it.seen[string(id)] {
+			return id, nil
+		}
+	}
+	return nil, nil
+}
+
+// walkCommits calls fn, if not nil, for every commit returned by it, and
+// stops at the first error returned by fn.
+func walkCommits(it CommitIterator, fn func(ID, Commit) error) error {
+	for {
+		id, commit, err := it.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		} else if fn == nil {
+			continue
+		} else if err := fn(id, commit); err != nil {
+			return err
+		}
+	}
+}
+
+// walker implements Walk and WalkAll.
+type walker struct {
+	rp          Repo
+	queue       []ID
+	seen        map[string]bool
+	firstParent bool
+}
+
+func (w *walker) Next() (ID, Commit, error) {
+	for len(w.queue) > 0 {
+		id := w.queue[0]
+		w.queue = w.queue[1:]
+		if w.seen != nil {
+			if w.seen[string(id)] {
+				continue
+			}
+			w.seen[string(id)] = true
+		}
+		commit, err := w.rp.Commit(id)
+		if err != nil {
+			if err := missingObject(w.rp, id, err); err != nil {
+				return nil, Commit{}, err
+			}
+			continue
+		}
+		parents := commit.Parents
+		if w.firstParent && len(parents) > 1 {
+			parents = parents[:1]
+		}
+		w.queue = append(w.queue, parents...)
+		return id, commit, nil
+	}
+	return nil, Commit{}, io.EOF
+}
+
+// PathLog returns an iterator over the commits in the first-parent history of
+// the head that added, modified or removed the given key, newest first. Only
+// the trees along the key's path are compared.
+func PathLog(rp Repo, key []string) (CommitIterator, error) {
+	head, err := rp.Head()
+	if err != nil {
+		return nil, err
+	}
+	return &pathLog{rp: rp, key: key, next: head}, nil
+}
+
+type pathLog struct {
+	rp   Repo
+	key  []string
+	next ID
+}
+
+func (p *pathLog) Next() (ID, Commit, error) {
+	for p.next != nil {
+		id := p.next
+		commit, err := p.rp.Commit(id)
+		if err != nil {
+			return nil, Commit{}, err
+		}
+		entry, err := lookup(p.rp, commit.Tree, p.key)
+		if err != nil {
+			return nil, Commit{}, err
+		}
+		var parentEntry *Entry
+		p.next = nil
+		if len(commit.Parents) > 0 {
+			p.next = commit.Parents[0]
+			if parent, err := p.rp.Commit(p.next); err != nil {
+				return nil, Commit{}, err
+			} else if parentEntry, err = lookup(p.rp, parent.Tree, p.key); err != nil {
+				return nil, Commit{}, err
+			}
+		}
+		if !sameEntry(entry, parentEntry) {
+			return id, commit, nil
+		}
+	}
+	return nil, Commit{}, io.EOF
+}
+
+// LastModified returns the most recent commit in the first-parent history of
+// the head that added, modified or removed the given key. A not found error
+// is returned if the key was never changed in that history.
+func LastModified(rp Repo, key []string) (ID, Commit, error) {
+	it, err := PathLog(rp, key)
+	if err != nil {
+		return nil, Commit{}, err
+	}
+	id, commit, err := it.Next()
+	if err == io.EOF {
+		return nil, Commit{}, notFoundError(fmt.Sprintf("no commit modified key %#v", key))
+	}
+	return id, commit, err
+}
+
+// Squash writes a single commit that replaces the commits from the commit
+// with id from up to and including the commit with id to. The new commit has
+// the tree of to and the parents of from, so it collapses the range into one
+// commit. It keeps the time, author and committer of to, but not its
+// signature. An error is returned if from is not to or one of its first-parent
+// ancestors. The head is not changed.
+func (s *sugar) Squash(from, to ID, msg []byte) (ID, error) {
+	tip, err := s.Commit(to)
+	if err != nil {
+		return nil, err
+	}
+	it := Walk(s.Repo, to)
+	for {
+		id, commit, err := it.Next()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%s is not a first-parent ancestor of %s", from, to)
+		} else if err != nil {
+			return nil, err
+		} else if id.Equal(from) {
+			return s.WriteCommit(Commit{
+				Tree:      tip.Tree,
+				Parents:   commit.Parents,
+				Author:    tip.Author,
+				Committer: tip.Committer,
+				Time:      tip.Time,
+				Message:   msg,
+			})
+		}
+	}
+}
+
+// sameEntry returns true if a and b are both nil or refer to the same object.
+func sameEntry(a, b *Entry) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Kind == b.Kind && a.Mode == b.Mode && a.ID.Equal(b.ID)
+}
@@ -0,0 +1,262 @@
+package can
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestLastModified(t *testing.T) {
+	rp := tmpRepo()
+	var (
+		first  = testCommitSet(t, rp, []string{"foo", "bar"}, "a")
+		second = testCommitSet(t, rp, []string{"foo", "bar"}, "b")
+		_      = testCommitSet(t, rp, []string{"baz"}, "c")
+	)
+	if id, commit, err := LastModified(rp, []string{"foo", "bar"}); err != nil {
+		t.Fatal(err)
+	} else if !id.Equal(second) {
+		t.Fatalf("bad commit: got=%s want=%s", id, second)
+	} else if got, want := string(commit.Message), "foo/bar=b"; got != want {
+		t.Fatalf("bad message: got=%q want=%q", got, want)
+	}
+	testCommitSet(t, rp, []string{"foo", "bar"}, "d")
+	last := testCommitSet(t, rp, []string{"foo", "bar"}, "a")
+	if id, _, err := LastModified(rp, []string{"foo", "bar"}); err != nil {
+		t.Fatal(err)
+	} else if !id.Equal(last) || id.Equal(first) {
+		t.Fatalf("bad commit: got=%s want=%s", id, last)
+	}
+	if _, _, err := LastModified(rp, []string{"missing"}); !IsNotFound(err) {
+		t.Fatalf("expected not found error, got: %v", err)
+	}
+}
+
+func TestLastModified_Root(t *testing.T) {
+	rp := tmpRepo()
+	root := testCommitSet(t, rp, []string{"foo"}, "a")
+	testCommitSet(t, rp, []string{"bar"}, "b")
+	if id, _, err := LastModified(rp, []string{"foo"}); err != nil {
+		t.Fatal(err)
+	} else if !id.Equal(root) {
+		t.Fatalf("bad commit: got=%s want=%s", id, root)
+	}
+}
+
+func TestPathLog(t *testing.T) {
+	rp := tmpRepo()
+	var (
+		first = testCommitSet(t, rp, []string{"foo", "bar"}, "a")
+		_     = testCommitSet(t, rp, []string{"foo", "baz"}, "b")
+		third = testCommitSet(t, rp, []string{"foo", "bar"}, "c")
+	)
+	it, err := PathLog(rp, []string{"foo", "bar"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []ID{third, first} {
+		if id, _, err := it.Next(); err != nil {
+			t.Fatal(err)
+		} else if !id.Equal(want) {
+			t.Fatalf("bad commit: got=%s want=%s", id, want)
+		}
+	}
+	if _, _, err := it.Next(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got: %v", err)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	rp := NewMemRepo()
+	commit := func(msg string, parents ...ID) ID {
+		id, err := rp.WriteCommit(Commit{Tree: MustID("0123"), Parents: parents, Message: []byte(msg)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	root := commit("root")
+	a := commit("a", root)
+	b := commit("b", root)
+	c := commit("c", b)
+	merge := commit("merge", a, c)
+	messages := func(it CommitIterator) []string {
+		var msgs []string
+		for {
+			_, commit, err := it.Next()
+			if err == io.EOF {
+				return msgs
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			msgs = append(msgs, string(commit.Message))
+		}
+	}
+	if diff := pretty.Compare(messages(Walk(rp, merge)), []string{"merge", "a", "root"}); diff != "" {
+		t.Fatal(diff)
+	}
+	if diff := pretty.Compare(messages(WalkAll(rp, merge)), []string{"merge", "a", "c", "root", "b"}); diff != "" {
+		t.Fatal(diff)
+	}
+	if _, _, err := Walk(rp, MustID("4567")).Next(); !IsNotFound(err) {
+		t.Fatalf("expected not found error, got: %v", err)
+	}
+}
+
+func TestMissingObjectHandler(t *testing.T) {
+	rp := tmpDirRepo()
+	testCommitSet(t, rp, []string{"foo"}, "a")
+	var (
+		second = testCommitSet(t, rp, []string{"foo"}, "b")
+		third  = testCommitSet(t, rp, []string{"foo"}, "c")
+	)
+	// Remove the parent of the head, like the boundary of a shallow clone.
+	if err := os.Remove(rp.path(second)); err != nil {
+		t.Fatal(err)
+	}
+	var reported []ID
+	tests := []struct {
+		Name    string
+		Handler MissingObjectHandler
+		Fail    bool
+	}{
+		{Name: "fail", Fail: true},
+		{Name: "skip", Handler: SkipMissing},
+		{Name: "report", Handler: func(id ID, err error) error {
+			reported = append(reported, id)
+			return nil
+		}},
+	}
+	for _, test := range tests {
+		rp.MissingObjects = test.Handler
+		var walked []ID
+		walkErr := walkCommits(WalkAll(rp, third), func(id ID, _ Commit) error {
+			walked = append(walked, id)
+			return nil
+		})
+		copyErr := CopyAll(NewMemRepo(), rp, third, 2)
+		if test.Fail {
+			if !IsNotFound(walkErr) {
+				t.Fatalf("%s: expected not found error from walk, got: %v", test.Name, walkErr)
+			} else if !IsNotFound(copyErr) {
+				t.Fatalf("%s: expected not found error from copy, got: %v", test.Name, copyErr)
+			} else if _, err := rp.GC(); !IsNotFound(err) {
+				t.Fatalf("%s: expected not found error from GC, got: %v", test.Name, err)
+			}
+			continue
+		}
+		if walkErr != nil {
+			t.Fatalf("%s: %s", test.Name, walkErr)
+		} else if diff := pretty.Compare(walked, []ID{third}); diff != "" {
+			t.Fatalf("%s: %s", test.Name, diff)
+		} else if copyErr != nil {
+			t.Fatalf("%s: %s", test.Name, copyErr)
+		}
+	}
+	if diff := pretty.Compare(reported, []ID{second, second}); diff != "" {
+		t.Fatalf("bad reported ids: %s", diff)
+	}
+	rp.MissingObjects = SkipMissing
+	if _, err := rp.GC(); err != nil {
+		t.Fatal(err)
+	} else if _, err := NewSugar(rp).Get([]string{"foo"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeBase(t *testing.T) {
+	rp := NewMemRepo()
+	commit := func(msg string, parents ...ID) ID {
+		id, err := rp.WriteCommit(Commit{Tree: MustID("0123"), Parents: parents, Message: []byte(msg)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	// Diamond: root <- left, right <- merge, with further commits on top.
+	root := commit("root")
+	left := commit("left", root)
+	right := commit("right", root)
+	merge := commit("merge", left, right)
+	ours := commit("ours", merge)
+	theirs := commit("theirs", right)
+	// Criss-cross: x and y both merge left and right.
+	x := commit("x", left, right)
+	y := commit("y", right, left)
+	other := commit("other root")
+	for _, test := range []struct {
+		Name string
+		A, B ID
+		Want ID
+	}{
+		{Name: "diamond", A: ours, B: theirs, Want: right},
+		{Name: "siblings", A: left, B: right, Want: root},
+		{Name: "ancestor", A: merge, B: left, Want: left},
+		{Name: "descendant", A: root, B: ours, Want: root},
+		{Name: "same", A: ours, B: ours, Want: ours},
+		{Name: "merge and parent ancestor", A: theirs, B: merge, Want: right},
+		{Name: "unrelated", A: ours, B: other, Want: nil},
+	} {
+		got, err := MergeBase(rp, test.A, test.B)
+		if err != nil {
+			t.Fatalf("%s: %s", test.Name, err)
+		} else if !got.Equal(test.Want) {
+			t.Errorf("%s: got=%s want=%s", test.Name, got, test.Want)
+		}
+	}
+	// Both left and right are lowest common ancestors of x and y.
+	if got, err := MergeBase(rp, x, y); err != nil {
+		t.Fatal(err)
+	} else if !got.Equal(left) && !got.Equal(right) {
+		t.Errorf("criss-cross: got=%s want=%s or %s", got, left, right)
+	}
+	if _, err := MergeBase(rp, ours, MustID("4567")); !IsNotFound(err) {
+		t.Fatalf("expected not found error, got: %v", err)
+	}
+}
+
+func TestSugar_Squash(t *testing.T) {
+	rp := tmpRepo()
+	var ids []ID
+	for i, name := range []string{"a", "b", "c", "d"} {
+		ids = append(ids, testCommitSet(t, rp, []string{"keys", name}, strconv.Itoa(i)))
+	}
+	tip := ids[len(ids)-1]
+	s := NewSugar(rp)
+	squashed, err := s.Squash(ids[1], tip, []byte("squashed"))
+	if err != nil {
+		t.Fatal(err)
+	} else if commit, err := rp.Commit(squashed); err != nil {
+		t.Fatal(err)
+	} else if string(commit.Message) != "squashed" {
+		t.Fatalf("bad message: %q", commit.Message)
+	} else if len(commit.Parents) != 1 || !commit.Parents[0].Equal(ids[0]) {
+		t.Fatalf("bad parents: %v", commit.Parents)
+	} else if err := rp.WriteHead(squashed); err != nil {
+		t.Fatal(err)
+	}
+	read := func(rc io.ReadCloser, err error) string {
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer rc.Close()
+		data, err := ioutil.ReadAll(rc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		key := []string{"keys", name}
+		if got, want := read(s.Get(key)), read(s.GetAt(tip, key)); got != want {
+			t.Fatalf("%#v: got=%q want=%q", key, got, want)
+		}
+	}
+	if _, err := s.Squash(tip, ids[1], nil); err == nil {
+		t.Fatal("expected error for from not being an ancestor of to")
+	}
+}
@@ -0,0 +1,456 @@
+package can
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Handler returns a read-only HTTPHandler for rp.
+func Handler(rp Repo) http.Handler {
+	return &HTTPHandler{Repo: rp}
+}
+
+// HTTPHandler serves a Repo over HTTP. Objects are transferred in the default
+// format, so their ids must match the ones computed by it. It handles the
+// following requests:
+//
+//	GET  /objects/<id>  returns the encoded object, or 404
+//	HEAD /objects/<id>  returns 200 if the object exists, or 404
+//	GET  /objects.bloom returns a Bloom of the stored objects, see BuildBloom
+//	POST /objects       stores the encoded object in the body, returns its id
+//	GET  /head          returns the id of the head, or 404
+//	PUT  /head          sets the head to the id in the body
+//	GET  /refs          returns a "<id> <name>\n" line for every ref
+//	GET  /refs/<name>   returns the id of the ref, or 404
+//	PUT  /refs/<name>   sets the ref to the id in the body
+//
+// Requests that modify the repo are rejected unless Writable is set. Requests
+// with malformed ids are rejected with 400. Internal errors are answered with
+// a generic 500 response, and their details are logged to ErrorLog, or the
+// standard logger if it is nil, so they are not disclosed to clients.
+type HTTPHandler struct {
+	Repo     Repo
+	Writable bool
+	ErrorLog *log.Logger
+}
+
+// ServeHTTP is part of the http.Handler interface.
+func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		path   = r.URL.Path
+		format = NewDefaultFormat()
+		err    error
+	)
+	switch {
+	case path == "/objects" && r.Method == "POST":
+		err = h.writable(func() error { return h.writeObject(w, r.Body, format) })
+	case strings.HasPrefix(path, "/objects/") && (r.Method == "GET" || r.Method == "HEAD"):
+		var id ID
+		if id, err = parseHTTPID(strings.TrimPrefix(path, "/objects/")); err == nil {
+			err = h.readObject(w, r.Method == "HEAD", id, format)
+		}
+	case path == "/objects.bloom" && r.Method == "GET":
+		var b *Bloom
+		if b, err = BuildBloom(h.Repo); err == nil {
+			w.Header().Set("Content-Type", "application/octet-stream")
+			err = b.Encode(w)
+		}
+	case path == "/head" && r.Method == "GET":
+		var id ID
+		if id, err = h.Repo.Head(); err == nil {
+			_, err = io.WriteString(w, id.String())
+		}
+	case path == "/head" && r.Method == "PUT":
+		err = h.writable(func() error {
+			id, err := readHTTPID(r.Body)
+			if err != nil {
+				return err
+			}
+			return h.Repo.WriteHead(id)
+		})
+	case path == "/refs" && r.Method == "GET":
+		err = h.listRefs(w)
+	case strings.HasPrefix(path, "/refs/") && r.Method == "GET":
+		var id ID
+		if id, err = h.Repo.Ref(strings.TrimPrefix(path, "/refs/")); err == nil {
+			_, err = io.WriteString(w, id.String())
+		}
+	case strings.HasPrefix(path, "/refs/") && r.Method == "PUT":
+		err = h.writable(func() error {
+			id, err := readHTTPID(r.Body)
+			if err != nil {
+				return err
+			}
+			return h.Repo.WriteRef(strings.TrimPrefix(path, "/refs/"), id)
+		})
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	if err == errReadOnly {
+		http.Error(w, err.Error(), http.StatusMethodNotAllowed)
+	} else if _, ok := err.(badRequestError); ok {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	} else if IsNotFound(err) {
+		http.Error(w, "not found", http.StatusNotFound)
+	} else if err != nil {
+		h.logf("can: %s %s: %s", r.Method, path, err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+	}
+}
+
+// logf logs an error to the ErrorLog of h.
+func (h *HTTPHandler) logf(format string, args ...interface{}) {
+	if h.ErrorLog != nil {
+		h.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// badRequestError is returned for malformed requests. Its message is sent to
+// the client.
+type badRequestError string
+
+func (b badRequestError) Error() string { return string(b) }
+
+// errReadOnly is returned for write requests to a read-only HTTPHandler.
+var errReadOnly = errors.New("repo is read-only")
+
+// writable calls fn if the handler is writable, or returns errReadOnly.
+func (h *HTTPHandler) writable(fn func() error) error {
+	if !h.Writable {
+		return errReadOnly
+	}
+	return fn()
+}
+
+// readObject writes the encoded object with the given id to w.
+func (h *HTTPHandler) readObject(w http.ResponseWriter, headOnly bool, id ID, format Format) error {
+	if headOnly {
+		if ok, err := h.Repo.Exists(id); err != nil {
+			return err
+		} else if !ok {
+			return notFoundError(fmt.Sprintf("object not found: %s", id))
+		}
+		return nil
+	}
+	obj, err := readObject(h.Repo, id)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	switch o := obj.(type) {
+	case Commit:
+		return format.EncodeCommit(w, o)
+	case Tree:
+		return format.EncodeTree(w, o)
+	default:
+		rc := o.(io.ReadCloser)
+		defer rc.Close()
+		return format.EncodeBlob(w, rc)
+	}
+}
+
+// writeObject stores the encoded object read from r and writes its id to w.
+func (h *HTTPHandler) writeObject(w http.ResponseWriter, r io.Reader, format Format) error {
+	b := bufio.NewReader(r)
+	prefix, _ := b.Peek(len(commitPrefix))
+	var (
+		id  ID
+		err error
+	)
+	switch prefixKind(prefix) {
+	case KindBlob:
+		var blob io.Reader
+		if blob, err = format.DecodeBlob(b); err == nil {
+			id, err = h.Repo.WriteBlob(blob)
+		}
+	case KindTree:
+		var tree Tree
+		if tree, err = format.DecodeTree(b); err == nil {
+			id, err = h.Repo.WriteTree(tree)
+		}
+	case KindCommit:
+		var commit Commit
+		if commit, err = format.DecodeCommit(b); err == nil {
+			id, err = h.Repo.WriteCommit(commit)
+		}
+	default:
+		err = badRequestError(fmt.Sprintf("unknown object prefix: %q", prefix))
+	}
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, id.String())
+	return err
+}
+
+// listRefs writes a line for every ref to w.
+func (h *HTTPHandler) listRefs(w io.Writer) error {
+	refs, err := h.Repo.Refs()
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(refs))
+	for name := range refs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := fmt.Fprintf(w, "%s %s\n", refs[name], name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readHTTPID reads a hex id from r.
+func readHTTPID(r io.Reader) (ID, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, 1024))
+	if err != nil {
+		return nil, err
+	}
+	return parseHTTPID(strings.TrimSpace(string(data)))
+}
+
+// parseHTTPID parses a hex id sent by a client, and returns a
+// badRequestError if it is malformed or empty.
+func parseHTTPID(s string) (ID, error) {
+	id, err := ParseID(s)
+	if err != nil || len(id) == 0 {
+		return nil, badRequestError(fmt.Sprintf("bad id: %q", s))
+	}
+	return id, nil
+}
+
+// NewHTTPRepo returns a Repo for the repo served by an HTTPHandler at
+// baseURL. If client is nil, http.DefaultClient is used. Objects read from
+// the server are verified against their id.
+func NewHTTPRepo(baseURL string, client *http.Client) Repo {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &httpRepo{
+		base:   strings.TrimSuffix(baseURL, "/"),
+		client: client,
+		format: NewDefaultFormat(),
+	}
+}
+
+// Check Repo interface compliance
+var _ = Repo(&httpRepo{})
+
+type httpRepo struct {
+	base   string
+	client *http.Client
+	format Format
+}
+
+func (h *httpRepo) Head() (ID, error) {
+	return h.getID("/head")
+}
+
+func (h *httpRepo) WriteHead(id ID) error {
+	_, err := h.do("PUT", "/head", strings.NewReader(id.String()))
+	return err
+}
+
+func (h *httpRepo) Ref(name string) (ID, error) {
+	if err := checkRefName(name); err != nil {
+		return nil, err
+	}
+	return h.getID("/refs/" + name)
+}
+
+func (h *httpRepo) WriteRef(name string, id ID) error {
+	if err := checkRefName(name); err != nil {
+		return err
+	}
+	_, err := h.do("PUT", "/refs/"+name, strings.NewReader(id.String()))
+	return err
+}
+
+func (h *httpRepo) Refs() (map[string]ID, error) {
+	data, err := h.do("GET", "/refs", nil)
+	if err != nil {
+		return nil, err
+	}
+	refs := map[string]ID{}
+	for _, line := range strings.Split(strings.TrimSuffix(string(data), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		fields := strings.SplitN(line, " ", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("bad ref line: %q", line)
+		} else if refs[fields[1]], err = ParseID(fields[0]); err != nil {
+			return nil, err
+		}
+	}
+	return refs, nil
+}
+
+func (h *httpRepo) Blob(id ID) (io.ReadCloser, error) {
+	body, err := h.open(id)
+	if err != nil {
+		return nil, err
+	}
+	r, err := h.format.DecodeBlob(NewIDVerifier(body, id))
+	if err != nil {
+		body.Close()
+		return nil, err
+	}
+	return NewReadCloser(r, body), nil
+}
+
+func (h *httpRepo) WriteBlob(r io.Reader) (ID, error) {
+	return h.write(func(w io.Writer) error { return h.format.EncodeBlob(w, r) })
+}
+
+func (h *httpRepo) Tree(id ID) (Tree, error) {
+	var tree Tree
+	err := h.decode(id, func(r io.Reader) (err error) {
+		tree, err = h.format.DecodeTree(r)
+		return err
+	})
+	return tree, err
+}
+
+func (h *httpRepo) WriteTree(t Tree) (ID, error) {
+	return h.write(func(w io.Writer) error { return h.format.EncodeTree(w, t) })
+}
+
+func (h *httpRepo) Commit(id ID) (Commit, error) {
+	var commit Commit
+	err := h.decode(id, func(r io.Reader) (err error) {
+		commit, err = h.format.DecodeCommit(r)
+		return err
+	})
+	return commit, err
+}
+
+func (h *httpRepo) WriteCommit(c Commit) (ID, error) {
+	return h.write(func(w io.Writer) error { return h.format.EncodeCommit(w, c) })
+}
+
+func (h *httpRepo) Exists(id ID) (bool, error) {
+	if _, err := h.do("HEAD", "/objects/"+id.String(), nil); IsNotFound(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// bloom is part of the bloomer interface.
+func (h *httpRepo) bloom() (*Bloom, error) {
+	res, err := h.request("GET", "/objects.bloom", nil)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return DecodeBloom(res.Body)
+}
+
+// getID returns the id returned by a GET request for the given path.
+func (h *httpRepo) getID(path string) (ID, error) {
+	data, err := h.do("GET", path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return ParseID(strings.TrimSpace(string(data)))
+}
+
+// decode calls fn with a verifying reader for the object with the given id,
+// and reads the rest of the object afterwards to complete the verification.
+func (h *httpRepo) decode(id ID, fn func(io.Reader) error) error {
+	body, err := h.open(id)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	r := NewIDVerifier(body, id)
+	if err := fn(r); err != nil {
+		return err
+	}
+	_, err = io.Copy(ioutil.Discard, r)
+	return err
+}
+
+// write sends the object encoded by fn to the server, and checks that the
+// server stored it under the expected id.
+func (h *httpRepo) write(fn func(io.Writer) error) (ID, error) {
+	pr, pw := io.Pipe()
+	iw := NewIDWriter(pw)
+	encoded := make(chan struct{})
+	go func() {
+		defer close(encoded)
+		pw.CloseWithError(fn(iw))
+	}()
+	data, err := h.do("POST", "/objects", pr)
+	// Unblock the encoder if the request failed before reading everything.
+	pr.CloseWithError(fmt.Errorf("request finished"))
+	<-encoded
+	if err != nil {
+		return nil, err
+	}
+	got, err := ParseID(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	} else if want := iw.ID(); !got.Equal(want) {
+		return nil, fmt.Errorf("server id mismatch: got=%s want=%s", got, want)
+	}
+	return got, nil
+}
+
+// open returns the body of a GET request for the object with the given id.
+func (h *httpRepo) open(id ID) (io.ReadCloser, error) {
+	res, err := h.request("GET", "/objects/"+id.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return res.Body, nil
+}
+
+// do sends a request and returns its response body.
+func (h *httpRepo) do(method, path string, body io.Reader) ([]byte, error) {
+	res, err := h.request(method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	return ioutil.ReadAll(res.Body)
+}
+
+// request sends a request and returns its response, or an error if the
+// response has an error status. A 404 status results in a not found error.
+func (h *httpRepo) request(method, path string, body io.Reader) (*http.Response, error) {
+	u := h.base + (&url.URL{Path: path}).EscapedPath()
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	res, err := h.client.Do(req)
+	if err != nil {
+		return nil, err
+	} else if res.StatusCode == http.StatusOK {
+		return res, nil
+	}
+	defer res.Body.Close()
+	msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	err = fmt.Errorf("%s %s: %s: %s", method, path, res.Status, bytes.TrimSpace(msg))
+	if res.StatusCode == http.StatusNotFound {
+		return nil, notFoundError(err.Error())
+	}
+	return nil, err
+}
@@ -0,0 +1,146 @@
+package can
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestHTTPRepo(t *testing.T) {
+	server := tmpRepo()
+	ts := httptest.NewServer(&HTTPHandler{Repo: server, Writable: true})
+	defer ts.Close()
+	rp := NewHTTPRepo(ts.URL, nil)
+	if _, err := rp.Head(); !IsNotFound(err) {
+		t.Fatalf("expected not found error, got: %v", err)
+	}
+	testCommitSet(t, rp, []string{"foo", "bar"}, "a")
+	head := testCommitSet(t, rp, []string{"foo", "baz"}, "b")
+	if got, err := server.Head(); err != nil {
+		t.Fatal(err)
+	} else if !got.Equal(head) {
+		t.Fatalf("bad server head: got=%s want=%s", got, head)
+	}
+	rc, err := NewSugar(rp).Get([]string{"foo", "baz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if data, err := ioutil.ReadAll(rc); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "b" {
+		t.Fatalf("bad value: %q", data)
+	}
+	if want, err := Fingerprint(server); err != nil {
+		t.Fatal(err)
+	} else if got, err := Fingerprint(rp); err != nil {
+		t.Fatal(err)
+	} else if !got.Equal(want) {
+		t.Fatal("fingerprints differ")
+	}
+	if ok, err := rp.Exists(head); err != nil || !ok {
+		t.Fatalf("expected head to exist: %v", err)
+	} else if ok, err := rp.Exists(MustID("0123")); err != nil || ok {
+		t.Fatalf("expected missing object to not exist: %v", err)
+	} else if _, err := rp.Blob(MustID("0123")); !IsNotFound(err) {
+		t.Fatalf("expected not found error, got: %v", err)
+	}
+	if err := rp.WriteRef("branches/dev", head); err != nil {
+		t.Fatal(err)
+	} else if got, err := rp.Ref("branches/dev"); err != nil {
+		t.Fatal(err)
+	} else if !got.Equal(head) {
+		t.Fatalf("bad ref: got=%s want=%s", got, head)
+	} else if refs, err := rp.Refs(); err != nil {
+		t.Fatal(err)
+	} else if diff := pretty.Compare(refs, map[string]ID{"branches/dev": head}); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestHTTPRepo_ReadOnly(t *testing.T) {
+	server := tmpRepo()
+	head := testCommitSet(t, server, []string{"foo"}, "a")
+	ts := httptest.NewServer(Handler(server))
+	defer ts.Close()
+	rp := NewHTTPRepo(ts.URL, nil)
+	if got, err := rp.Head(); err != nil {
+		t.Fatal(err)
+	} else if !got.Equal(head) {
+		t.Fatalf("bad head: got=%s want=%s", got, head)
+	} else if _, err := rp.WriteBlob(strings.NewReader("b")); err == nil {
+		t.Fatal("expected error when writing to a read-only handler")
+	} else if err := rp.WriteHead(MustID("0123")); err == nil {
+		t.Fatal("expected error when writing to a read-only handler")
+	}
+}
+
+func TestHTTPRepo_Verify(t *testing.T) {
+	server := tmpRepo()
+	id, err := server.WriteBlob(strings.NewReader("Hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The server returns the wrong blob for every object.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("blob\nJello"))
+	}))
+	defer ts.Close()
+	rc, err := NewHTTPRepo(ts.URL, nil).Blob(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if _, err := ioutil.ReadAll(rc); err == nil || !strings.Contains(err.Error(), "bad id") {
+		t.Fatalf("expected bad id error, got: %v", err)
+	}
+}
+
+func TestHTTPHandler_Errors(t *testing.T) {
+	server := tmpDirRepo()
+	id, err := server.WriteBlob(strings.NewReader("Hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Replacing the object file with a directory makes reading it fail.
+	if err := os.Remove(server.path(id)); err != nil {
+		t.Fatal(err)
+	} else if err := os.Mkdir(server.path(id), 0700); err != nil {
+		t.Fatal(err)
+	}
+	logs := &bytes.Buffer{}
+	ts := httptest.NewServer(&HTTPHandler{Repo: server, ErrorLog: log.New(logs, "", 0)})
+	defer ts.Close()
+	for _, test := range []struct {
+		Path   string
+		Status int
+		Body   string
+	}{
+		{Path: "/objects/", Status: http.StatusBadRequest, Body: `bad id: ""`},
+		{Path: "/objects/xyz", Status: http.StatusBadRequest, Body: `bad id: "xyz"`},
+		{Path: "/objects/0123", Status: http.StatusNotFound, Body: "not found"},
+		{Path: "/objects/" + id.String(), Status: http.StatusInternalServerError, Body: "internal error"},
+	} {
+		res, err := http.Get(ts.URL + test.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		} else if res.StatusCode != test.Status || strings.TrimSpace(string(body)) != test.Body {
+			t.Errorf("%s: got=%d %q want=%d %q", test.Path, res.StatusCode, body, test.Status, test.Body)
+		}
+	}
+	if !strings.Contains(logs.String(), server.path(id)) {
+		t.Fatalf("expected internal error to be logged, got: %q", logs)
+	}
+}
@@ -0,0 +1,178 @@
+package can
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"time"
+)
+
+// NewJSONFormat returns a Format that encodes objects as JSON, which is meant
+// for debugging and interoperability. Blobs are encoded as base64 strings and
+// are buffered in memory, trees as arrays of entries, and commits as objects
+// with hex ids and RFC 3339 times. Commit messages are base64 encoded, as
+// they may hold arbitrary bytes.
+func NewJSONFormat() Format {
+	return &jsonFormat{}
+}
+
+// jsonFormat implements the Format interface. It holds no state and is
+// therefore safe for concurrent use.
+type jsonFormat struct{}
+
+type jsonEntry struct {
+	Kind Kind   `json:"kind"`
+	Mode uint32 `json:"mode,omitempty"`
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type jsonCommit struct {
+	Tree      string   `json:"tree"`
+	Parents   []string `json:"parents,omitempty"`
+	Author    string   `json:"author,omitempty"`
+	Committer string   `json:"committer,omitempty"`
+	Signature []byte   `json:"signature,omitempty"`
+	Time      string   `json:"time"`
+	Message   []byte   `json:"message,omitempty"`
+}
+
+// FormatInfo is part of the FormatDescriber interface.
+func (f *jsonFormat) FormatInfo() (string, int) {
+	return "json", 1
+}
+
+// EncodeBlob is part of the Format interface.
+func (f *jsonFormat) EncodeBlob(w io.Writer, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	return f.encode(w, data)
+}
+
+// DecodeBlob is part of the Format interface.
+func (f *jsonFormat) DecodeBlob(r io.Reader) (io.Reader, error) {
+	var data []byte
+	if err := f.decode(r, KindBlob, &data); err != nil {
+		return nil, err
+	}
+	return bytes.NewReader(data), nil
+}
+
+// EncodeTree is part of the Format interface.
+func (f *jsonFormat) EncodeTree(w io.Writer, t Tree) error {
+	sort.Sort(t)
+	entries := make([]jsonEntry, len(t))
+	for i, entry := range t {
+		entries[i] = jsonEntry{Kind: entry.Kind, Mode: entry.Mode, ID: entry.ID.String(), Name: entry.Name}
+	}
+	return f.encode(w, entries)
+}
+
+// DecodeTree is part of the Format interface.
+func (f *jsonFormat) DecodeTree(r io.Reader) (Tree, error) {
+	var entries []jsonEntry
+	if err := f.decode(r, KindTree, &entries); err != nil {
+		return nil, err
+	} else if entries == nil {
+		return nil, fmt.Errorf("bad tree: not an array")
+	}
+	var tree Tree
+	for _, entry := range entries {
+		id, err := ParseID(entry.ID)
+		if err != nil {
+			return nil, err
+		}
+		tree = append(tree, &Entry{Kind: entry.Kind, Mode: entry.Mode, ID: id, Name: entry.Name})
+	}
+	return tree, nil
+}
+
+// EncodeCommit is part of the Format interface.
+func (f *jsonFormat) EncodeCommit(w io.Writer, c Commit) error {
+	jc := jsonCommit{
+		Tree:      c.Tree.String(),
+		Author:    c.Author,
+		Committer: c.Committer,
+		Signature: c.Signature,
+		Time:      c.Time.Format(time.RFC3339Nano),
+		Message:   c.Message,
+	}
+	for _, parent := range c.Parents {
+		jc.Parents = append(jc.Parents, parent.String())
+	}
+	return f.encode(w, jc)
+}
+
+// DecodeCommit is part of the Format interface.
+func (f *jsonFormat) DecodeCommit(r io.Reader) (Commit, error) {
+	var jc jsonCommit
+	if err := f.decode(r, KindCommit, &jc); err != nil {
+		return Commit{}, err
+	}
+	commit := Commit{Author: jc.Author, Committer: jc.Committer}
+	var err error
+	if commit.Tree, err = ParseID(jc.Tree); err != nil {
+		return Commit{}, err
+	}
+	for _, parent := range jc.Parents {
+		id, err := ParseID(parent)
+		if err != nil {
+			return Commit{}, err
+		}
+		commit.Parents = append(commit.Parents, id)
+	}
+	t, err := time.Parse(time.RFC3339Nano, jc.Time)
+	if err != nil {
+		return Commit{}, fmt.Errorf("bad time: %s: %s", jc.Time, err)
+	}
+	// Use the same location as the default format, and the zero time for the
+	// zero Commit value, to allow symmetry of encoding/decoding.
+	if _, offset := t.Zone(); !t.IsZero() {
+		commit.Time = time.Unix(t.Unix(), int64(t.Nanosecond())).In(time.FixedZone("", offset))
+	}
+	if len(jc.Signature) > 0 {
+		commit.Signature = jc.Signature
+	}
+	if len(jc.Message) > 0 {
+		commit.Message = jc.Message
+	}
+	return commit, nil
+}
+
+// encode writes v to w as a line of JSON.
+func (f *jsonFormat) encode(w io.Writer, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// decode reads all of r and unmarshals it into v, which must be of the given
+// kind. Blobs are JSON strings, trees arrays and commits objects, so a
+// *KindError is returned if r holds another kind of value.
+func (f *jsonFormat) decode(r io.Reader, want Kind, v interface{}) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var got Kind
+	switch trimmed := bytes.TrimSpace(data); {
+	case bytes.HasPrefix(trimmed, []byte(`"`)):
+		got = KindBlob
+	case bytes.HasPrefix(trimmed, []byte("[")):
+		got = KindTree
+	case bytes.HasPrefix(trimmed, []byte("{")):
+		got = KindCommit
+	}
+	if got != "" && got != want {
+		return &KindError{Want: want, Got: got}
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,148 @@
+package can
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestJSONFormat_Blob(t *testing.T) {
+	tests := []struct {
+		Data []byte
+		Want []byte
+	}{
+		{
+			Data: []byte(""),
+			Want: []byte("\"\"\n"),
+		},
+		{
+			Data: []byte("Hello World"),
+			Want: []byte("\"SGVsbG8gV29ybGQ=\"\n"),
+		},
+	}
+	format := NewJSONFormat()
+	for _, test := range tests {
+		buf := bytes.NewBuffer(nil)
+		if err := format.EncodeBlob(buf, bytes.NewReader(test.Data)); err != nil {
+			t.Fatal(err)
+		} else if got := buf.Bytes(); bytes.Compare(got, test.Want) != 0 {
+			t.Fatalf("got=%q want=%q", got, test.Want)
+		} else if r, err := format.DecodeBlob(buf); err != nil {
+			t.Fatal(err)
+		} else if gotData, err := ioutil.ReadAll(r); err != nil {
+			t.Fatal(err)
+		} else if bytes.Compare(gotData, test.Data) != 0 {
+			t.Fatalf("got=%q want=%q", gotData, test.Data)
+		}
+	}
+}
+
+func TestJSONFormat_Tree(t *testing.T) {
+	tests := []struct {
+		Tree Tree
+		Want []byte
+	}{
+		{
+			Tree: nil,
+			Want: []byte("[]\n"),
+		},
+		{
+			Tree: Tree{
+				{Kind: KindBlob, Name: "how are you?", ID: MustID("8765")},
+				{Kind: KindTree, Name: "hi", ID: MustID("1234")},
+			},
+			Want: []byte(`[{"kind":"tree","id":"1234","name":"hi"},{"kind":"blob","id":"8765","name":"how are you?"}]` + "\n"),
+		},
+		{
+			Tree: Tree{{Kind: KindBlob, Mode: ModeExecutable, Name: "run.sh", ID: MustID("1234")}},
+			Want: []byte(`[{"kind":"blob","mode":33261,"id":"1234","name":"run.sh"}]` + "\n"),
+		},
+	}
+	format := NewJSONFormat()
+	for _, test := range tests {
+		buf := bytes.NewBuffer(nil)
+		if err := format.EncodeTree(buf, test.Tree); err != nil {
+			t.Fatal(err)
+		} else if got := buf.Bytes(); bytes.Compare(got, test.Want) != 0 {
+			t.Fatalf("got=%q want=%q", got, test.Want)
+		} else if gotTree, err := format.DecodeTree(buf); err != nil {
+			t.Fatal(err)
+		} else if diff := pretty.Compare(gotTree, test.Tree); diff != "" {
+			t.Fatalf("%s", diff)
+		}
+	}
+}
+
+func TestJSONFormat_Commit(t *testing.T) {
+	tm := time.Date(2015, 2, 20, 13, 14, 33, 0, time.FixedZone("", 3600))
+	tests := []struct {
+		Commit Commit
+		Want   []byte
+	}{
+		{
+			Commit: Commit{},
+			Want:   []byte(`{"tree":"","time":"0001-01-01T00:00:00Z"}` + "\n"),
+		},
+		{
+			Commit: Commit{
+				Tree:      MustID("0123456789"),
+				Parents:   []ID{MustID("6789"), MustID("45")},
+				Author:    "Jane Doe <jane@example.com>",
+				Committer: "John Doe <john@example.com>",
+				Time:      tm,
+				Message:   []byte("hi"),
+			},
+			Want: []byte(`{"tree":"0123456789","parents":["6789","45"],"author":"Jane Doe \u003cjane@example.com\u003e","committer":"John Doe \u003cjohn@example.com\u003e","time":"2015-02-20T13:14:33+01:00","message":"aGk="}` + "\n"),
+		},
+		{
+			Commit: Commit{
+				Tree: MustID("0123456789"),
+				Time: tm.Add(5 * time.Millisecond).In(time.FixedZone("", -1800)),
+			},
+			Want: []byte(`{"tree":"0123456789","time":"2015-02-20T11:44:33.005-00:30"}` + "\n"),
+		},
+	}
+	format := NewJSONFormat()
+	for _, test := range tests {
+		buf := bytes.NewBuffer(nil)
+		if err := format.EncodeCommit(buf, test.Commit); err != nil {
+			t.Fatal(err)
+		} else if got := buf.Bytes(); bytes.Compare(got, test.Want) != 0 {
+			t.Fatalf("got=%q want=%q", got, test.Want)
+		} else if gotCommit, err := format.DecodeCommit(buf); err != nil {
+			t.Fatal(err)
+		} else if diff := pretty.Compare(gotCommit, test.Commit); diff != "" {
+			t.Fatalf("%s", diff)
+		}
+	}
+}
+
+func TestJSONFormat_Errors(t *testing.T) {
+	format := NewJSONFormat()
+	if _, err := format.DecodeTree(strings.NewReader(`{"tree":""}`)); err == nil {
+		t.Fatal("expected error for commit decoded as tree")
+	} else if ke, ok := err.(*KindError); !ok || ke.Got != KindCommit || ke.Want != KindTree {
+		t.Fatalf("expected kind error, got: %#v", err)
+	} else if _, err := format.DecodeTree(strings.NewReader("null")); err == nil {
+		t.Fatal("expected error for null tree")
+	} else if _, err := format.DecodeCommit(strings.NewReader(`{"tree":"xyz","time":""}`)); err == nil {
+		t.Fatal("expected error for bad tree id")
+	}
+}
+
+func TestJSONFormat_Repo(t *testing.T) {
+	rp := tmpDirRepo()
+	rp.Format = NewJSONFormat()
+	testCommitSet(t, rp, []string{"foo", "bar"}, "a")
+	if data, err := NewSugar(rp).Get([]string{"foo", "bar"}); err != nil {
+		t.Fatal(err)
+	} else if got, err := ioutil.ReadAll(data); err != nil {
+		t.Fatal(err)
+	} else if string(got) != "a" {
+		t.Fatalf("got=%q want=%q", got, "a")
+	}
+}
@@ -0,0 +1,164 @@
+package can
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// NewMemRepo returns an empty MemRepo.
+func NewMemRepo() *MemRepo {
+	return &MemRepo{format: NewDefaultFormat(), objects: map[string][]byte{}, refs: map[string]ID{}}
+}
+
+// Check Repo interface compliance
+var _ = Repo(&MemRepo{})
+
+// MemRepo is a Repo that keeps all objects in memory. Objects are encoded
+// using the default format and sha1, so they have the same ids as in a DirRepo
+// using the default Format and Hash. It is safe for concurrent use.
+type MemRepo struct {
+	mu      sync.RWMutex
+	format  Format
+	head    ID
+	objects map[string][]byte
+	refs    map[string]ID
+}
+
+func (m *MemRepo) Head() (ID, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.head == nil {
+		return nil, notFoundError("head not found")
+	}
+	return m.head, nil
+}
+
+func (m *MemRepo) WriteHead(id ID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.head = append(ID(nil), id...)
+	return nil
+}
+
+func (m *MemRepo) Ref(name string) (ID, error) {
+	if err := checkRefName(name); err != nil {
+		return nil, err
+	}
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	id, ok := m.refs[name]
+	if !ok {
+		return nil, notFoundError(fmt.Sprintf("ref not found: %s", name))
+	}
+	return id, nil
+}
+
+func (m *MemRepo) WriteRef(name string, id ID) error {
+	if err := checkRefName(name); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.refs[name] = append(ID(nil), id...)
+	return nil
+}
+
+func (m *MemRepo) Refs() (map[string]ID, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	refs := make(map[string]ID, len(m.refs))
+	for name, id := range m.refs {
+		refs[name] = id
+	}
+	return refs, nil
+}
+
+func (m *MemRepo) Blob(id ID) (io.ReadCloser, error) {
+	data, err := m.read(id)
+	if err != nil {
+		return nil, err
+	}
+	r, err := m.format.DecodeBlob(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(r), nil
+}
+
+func (m *MemRepo) WriteBlob(r io.Reader) (ID, error) {
+	return m.write(r)
+}
+
+func (m *MemRepo) Tree(id ID) (Tree, error) {
+	data, err := m.read(id)
+	if err != nil {
+		return nil, err
+	}
+	return m.format.DecodeTree(bytes.NewReader(data))
+}
+
+func (m *MemRepo) WriteTree(t Tree) (ID, error) {
+	if err := t.Validate(); err != nil {
+		return nil, err
+	}
+	return m.write(t)
+}
+
+func (m *MemRepo) Commit(id ID) (Commit, error) {
+	data, err := m.read(id)
+	if err != nil {
+		return Commit{}, err
+	}
+	return m.format.DecodeCommit(bytes.NewReader(data))
+}
+
+func (m *MemRepo) WriteCommit(c Commit) (ID, error) {
+	return m.write(c)
+}
+
+func (m *MemRepo) Exists(id ID) (bool, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	_, ok := m.objects[id.String()]
+	return ok, nil
+}
+
+// read returns a copy of the encoded object with the given id.
+func (m *MemRepo) read(id ID) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	data, ok := m.objects[id.String()]
+	if !ok {
+		return nil, notFoundError(fmt.Sprintf("object not found: %s", id))
+	}
+	return append([]byte(nil), data...), nil
+}
+
+func (m *MemRepo) write(o interface{}) (ID, error) {
+	buf := &bytes.Buffer{}
+	iw := NewIDWriter(buf)
+	switch t := o.(type) {
+	case Tree:
+		if err := m.format.EncodeTree(iw, t); err != nil {
+			return nil, err
+		}
+	case Commit:
+		if err := m.format.EncodeCommit(iw, t); err != nil {
+			return nil, err
+		}
+	case io.Reader:
+		if err := m.format.EncodeBlob(iw, t); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("bad type: %#v", t)
+	}
+	id := iw.ID()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[id.String()] = buf.Bytes()
+	return id, nil
+}
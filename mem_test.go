@@ -0,0 +1,58 @@
+package can
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestMemRepo(t *testing.T) {
+	rp := NewMemRepo()
+	if _, err := rp.Head(); !IsNotFound(err) {
+		t.Fatalf("expected not found error, got: %v", err)
+	}
+	testBlob(t, rp, []byte("Hello"), MustID("0cd5a7d8dc5a48bb59c0205146e4aac675dfe74a"))
+	testTree(t, rp, Tree{
+		{Kind: KindBlob, ID: MustID("0cd5a7d8dc5a48bb59c0205146e4aac675dfe74a"), Name: "blob 1"},
+		{Kind: KindBlob, ID: MustID("054f22c17948d775ac4b327c7987c7acff4b8d64"), Name: "blob 2"},
+	}, MustID("29ee187f331966f235b3f67404b71e812f893825"))
+	testCommit(t, rp, Commit{
+		Tree:    MustID("0123456789"),
+		Parents: []ID{MustID("0123"), MustID("45"), MustID("6789")},
+		Time:    time.Date(2015, 2, 20, 13, 14, 33, 0, time.FixedZone("", 3600)),
+		Message: []byte("hi,\n\nhow are you?"),
+	}, MustID("04f81807bae3f1091ef8c7feb475430432cfd7e3"))
+	missing := MustID("0123")
+	if _, err := rp.Blob(missing); !IsNotFound(err) {
+		t.Fatalf("expected not found error, got: %v", err)
+	} else if _, err := rp.Tree(missing); !IsNotFound(err) {
+		t.Fatalf("expected not found error, got: %v", err)
+	} else if _, err := rp.Commit(missing); !IsNotFound(err) {
+		t.Fatalf("expected not found error, got: %v", err)
+	}
+	head := testCommitSet(t, rp, []string{"foo"}, "a")
+	if got, err := rp.Head(); err != nil {
+		t.Fatal(err)
+	} else if !got.Equal(head) {
+		t.Fatalf("bad head: got=%s want=%s", got, head)
+	}
+}
+
+func TestMemRepo_BlobCopy(t *testing.T) {
+	rp := NewMemRepo()
+	id, err := rp.WriteBlob(bytes.NewReader([]byte("Hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := rp.Blob(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[0] = 'J'
+	testBlob(t, rp, []byte("Hello"), id)
+}
@@ -0,0 +1,195 @@
+package can
+
+import "sort"
+
+// Conflict describes a path that was changed differently by both sides of a
+// merge. The ids are nil for sides on which the path does not exist or is a
+// tree. Conflicts involving trees are reported for the keys below them.
+type Conflict struct {
+	Path   []string
+	Base   ID
+	Ours   ID
+	Theirs ID
+}
+
+// Merge performs a three-way merge of the trees ours and theirs, using the
+// tree base as their common ancestor, and returns the id of the merged tree.
+// A nil id is treated as an empty tree. Paths changed by only one side take
+// that side's entry, while paths changed differently by both sides are
+// returned as conflicts and keep our entry in the merged tree. A tree changed
+// by one side and removed or replaced by the other side is merged key by key,
+// with a missing or non-tree side treated as an empty tree. Trees left empty
+// by the merge are removed, except for the root tree. Creating a commit
+// for the merged tree is left to the caller.
+func (s *sugar) Merge(base, ours, theirs ID) (ID, []Conflict, error) {
+	root := func(id ID) *Entry {
+		if id == nil {
+			return nil
+		}
+		return &Entry{Kind: KindTree, ID: id}
+	}
+	m := &merger{rp: s.Repo}
+	entry, err := m.merge(nil, root(base), root(ours), root(theirs))
+	if err != nil {
+		return nil, nil, err
+	} else if entry != nil && entry.Kind == KindTree {
+		return entry.ID, m.conflicts, nil
+	}
+	id, err := s.WriteTree(nil)
+	return id, m.conflicts, err
+}
+
+// MergeCommits merges the commit theirs into the commit ours, which must be
+// the head of rp, and advances the head. The trees are merged using Merge with
+// the tree of the MergeBase of both commits as the base, or an empty tree if
+// their histories are disjoint. If there are no conflicts, a commit with the
+// merged tree and the parents ours and theirs is created from the given
+// details, and becomes the head. A nil c is treated like a zero Commit. If
+// theirs is a descendant of ours, the head is fast-forwarded to theirs
+// without creating a commit, and if it is an ancestor of ours nothing is
+// done. The id of the resulting head is returned.
+//
+// Conflicts are returned without creating a commit or changing the head, so
+// the caller can resolve them. ErrHeadMoved is returned if the head is not
+// ours when it is advanced.
+func MergeCommits(rp Repo, ours, theirs ID, c *Commit) (ID, []Conflict, error) {
+	base, err := MergeBase(rp, ours, theirs)
+	if err != nil {
+		return nil, nil, err
+	} else if base.Equal(theirs) {
+		return ours, nil, nil
+	} else if base.Equal(ours) {
+		if err := swapHead(rp, ours, theirs); err != nil {
+			return nil, nil, err
+		}
+		return theirs, nil, nil
+	}
+	var trees [3]ID
+	for i, id := range []ID{base, ours, theirs} {
+		if id == nil {
+			continue
+		}
+		commit, err := rp.Commit(id)
+		if err != nil {
+			return nil, nil, err
+		}
+		trees[i] = commit.Tree
+	}
+	treeID, conflicts, err := (&sugar{Repo: rp}).Merge(trees[0], trees[1], trees[2])
+	if err != nil || len(conflicts) > 0 {
+		return nil, conflicts, err
+	}
+	var commit Commit
+	if c != nil {
+		commit = *c
+	}
+	commit.Tree = treeID
+	commit.Parents = []ID{ours, theirs}
+	id, err := rp.WriteCommit(commit)
+	if err != nil {
+		return nil, nil, err
+	} else if err := swapHead(rp, ours, id); err != nil {
+		return nil, nil, err
+	}
+	return id, nil, nil
+}
+
+// merger implements the three-way merge of Merge.
+type merger struct {
+	rp        Repo
+	conflicts []Conflict
+}
+
+// merge returns the merged entry for the given path, or nil if it does not
+// exist after the merge.
+func (m *merger) merge(path []string, base, ours, theirs *Entry) (*Entry, error) {
+	switch {
+	case sameEntry(ours, theirs):
+		return ours, nil
+	case sameEntry(base, ours):
+		return theirs, nil
+	case sameEntry(base, theirs):
+		return ours, nil
+	case isTree(ours) || isTree(theirs):
+		return m.mergeTrees(path, base, ours, theirs)
+	}
+	m.conflict(path, base, ours, theirs)
+	return ours, nil
+}
+
+// conflict records a conflict for the given path, omitting the ids of trees.
+func (m *merger) conflict(path []string, base, ours, theirs *Entry) {
+	conflict := Conflict{Path: path}
+	if base != nil && !isTree(base) {
+		conflict.Base = base.ID
+	}
+	if ours != nil && !isTree(ours) {
+		conflict.Ours = ours.ID
+	}
+	if theirs != nil && !isTree(theirs) {
+		conflict.Theirs = theirs.ID
+	}
+	m.conflicts = append(m.conflicts, conflict)
+}
+
+// mergeTrees merges the entries of ours and theirs, at least one of which is
+// a tree. Sides that are not trees are treated as empty trees, and a blob
+// replacing a tree on one side is reported as a conflict for path. The result
+// is our entry then if it is not a tree.
+func (m *merger) mergeTrees(path []string, base, ours, theirs *Entry) (*Entry, error) {
+	var trees [3]Tree
+	names := map[string]bool{}
+	for i, entry := range []*Entry{base, ours, theirs} {
+		if !isTree(entry) {
+			continue
+		}
+		tree, err := m.rp.Tree(entry.ID)
+		if err != nil {
+			return nil, err
+		}
+		trees[i] = tree
+		for _, e := range tree {
+			names[e.Name] = true
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	var merged Tree
+	for _, name := range sorted {
+		entryPath := make([]string, len(path)+1)
+		copy(entryPath, path)
+		entryPath[len(path)] = name
+		entry, err := m.merge(entryPath, trees[0].Get(name), trees[1].Get(name), trees[2].Get(name))
+		if err != nil {
+			return nil, err
+		} else if entry != nil {
+			merged = merged.Add(entry)
+		}
+	}
+	if (ours != nil && !isTree(ours)) || (theirs != nil && !isTree(theirs)) {
+		m.conflict(path, base, ours, theirs)
+		if !isTree(ours) {
+			return ours, nil
+		}
+	}
+	if len(merged) == 0 {
+		return nil, nil
+	}
+	id, err := m.rp.WriteTree(merged)
+	if err != nil {
+		return nil, err
+	}
+	var name string
+	if len(path) > 0 {
+		name = path[len(path)-1]
+	}
+	return &Entry{Kind: KindTree, Name: name, ID: id}, nil
+}
+
+// isTree returns true if entry is a non-nil tree entry.
+func isTree(entry *Entry) bool {
+	return entry != nil && entry.Kind == KindTree
+}
@@ -0,0 +1,203 @@
+package can
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestSugar_Merge(t *testing.T) {
+	rp := tmpRepo()
+	s := NewSugar(rp)
+	blobs := map[string]ID{}
+	set := func(treeID ID, key, val string) ID {
+		id, err := s.Set(treeID, strings.Split(key, "/"), strings.NewReader(val))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if blobs[val], err = rp.WriteBlob(strings.NewReader(val)); err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	del := func(treeID ID, key string) ID {
+		id, err := s.Delete(treeID, strings.Split(key, "/"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	base := set(nil, "a/x", "base x")
+	base = set(base, "a/y", "base y")
+	base = set(base, "b", "base b")
+	base = set(base, "c", "base c")
+	base = set(base, "d/z", "base z")
+
+	ours := set(base, "a/x", "our x")
+	ours = set(ours, "b", "same b")
+	ours = set(ours, "c", "our c")
+	ours = set(ours, "e", "our e")
+
+	theirs := set(base, "a/y", "their y")
+	theirs = set(theirs, "b", "same b")
+	theirs = del(theirs, "c")
+	theirs = del(theirs, "d/z")
+
+	treeID, conflicts, err := s.Merge(base, ours, theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Conflict{{Path: []string{"c"}, Base: blobs["base c"], Ours: blobs["our c"]}}
+	if diff := pretty.Compare(conflicts, want); diff != "" {
+		t.Fatal(diff)
+	}
+	wantTree := set(nil, "a/x", "our x")
+	wantTree = set(wantTree, "a/y", "their y")
+	wantTree = set(wantTree, "b", "same b")
+	wantTree = set(wantTree, "c", "our c")
+	wantTree = set(wantTree, "e", "our e")
+	if !treeID.Equal(wantTree) {
+		changes, _ := Diff(rp, wantTree, treeID)
+		t.Fatalf("bad merged tree: %s", pretty.Sprint(changes))
+	}
+
+	// Merging in the other direction records the deletion as our side.
+	if _, conflicts, err := s.Merge(base, theirs, ours); err != nil {
+		t.Fatal(err)
+	} else if len(conflicts) != 1 || conflicts[0].Ours != nil || !conflicts[0].Theirs.Equal(blobs["our c"]) {
+		t.Fatalf("bad conflicts: %s", pretty.Sprint(conflicts))
+	}
+
+	// Trees replaced by a blob are merged key by key, and conflicts are
+	// reported for the full keys below them.
+	ours = set(base, "d/z", "our z")
+	theirs = set(del(base, "d/z"), "d", "their d")
+	for _, test := range []struct {
+		Ours, Theirs ID
+		Want         []Conflict
+	}{
+		{
+			Ours:   ours,
+			Theirs: theirs,
+			Want: []Conflict{
+				{Path: []string{"d", "z"}, Base: blobs["base z"], Ours: blobs["our z"]},
+				{Path: []string{"d"}, Theirs: blobs["their d"]},
+			},
+		},
+		{
+			Ours:   theirs,
+			Theirs: ours,
+			Want: []Conflict{
+				{Path: []string{"d", "z"}, Base: blobs["base z"], Theirs: blobs["our z"]},
+				{Path: []string{"d"}, Ours: blobs["their d"]},
+			},
+		},
+	} {
+		if treeID, conflicts, err := s.Merge(base, test.Ours, test.Theirs); err != nil {
+			t.Fatal(err)
+		} else if diff := pretty.Compare(conflicts, test.Want); diff != "" {
+			t.Fatal(diff)
+		} else if !treeID.Equal(test.Ours) {
+			changes, _ := Diff(rp, test.Ours, treeID)
+			t.Fatalf("bad merged tree: %s", pretty.Sprint(changes))
+		}
+	}
+}
+
+func TestMergeCommits(t *testing.T) {
+	rp := tmpDirRepo()
+	s := NewSugar(rp)
+	commit := func(parent ID, key, val string) ID {
+		var (
+			treeID  ID
+			parents []ID
+		)
+		if parent != nil {
+			c, err := rp.Commit(parent)
+			if err != nil {
+				t.Fatal(err)
+			}
+			treeID, parents = c.Tree, []ID{parent}
+		}
+		treeID, err := s.Set(treeID, []string{key}, strings.NewReader(val))
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, err := rp.WriteCommit(Commit{Tree: treeID, Parents: parents})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	checkHead := func(want ID) {
+		if head, err := rp.Head(); err != nil {
+			t.Fatal(err)
+		} else if !head.Equal(want) {
+			t.Fatalf("bad head: got=%s want=%s", head, want)
+		}
+	}
+	base := commit(nil, "a", "1")
+	if err := rp.WriteHead(base); err != nil {
+		t.Fatal(err)
+	}
+
+	// Fast-forward.
+	theirs := commit(base, "b", "2")
+	if id, conflicts, err := MergeCommits(rp, base, theirs, nil); err != nil {
+		t.Fatal(err)
+	} else if len(conflicts) != 0 || !id.Equal(theirs) {
+		t.Fatalf("bad fast-forward: id=%s conflicts=%v", id, conflicts)
+	}
+	checkHead(theirs)
+	if id, _, err := MergeCommits(rp, theirs, base, nil); err != nil {
+		t.Fatal(err)
+	} else if !id.Equal(theirs) {
+		t.Fatalf("bad merge of ancestor: got=%s want=%s", id, theirs)
+	}
+	checkHead(theirs)
+
+	// Clean merge.
+	ours := commit(theirs, "c", "3")
+	other := commit(theirs, "d", "4")
+	if err := rp.WriteHead(ours); err != nil {
+		t.Fatal(err)
+	}
+	merged, conflicts, err := MergeCommits(rp, ours, other, &Commit{Message: []byte("merge")})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(conflicts) != 0 {
+		t.Fatalf("unexpected conflicts: %v", conflicts)
+	}
+	checkHead(merged)
+	if c, err := rp.Commit(merged); err != nil {
+		t.Fatal(err)
+	} else if diff := pretty.Compare(c.Parents, []ID{ours, other}); diff != "" {
+		t.Fatal(diff)
+	} else if string(c.Message) != "merge" {
+		t.Fatalf("bad message: %q", c.Message)
+	} else if keys, err := s.ListKeys(c.Tree, nil); err != nil {
+		t.Fatal(err)
+	} else if diff := pretty.Compare(keys, [][]string{{"a"}, {"b"}, {"c"}, {"d"}}); diff != "" {
+		t.Fatal(diff)
+	}
+
+	// Conflicting merge.
+	x := commit(merged, "a", "x")
+	y := commit(merged, "a", "y")
+	if err := rp.WriteHead(x); err != nil {
+		t.Fatal(err)
+	}
+	if id, conflicts, err := MergeCommits(rp, x, y, nil); err != nil {
+		t.Fatal(err)
+	} else if id != nil || len(conflicts) != 1 || strings.Join(conflicts[0].Path, "/") != "a" {
+		t.Fatalf("bad conflicting merge: id=%s conflicts=%v", id, conflicts)
+	}
+	checkHead(x)
+
+	// The head must not have moved since ours was read.
+	if _, _, err := MergeCommits(rp, merged, commit(merged, "e", "5"), nil); err != ErrHeadMoved {
+		t.Fatalf("expected ErrHeadMoved, got: %v", err)
+	}
+	checkHead(x)
+}
@@ -0,0 +1,76 @@
+package can
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+// mmapMaxSize is the size above which object files are read through a file
+// handle instead of being mapped into memory.
+const mmapMaxSize = 256 << 20
+
+// errMmapUnsupported is returned by mmapFile if a file can not be mapped, and
+// should be read through a file handle instead.
+var errMmapUnsupported = errors.New("mmap not supported")
+
+// openMmap is like open, but maps the object file into memory. It returns
+// errMmapUnsupported if the object can not be mapped.
+func (d *DirRepo) openMmap(id ID, verify bool) (io.ReadCloser, Format, error) {
+	data, unmap, err := mmapFile(d.path(id))
+	if err != nil {
+		return nil, nil, err
+	}
+	r := &mmapReader{data: data, unmap: unmap}
+	format := d.Format
+	if s, ok := format.(Sealer); ok {
+		ur, err := s.Unseal(r)
+		if err != nil {
+			r.Close()
+			return nil, nil, err
+		}
+		if verify {
+			ur = newIDVerifier(ur, id, d.newHash())
+		}
+		return NewReadCloser(ur, r), s.Unsealed(), nil
+	}
+	if !verify {
+		return r, format, nil
+	} else if _, ok := d.verified.Load(string(id)); !ok {
+		h := d.newHash()
+		h.Write(data)
+		if got := ID(h.Sum(nil)); !got.Equal(id) {
+			r.Close()
+			return nil, nil, &CorruptError{ID: id, Reason: fmt.Sprintf("bad id: got=%s", got)}
+		}
+		d.verified.Store(string(id), true)
+	}
+	return r, format, nil
+}
+
+// mmapReader reads from a memory mapped file, which is unmapped on Close.
+type mmapReader struct {
+	data   []byte
+	off    int
+	unmap  func() error
+	closed bool
+}
+
+func (m *mmapReader) Read(p []byte) (int, error) {
+	if m.closed {
+		return 0, errors.New("read from closed object")
+	} else if m.off >= len(m.data) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.data[m.off:])
+	m.off += n
+	return n, nil
+}
+
+func (m *mmapReader) Close() error {
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	return m.unmap()
+}
@@ -0,0 +1,9 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package can
+
+// mmapFile always returns errMmapUnsupported on this platform.
+func mmapFile(path string) ([]byte, func() error, error) {
+	return nil, nil, errMmapUnsupported
+}
@@ -0,0 +1,78 @@
+package can
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestDirRepo_Mmap(t *testing.T) {
+	rp := tmpDirRepo()
+	rp.Mmap = true
+	testBlob(t, rp, []byte("Hello"), MustID("0cd5a7d8dc5a48bb59c0205146e4aac675dfe74a"))
+	testBlob(t, rp, []byte(""), MustID("4b1568079f8fc1adcdbff5bf24b9be9fc9e4576d"))
+	var (
+		head = testCommitSet(t, rp, []string{"foo", "bar"}, "a")
+		s    = NewSugar(rp)
+		wg   sync.WaitGroup
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := rp.Commit(head); err != nil {
+				t.Error(err)
+			} else if rc, err := s.Get([]string{"foo", "bar"}); err != nil {
+				t.Error(err)
+			} else if data, err := ioutil.ReadAll(rc); err != nil {
+				t.Error(err)
+			} else if string(data) != "a" {
+				t.Errorf("bad data: %q", data)
+			} else if err := rc.Close(); err != nil {
+				t.Error(err)
+			} else if _, err := rc.Read(make([]byte, 1)); err == nil {
+				t.Error("expected error when reading closed blob")
+			}
+		}()
+	}
+	wg.Wait()
+	id, err := rp.WriteBlob(strings.NewReader("corrupt"))
+	if err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(rp.path(id), []byte("blob\ncorrupted"), 0600); err != nil {
+		t.Fatal(err)
+	} else if _, err := rp.Blob(id); err == nil {
+		t.Fatal("expected error for corrupt object")
+	}
+}
+
+func BenchmarkDirRepo_Blob(b *testing.B) {
+	for _, mmap := range []bool{false, true} {
+		for _, verify := range []bool{true, false} {
+			b.Run(fmt.Sprintf("mmap=%t/verify=%t", mmap, verify), func(b *testing.B) {
+				rp := tmpDirRepo()
+				rp.Mmap = mmap
+				rp.Verify = verify
+				data := bytes.Repeat([]byte("0123456789abcdef"), 1024)
+				id, err := rp.WriteBlob(bytes.NewReader(data))
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.SetBytes(int64(len(data)))
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					rc, err := rp.Blob(id)
+					if err != nil {
+						b.Fatal(err)
+					} else if _, err := ioutil.ReadAll(rc); err != nil {
+						b.Fatal(err)
+					}
+					rc.Close()
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package can
+
+import (
+	"fmt"
+	"io"
+	"sync"
+)
+
+// References returns the ids of the objects directly referenced by the object
+// with the given id, i.e. the tree and parents of a commit, or the entries of
+// a tree. Blobs do not reference any objects.
+func References(rp Repo, id ID) ([]ID, error) {
+	obj, err := readObject(rp, id)
+	if err != nil {
+		return nil, err
+	}
+	var refs []ID
+	switch o := obj.(type) {
+	case Commit:
+		refs = append(refs, o.Tree)
+		refs = append(refs, o.Parents...)
+	case Tree:
+		for _, entry := range o {
+			refs = append(refs, entry.ID)
+		}
+	case io.ReadCloser:
+		o.Close()
+	}
+	return refs, nil
+}
+
+// objectKind returns the Kind of the object with the given id.
+func objectKind(rp Repo, id ID) (Kind, error) {
+	obj, err := readObject(rp, id)
+	if err != nil {
+		return "", err
+	}
+	switch o := obj.(type) {
+	case Commit:
+		return KindCommit, nil
+	case Tree:
+		return KindTree, nil
+	default:
+		o.(io.ReadCloser).Close()
+		return KindBlob, nil
+	}
+}
+
+// readObject returns the object with the given id as a Commit, a Tree or an
+// io.ReadCloser for blobs. As the Repo interface does not expose the kind of
+// an object, each kind is tried in turn.
+func readObject(rp Repo, id ID) (interface{}, error) {
+	commit, err := rp.Commit(id)
+	if err == nil {
+		return commit, nil
+	} else if IsNotFound(err) {
+		return nil, err
+	}
+	if tree, err := rp.Tree(id); err == nil {
+		return tree, nil
+	}
+	if blob, err := rp.Blob(id); err == nil {
+		return blob, nil
+	}
+	return nil, fmt.Errorf("unknown object kind: %s: %s", id, err)
+}
+
+// Copy copies the object with the given id from src to dst, together with
+// all objects it references, recursively. Objects that dst already has are
+// skipped, including the objects they reference, which are assumed to exist
+// as well. Referenced objects are written before the objects referring to
+// them. Both repos must compute the same ids for the same objects.
+func Copy(dst, src Repo, id ID) error {
+	return copyWalk(dst, src, id, func(id ID, obj interface{}) error {
+		if obj == nil {
+			return copyBlob(dst, src, id)
+		}
+		return copyWrite(dst, id, obj)
+	})
+}
+
+// copyWalk calls fn for the object with the given id and all objects it
+// references that dst does not have, references before the objects referring
+// to them. fn is called with the Commit or Tree read from src, or with nil for
+// blobs, which are not read.
+func copyWalk(dst, src Repo, id ID, fn func(id ID, obj interface{}) error) error {
+	type item struct {
+		id      ID
+		kind    Kind
+		obj     interface{}
+		visited bool
+	}
+	var (
+		stack = []item{{id: id}}
+		done  = map[string]bool{}
+	)
+	for len(stack) > 0 {
+		it := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if done[string(it.id)] {
+			continue
+		}
+		if !it.visited {
+			if ok, err := dst.Exists(it.id); err != nil {
+				return err
+			} else if ok {
+				done[string(it.id)] = true
+				continue
+			}
+			if it.kind == "" {
+				var err error
+				if it.kind, err = objectKind(src, it.id); err != nil {
+					if err := missingObject(src, it.id, err); err != nil {
+						return err
+					}
+					done[string(it.id)] = true
+					continue
+				}
+			}
+			var refs []item
+			switch it.kind {
+			case KindCommit:
+				commit, err := src.Commit(it.id)
+				if err != nil {
+					if err := missingObject(src, it.id, err); err != nil {
+						return err
+					}
+					done[string(it.id)] = true
+					continue
+				}
+				it.obj = commit
+				refs = append(refs, item{id: commit.Tree, kind: KindTree})
+				for _, parent := range commit.Parents {
+					refs = append(refs, item{id: parent, kind: KindCommit})
+				}
+			case KindTree:
+				tree, err := src.Tree(it.id)
+				if err != nil {
+					if err := missingObject(src, it.id, err); err != nil {
+						return err
+					}
+					done[string(it.id)] = true
+					continue
+				}
+				it.obj = tree
+				for _, entry := range tree {
+					refs = append(refs, item{id: entry.ID, kind: entry.objectKind()})
+				}
+			case KindBlob:
+			default:
+				return fmt.Errorf("unknown kind %q for object %s", it.kind, it.id)
+			}
+			if len(refs) > 0 {
+				// Revisit the object once its references have been visited.
+				it.visited = true
+				stack = append(stack, it)
+				stack = append(stack, refs...)
+				continue
+			}
+		}
+		if err := fn(it.id, it.obj); err != nil {
+			return err
+		}
+		done[string(it.id)] = true
+	}
+	return nil
+}
+
+// copyWrite writes the Commit or Tree obj to dst, and checks that dst stores
+// it under the given id.
+func copyWrite(dst Repo, id ID, obj interface{}) error {
+	var (
+		got ID
+		err error
+	)
+	switch o := obj.(type) {
+	case Commit:
+		got, err = dst.WriteCommit(o)
+	case Tree:
+		got, err = dst.WriteTree(o)
+	default:
+		return fmt.Errorf("bad type: %#v", o)
+	}
+	if err != nil {
+		return err
+	} else if !got.Equal(id) {
+		return fmt.Errorf("copy: id mismatch: got=%s want=%s", got, id)
+	}
+	return nil
+}
+
+// CopyAll is like Copy, but copies blobs concurrently using the given number
+// of workers, which speeds up copying from slow repos. The commits and trees
+// reachable from root are read first, and are written once all blobs have
+// been copied, references before the objects referring to them. The first
+// error stops the remaining work and is returned.
+func CopyAll(dst, src Repo, root ID, parallelism int) error {
+	if parallelism < 1 {
+		return fmt.Errorf("bad parallelism: %d", parallelism)
+	}
+	blobs, objects, err := copyPlan(dst, src, root)
+	if err != nil {
+		return err
+	}
+	var (
+		ids      = make(chan ID)
+		stop     = make(chan struct{})
+		errOnce  sync.Once
+		firstErr error
+		wg       sync.WaitGroup
+	)
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			close(stop)
+		})
+	}
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for id := range ids {
+				if err := copyBlob(dst, src, id); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+feed:
+	for _, id := range blobs {
+		select {
+		case ids <- id:
+		case <-stop:
+			break feed
+		}
+	}
+	close(ids)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	for _, obj := range objects {
+		if err := copyWrite(dst, obj.id, obj.obj); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copyObject is a commit or tree to be written by CopyAll.
+type copyObject struct {
+	id  ID
+	obj interface{}
+}
+
+// copyPlan returns the ids of the blobs reachable from root, and the commits
+// and trees reachable from root in the order they need to be written, leaving
+// out those that dst already has.
+func copyPlan(dst, src Repo, root ID) ([]ID, []copyObject, error) {
+	var (
+		blobs   []ID
+		objects []copyObject
+	)
+	err := copyWalk(dst, src, root, func(id ID, obj interface{}) error {
+		if obj == nil {
+			blobs = append(blobs, id)
+		} else {
+			objects = append(objects, copyObject{id: id, obj: obj})
+		}
+		return nil
+	})
+	return blobs, objects, err
+}
+
+// copyBlob copies the blob with the given id from src to dst, unless dst has
+// it already.
+func copyBlob(dst, src Repo, id ID) error {
+	if ok, err := dst.Exists(id); err != nil || ok {
+		return err
+	}
+	rc, err := src.Blob(id)
+	if err != nil {
+		return missingObject(src, id, err)
+	}
+	defer rc.Close()
+	got, err := dst.WriteBlob(rc)
+	if err != nil {
+		return err
+	} else if !got.Equal(id) {
+		return fmt.Errorf("copy: id mismatch: got=%s want=%s", got, id)
+	}
+	return nil
+}
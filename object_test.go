@@ -0,0 +1,170 @@
+package can
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestReferences(t *testing.T) {
+	rp := tmpRepo()
+	first := testCommitSet(t, rp, []string{"foo"}, "a")
+	second := testCommitSet(t, rp, []string{"bar"}, "b")
+	commit, err := rp.Commit(second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := rp.Tree(commit.Tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobID, err := rp.WriteBlob(strings.NewReader("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ID   ID
+		Kind Kind
+		Want []ID
+	}{
+		{ID: second, Kind: KindCommit, Want: []ID{commit.Tree, first}},
+		{ID: commit.Tree, Kind: KindTree, Want: []ID{tree.Get("bar").ID, tree.Get("foo").ID}},
+		{ID: blobID, Kind: KindBlob, Want: nil},
+	}
+	for _, test := range tests {
+		if refs, err := References(rp, test.ID); err != nil {
+			t.Fatal(err)
+		} else if diff := pretty.Compare(refs, test.Want); diff != "" {
+			t.Errorf("%s: %s", test.Kind, diff)
+		} else if kind, err := objectKind(rp, test.ID); err != nil {
+			t.Fatal(err)
+		} else if kind != test.Kind {
+			t.Errorf("bad kind: got=%s want=%s", kind, test.Kind)
+		}
+	}
+	if _, err := References(rp, MustID("0123")); !IsNotFound(err) {
+		t.Fatalf("expected not found error, got: %v", err)
+	}
+}
+
+func TestCopy(t *testing.T) {
+	src := NewMemRepo()
+	testCommitSet(t, src, []string{"foo", "bar"}, "a")
+	testCommitSet(t, src, []string{"foo", "baz"}, "b")
+	head := testCommitSet(t, src, []string{"qux"}, "a")
+	if _, err := src.WriteBlob(strings.NewReader("unreachable")); err != nil {
+		t.Fatal(err)
+	}
+	dst := NewMemRepo()
+	if err := Copy(dst, src, head); err != nil {
+		t.Fatal(err)
+	} else if err := dst.WriteHead(head); err != nil {
+		t.Fatal(err)
+	}
+	if want, err := Fingerprint(src); err != nil {
+		t.Fatal(err)
+	} else if got, err := Fingerprint(dst); err != nil {
+		t.Fatal(err)
+	} else if !got.Equal(want) {
+		t.Fatal("destination is incomplete")
+	} else if len(dst.objects) >= len(src.objects) {
+		t.Fatalf("unreachable object was copied: src=%d dst=%d", len(src.objects), len(dst.objects))
+	}
+	// Copying into a DirRepo with CheckCommits requires referenced objects to
+	// be written first.
+	dir := tmpDirRepo()
+	dir.CheckCommits = true
+	if err := Copy(dir, src, head); err != nil {
+		t.Fatal(err)
+	}
+	if err := Copy(dst, src, MustID("0123")); !IsNotFound(err) {
+		t.Fatalf("expected not found error, got: %v", err)
+	}
+}
+
+// concurrentRepo is a Repo that records the peak number of concurrent Blob
+// calls.
+type concurrentRepo struct {
+	Repo
+	mu     sync.Mutex
+	active int
+	peak   int
+}
+
+func (c *concurrentRepo) Blob(id ID) (io.ReadCloser, error) {
+	c.mu.Lock()
+	if c.active++; c.active > c.peak {
+		c.peak = c.active
+	}
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.active--
+		c.mu.Unlock()
+	}()
+	// Give other calls a chance to overlap with this one, like the latency of
+	// a network backend.
+	time.Sleep(time.Millisecond)
+	return c.Repo.Blob(id)
+}
+
+func TestCopyAll(t *testing.T) {
+	src := NewMemRepo()
+	for i := 0; i < 20; i++ {
+		testCommitSet(t, src, []string{"dir", strconv.Itoa(i)}, strconv.Itoa(i))
+	}
+	head, err := src.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	copied := func(fn func(dst, src Repo) error) int {
+		dst := tmpDirRepo()
+		dst.CheckCommits = true
+		counter := &concurrentRepo{Repo: src}
+		if err := fn(dst, counter); err != nil {
+			t.Fatal(err)
+		} else if err := dst.WriteHead(head); err != nil {
+			t.Fatal(err)
+		} else if want, err := Fingerprint(src); err != nil {
+			t.Fatal(err)
+		} else if got, err := Fingerprint(dst); err != nil {
+			t.Fatal(err)
+		} else if !got.Equal(want) {
+			t.Fatal("destination is incomplete")
+		}
+		return counter.peak
+	}
+	if peak := copied(func(dst, src Repo) error { return Copy(dst, src, head) }); peak != 1 {
+		t.Fatalf("expected sequential copy, got peak=%d", peak)
+	} else if peak := copied(func(dst, src Repo) error { return CopyAll(dst, src, head, 10) }); peak <= 1 {
+		t.Fatalf("expected concurrent copy, got peak=%d", peak)
+	}
+
+	// Copying a second time only writes what's missing.
+	dst := NewMemRepo()
+	if err := CopyAll(dst, src, head, 4); err != nil {
+		t.Fatal(err)
+	} else if err := CopyAll(dst, NewMemRepo(), head, 4); err != nil {
+		t.Fatalf("expected no reads from src, got: %v", err)
+	}
+
+	broken := NewMemRepo()
+	for id, data := range src.objects {
+		broken.objects[id] = data
+	}
+	blob, err := src.WriteBlob(strings.NewReader("0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(broken.objects, blob.String())
+	if err := CopyAll(NewMemRepo(), broken, head, 4); !IsNotFound(err) {
+		t.Fatalf("expected not found error, got: %v", err)
+	} else if err := CopyAll(NewMemRepo(), src, head, 0); err == nil {
+		t.Fatal("expected error for bad parallelism")
+	}
+}
@@ -0,0 +1,139 @@
+package can
+
+import (
+	"io"
+	"sync"
+)
+
+// NewObservedRepo returns a Repo that passes all calls through to inner and
+// records them in the returned RepoMetrics, e.g. to assert on the IO behavior
+// of code using the repo in tests.
+func NewObservedRepo(inner Repo) (Repo, *RepoMetrics) {
+	m := &RepoMetrics{calls: map[string]int64{}}
+	return &observedRepo{inner: inner, metrics: m}, m
+}
+
+// RepoMetrics holds the calls made to a Repo returned by NewObservedRepo. It
+// is safe for concurrent use.
+type RepoMetrics struct {
+	mu           sync.Mutex
+	calls        map[string]int64
+	bytesRead    int64
+	bytesWritten int64
+}
+
+// Calls returns the number of calls of the Repo method with the given name,
+// e.g. "WriteTree", including calls that returned an error.
+func (m *RepoMetrics) Calls(method string) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.calls[method]
+}
+
+// BytesRead returns the number of blob bytes read from the blobs returned by
+// Blob. Trees and commits are not included.
+func (m *RepoMetrics) BytesRead() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.bytesRead
+}
+
+// BytesWritten returns the number of blob bytes passed to WriteBlob. Trees and
+// commits are not included.
+func (m *RepoMetrics) BytesWritten() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.bytesWritten
+}
+
+func (m *RepoMetrics) call(method string) {
+	m.mu.Lock()
+	m.calls[method]++
+	m.mu.Unlock()
+}
+
+// observedRepo implements NewObservedRepo.
+type observedRepo struct {
+	inner   Repo
+	metrics *RepoMetrics
+}
+
+func (o *observedRepo) Head() (ID, error) {
+	o.metrics.call("Head")
+	return o.inner.Head()
+}
+
+func (o *observedRepo) WriteHead(id ID) error {
+	o.metrics.call("WriteHead")
+	return o.inner.WriteHead(id)
+}
+
+func (o *observedRepo) Ref(name string) (ID, error) {
+	o.metrics.call("Ref")
+	return o.inner.Ref(name)
+}
+
+func (o *observedRepo) WriteRef(name string, id ID) error {
+	o.metrics.call("WriteRef")
+	return o.inner.WriteRef(name, id)
+}
+
+func (o *observedRepo) Refs() (map[string]ID, error) {
+	o.metrics.call("Refs")
+	return o.inner.Refs()
+}
+
+func (o *observedRepo) Blob(id ID) (io.ReadCloser, error) {
+	o.metrics.call("Blob")
+	rc, err := o.inner.Blob(id)
+	if err != nil {
+		return nil, err
+	}
+	return NewReadCloser(&meteredReader{r: rc, m: o.metrics, n: &o.metrics.bytesRead}, rc), nil
+}
+
+func (o *observedRepo) WriteBlob(r io.Reader) (ID, error) {
+	o.metrics.call("WriteBlob")
+	return o.inner.WriteBlob(&meteredReader{r: r, m: o.metrics, n: &o.metrics.bytesWritten})
+}
+
+func (o *observedRepo) Tree(id ID) (Tree, error) {
+	o.metrics.call("Tree")
+	return o.inner.Tree(id)
+}
+
+func (o *observedRepo) WriteTree(t Tree) (ID, error) {
+	o.metrics.call("WriteTree")
+	return o.inner.WriteTree(t)
+}
+
+func (o *observedRepo) Commit(id ID) (Commit, error) {
+	o.metrics.call("Commit")
+	return o.inner.Commit(id)
+}
+
+func (o *observedRepo) WriteCommit(c Commit) (ID, error) {
+	o.metrics.call("WriteCommit")
+	return o.inner.WriteCommit(c)
+}
+
+func (o *observedRepo) Exists(id ID) (bool, error) {
+	o.metrics.call("Exists")
+	return o.inner.Exists(id)
+}
+
+// meteredReader adds the number of bytes read from r to the counter n, which
+// is guarded by the mutex of m.
+type meteredReader struct {
+	r io.Reader
+	m *RepoMetrics
+	n *int64
+}
+
+func (r *meteredReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.m.mu.Lock()
+	*r.n += int64(n)
+	r.m.mu.Unlock()
+	return n, err
+}
@@ -0,0 +1,86 @@
+package can
+
+import (
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestNewObservedRepo(t *testing.T) {
+	rp, m := NewObservedRepo(tmpRepo())
+	blob, err := rp.WriteBlob(strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rc, err := rp.Blob(blob)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer rc.Close()
+			if _, err := ioutil.ReadAll(rc); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	tree, err := rp.WriteTree(Tree{{Kind: KindBlob, Name: "a", ID: blob}})
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := rp.Tree(tree); err != nil {
+		t.Fatal(err)
+	}
+	commit, err := rp.WriteCommit(Commit{Tree: tree})
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := rp.Commit(commit); err != nil {
+		t.Fatal(err)
+	} else if err := rp.WriteHead(commit); err != nil {
+		t.Fatal(err)
+	} else if _, err := rp.Head(); err != nil {
+		t.Fatal(err)
+	} else if err := rp.WriteRef("main", commit); err != nil {
+		t.Fatal(err)
+	} else if _, err := rp.Ref("main"); err != nil {
+		t.Fatal(err)
+	} else if _, err := rp.Refs(); err != nil {
+		t.Fatal(err)
+	} else if _, err := rp.Exists(commit); err != nil {
+		t.Fatal(err)
+	} else if _, err := rp.Tree(MustID("0123")); err == nil {
+		t.Fatal("expected error for missing tree")
+	}
+	got := map[string]int64{}
+	for _, method := range []string{"Head", "WriteHead", "Ref", "WriteRef", "Refs", "Blob", "WriteBlob", "Tree", "WriteTree", "Commit", "WriteCommit", "Exists"} {
+		got[method] = m.Calls(method)
+	}
+	want := map[string]int64{
+		"Head":        1,
+		"WriteHead":   1,
+		"Ref":         1,
+		"WriteRef":    1,
+		"Refs":        1,
+		"Blob":        4,
+		"WriteBlob":   1,
+		"Tree":        2,
+		"WriteTree":   1,
+		"Commit":      1,
+		"WriteCommit": 1,
+		"Exists":      1,
+	}
+	if diff := pretty.Compare(got, want); diff != "" {
+		t.Fatal(diff)
+	} else if got := m.BytesWritten(); got != 5 {
+		t.Fatalf("bad bytes written: got=%d want=%d", got, 5)
+	} else if got := m.BytesRead(); got != 20 {
+		t.Fatalf("bad bytes read: got=%d want=%d", got, 20)
+	}
+}
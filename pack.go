@@ -0,0 +1,132 @@
+package can
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// packHeader is the first line of a pack stream.
+const packHeader = "can-pack 1\n"
+
+// Pack writes all objects kept by GC, i.e. those reachable from the head, a
+// ref that is not weak or the reflog, to w as a single stream that can be read
+// by Unpack. Each object is written as a "<kind> <id> <size>\n" line followed
+// by its unsealed encoding, and the stream ends with an "end <count>\n" line,
+// which allows Unpack to detect truncated streams. Objects are buffered in
+// memory while they are written.
+func (d *DirRepo) Pack(w io.Writer) error {
+	roots, err := d.roots()
+	if err != nil {
+		return err
+	}
+	b := bufio.NewWriter(w)
+	if _, err := io.WriteString(b, packHeader); err != nil {
+		return err
+	}
+	count := 0
+	if err := walkReachable(d, roots, func(id ID, kind Kind) error {
+		rc, _, err := d.open(id)
+		if err != nil {
+			return missingObject(d, id, err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		} else if _, err := fmt.Fprintf(b, "%s %s %d\n", kind, id, len(data)); err != nil {
+			return err
+		} else if _, err := b.Write(data); err != nil {
+			return err
+		}
+		count++
+		return nil
+	}); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(b, "end %d\n", count); err != nil {
+		return err
+	}
+	return b.Flush()
+}
+
+// Unpack stores the objects of a stream written by Pack and returns their
+// number. Objects are decoded and written like any other object, so their ids
+// are verified. The repo must use the same unsealed Format as the packed repo.
+func (d *DirRepo) Unpack(r io.Reader) (n int, err error) {
+	b := bufio.NewReader(r)
+	if header, err := b.ReadString('\n'); err != nil {
+		return 0, packErr(err)
+	} else if header != packHeader {
+		return 0, fmt.Errorf("bad pack header: %q", header)
+	}
+	format := d.Format
+	if s, ok := format.(Sealer); ok {
+		format = s.Unsealed()
+	}
+	for {
+		line, err := b.ReadString('\n')
+		if err != nil {
+			return n, packErr(err)
+		}
+		if strings.HasPrefix(line, "end ") {
+			var count int
+			if _, err := fmt.Sscanf(line, "end %d\n", &count); err != nil {
+				return n, fmt.Errorf("bad pack trailer: %q", line)
+			} else if count != n {
+				return n, fmt.Errorf("bad pack object count: got=%d want=%d", n, count)
+			}
+			return n, nil
+		}
+		var (
+			kind Kind
+			hex  string
+			size int64
+		)
+		if _, err := fmt.Sscanf(line, "%s %s %d\n", &kind, &hex, &size); err != nil {
+			return n, fmt.Errorf("bad pack object header: %q", line)
+		}
+		want, err := ParseID(hex)
+		if err != nil {
+			return n, err
+		}
+		data, err := ioutil.ReadAll(io.LimitReader(b, size))
+		if err != nil {
+			return n, err
+		} else if int64(len(data)) != size {
+			return n, packErr(io.EOF)
+		}
+		var o interface{}
+		switch kind {
+		case KindBlob:
+			o, err = format.DecodeBlob(bytes.NewReader(data))
+		case KindTree:
+			o, err = format.DecodeTree(bytes.NewReader(data))
+		case KindCommit:
+			o, err = format.DecodeCommit(bytes.NewReader(data))
+		default:
+			err = fmt.Errorf("unknown kind %q for object %s", kind, want)
+		}
+		if err != nil {
+			return n, err
+		}
+		if got, err := d.write(o); err != nil {
+			return n, err
+		} else if !got.Equal(want) {
+			return n, fmt.Errorf("bad id: got=%s want=%s", got, want)
+		}
+		n++
+	}
+}
+
+// packErr turns an io.EOF encountered while reading a pack into
+// io.ErrUnexpectedEOF, as a complete pack ends with a trailer.
+func packErr(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,70 @@
+package can
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestDirRepo_Pack(t *testing.T) {
+	src := tmpDirRepo()
+	testCommitSet(t, src, []string{"foo", "bar"}, "a")
+	testCommitSet(t, src, []string{"foo", "baz"}, "b")
+	testCommitSet(t, src, []string{"qux"}, "c")
+	if _, err := src.WriteBlob(strings.NewReader("unreachable")); err != nil {
+		t.Fatal(err)
+	}
+	want := 0
+	head, err := src.Head()
+	if err != nil {
+		t.Fatal(err)
+	} else if err := walkReachable(src, []ID{head}, func(ID, Kind) error {
+		want++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if err := src.Pack(buf); err != nil {
+		t.Fatal(err)
+	}
+	dst := tmpDirRepo()
+	if n, err := dst.Unpack(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	} else if n != want {
+		t.Fatalf("bad count: got=%d want=%d", n, want)
+	} else if ids, err := dst.Objects(); err != nil {
+		t.Fatal(err)
+	} else if len(ids) != want {
+		t.Fatalf("bad object count: got=%d want=%d", len(ids), want)
+	} else if err := dst.WriteHead(head); err != nil {
+		t.Fatal(err)
+	}
+	srcPrint, err := Fingerprint(src)
+	if err != nil {
+		t.Fatal(err)
+	} else if dstPrint, err := Fingerprint(dst); err != nil {
+		t.Fatal(err)
+	} else if !dstPrint.Equal(srcPrint) {
+		t.Fatal("unpacked repo differs from packed repo")
+	}
+	// Objects only reachable from a ref are packed as well.
+	branch := testRefCommit(t, src, "branches/dev", "dev")
+	buf.Reset()
+	if err := src.Pack(buf); err != nil {
+		t.Fatal(err)
+	} else if n, err := dst.Unpack(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatal(err)
+	} else if n != want+3 {
+		t.Fatalf("bad count with ref: got=%d want=%d", n, want+3)
+	} else if _, err := dst.Commit(branch); err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{0, 5, buf.Len() / 2, buf.Len() - 1} {
+		truncated := bytes.NewReader(buf.Bytes()[:size])
+		if _, err := tmpDirRepo().Unpack(truncated); err != io.ErrUnexpectedEOF {
+			t.Fatalf("expected io.ErrUnexpectedEOF for %d bytes, got: %v", size, err)
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package can
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+)
+
+// walkReachable calls fn once for every object reachable from the commits
+// with the given ids, including the commits themselves. Commits and trees are
+// read before fn is called for them, while blobs are not read. Walking stops
+// at the first error.
+func walkReachable(rp Repo, commits []ID, fn func(id ID, kind Kind) error) error {
+	type item struct {
+		id   ID
+		kind Kind
+	}
+	var (
+		seen  = map[string]bool{}
+		stack []item
+	)
+	for _, id := range commits {
+		stack = append(stack, item{id: id, kind: KindCommit})
+	}
+	for len(stack) > 0 {
+		it := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seen[string(it.id)] {
+			continue
+		}
+		seen[string(it.id)] = true
+		var refs []item
+		switch it.kind {
+		case KindCommit:
+			commit, err := rp.Commit(it.id)
+			if err != nil {
+				if err := missingObject(rp, it.id, err); err != nil {
+					return err
+				}
+				continue
+			}
+			refs = append(refs, item{id: commit.Tree, kind: KindTree})
+			for _, parent := range commit.Parents {
+				refs = append(refs, item{id: parent, kind: KindCommit})
+			}
+		case KindTree:
+			tree, err := rp.Tree(it.id)
+			if err != nil {
+				if err := missingObject(rp, it.id, err); err != nil {
+					return err
+				}
+				continue
+			}
+			for _, entry := range tree {
+				refs = append(refs, item{id: entry.ID, kind: entry.objectKind()})
+			}
+		case KindBlob:
+		default:
+			return fmt.Errorf("unknown kind %q for object %s", it.kind, it.id)
+		}
+		if err := fn(it.id, it.kind); err != nil {
+			return err
+		}
+		stack = append(stack, refs...)
+	}
+	return nil
+}
+
+// Fingerprint returns an id that summarizes the head of rp and all objects
+// reachable from it. Repos with the same head and reachable objects have the
+// same fingerprint, regardless of how they store their objects. A repo
+// without a head has the fingerprint of an empty object set.
+func Fingerprint(rp Repo) (ID, error) {
+	var roots []ID
+	head, err := rp.Head()
+	if err == nil {
+		roots = append(roots, head)
+	} else if !IsNotFound(err) {
+		return nil, err
+	}
+	var ids IDs
+	if err := walkReachable(rp, roots, func(id ID, kind Kind) error {
+		ids = append(ids, id)
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.Sort(ids)
+	iw := NewIDWriter(ioutil.Discard)
+	if _, err := fmt.Fprintf(iw, "head %s\n", head); err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if _, err := io.WriteString(iw, id.String()+"\n"); err != nil {
+			return nil, err
+		}
+	}
+	return iw.ID(), nil
+}
+
+// GC removes all objects that are not reachable from the head, a ref that is
+// not weak or a commit recorded in the reflog, and returns the number of
+// removed objects. All objects are removed if the repo has none of them. Weak
+// refs whose targets are not reachable are removed as well. GC must not run
+// concurrently with writes to the repo, or to other repos sharing its objects,
+// as objects that are not referenced by the head yet would be removed.
+func (d *DirRepo) GC() (removed int, err error) {
+	refs, err := d.Refs()
+	if err != nil {
+		return 0, err
+	}
+	reachable, err := d.reachable()
+	if err != nil {
+		return 0, err
+	}
+	err = d.WalkObjects(func(id ID) error {
+		if reachable[string(id)] {
+			return nil
+		} else if err := os.Remove(d.path(id)); err != nil {
+			return err
+		}
+		d.verified.Delete(string(id))
+		removed++
+		return nil
+	})
+	if err != nil {
+		return removed, err
+	}
+	for name, id := range refs {
+		if IsWeakRef(name) && !reachable[string(id)] {
+			if err := d.removeRef(name); err != nil {
+				return removed, err
+			}
+		}
+	}
+	return removed, nil
+}
+
+// GCDryRun returns the ids of the objects GC would remove, and their total
+// size on disk, without removing anything.
+func (d *DirRepo) GCDryRun() (ids []ID, size int64, err error) {
+	reachable, err := d.reachable()
+	if err != nil {
+		return nil, 0, err
+	}
+	err = d.WalkObjects(func(id ID) error {
+		if reachable[string(id)] {
+			return nil
+		}
+		info, err := os.Stat(d.path(id))
+		if err != nil {
+			return err
+		}
+		ids = append(ids, id)
+		size += info.Size()
+		return nil
+	})
+	return ids, size, err
+}
+
+// reachable returns the set of ids of the objects reachable from roots.
+func (d *DirRepo) reachable() (map[string]bool, error) {
+	roots, err := d.roots()
+	if err != nil {
+		return nil, err
+	}
+	reachable := map[string]bool{}
+	if err := walkReachable(d, roots, func(id ID, kind Kind) error {
+		reachable[string(id)] = true
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return reachable, nil
+}
+
+// roots returns the ids of the commits whose objects GC and Pack keep, i.e.
+// the head, the targets of all refs that are not weak, which must be commits,
+// and the commits the reflog moved the head to that still exist.
+func (d *DirRepo) roots() ([]ID, error) {
+	var roots []ID
+	if head, err := d.Head(); err == nil {
+		roots = append(roots, head)
+	} else if !IsNotFound(err) {
+		return nil, err
+	}
+	refs, err := d.Refs()
+	if err != nil {
+		return nil, err
+	}
+	for name, id := range refs {
+		if !IsWeakRef(name) {
+			roots = append(roots, id)
+		}
+	}
+	reflog, err := d.Reflog()
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range reflog {
+		// The head an entry moved away from is recorded as New by the entry
+		// before it, unless that entry has been expired. Commits moved away
+		// from may have been removed by an earlier GC.
+		if ok, err := d.Exists(entry.New); err != nil {
+			return nil, err
+		} else if ok {
+			roots = append(roots, entry.New)
+		}
+	}
+	return roots, nil
+}
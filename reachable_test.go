@@ -0,0 +1,200 @@
+package can
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestFingerprint(t *testing.T) {
+	var (
+		a = tmpRepo()
+		b = tmpEncryptedRepo(t)
+	)
+	fingerprint := func(rp Repo) ID {
+		id, err := Fingerprint(rp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	if !fingerprint(a).Equal(fingerprint(b)) {
+		t.Fatal("empty repos should have the same fingerprint")
+	}
+	for _, rp := range []Repo{a, b} {
+		testCommitSet(t, rp, []string{"foo", "bar"}, "a")
+		testCommitSet(t, rp, []string{"foo", "baz"}, "b")
+	}
+	before := fingerprint(a)
+	if !before.Equal(fingerprint(b)) {
+		t.Fatal("repos with the same content should have the same fingerprint")
+	}
+	if _, err := a.WriteBlob(strings.NewReader("unreachable")); err != nil {
+		t.Fatal(err)
+	} else if !before.Equal(fingerprint(a)) {
+		t.Fatal("unreachable objects should not change the fingerprint")
+	}
+	testCommitSet(t, a, []string{"foo", "bar"}, "c")
+	if before.Equal(fingerprint(a)) {
+		t.Fatal("a new commit should change the fingerprint")
+	}
+}
+
+func TestDirRepo_GC(t *testing.T) {
+	rp := tmpDirRepo()
+	if _, err := rp.WriteBlob(strings.NewReader("unreachable")); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := rp.GC(); err != nil {
+		t.Fatal(err)
+	} else if removed != 1 {
+		t.Fatalf("bad removed count without head: %d", removed)
+	}
+	testCommitSet(t, rp, []string{"foo", "bar"}, "a")
+	testCommitSet(t, rp, []string{"foo", "bar"}, "b")
+	before, err := Fingerprint(rp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The new root tree is unreachable, while its blob is shared with the head.
+	if _, err := NewSugar(rp).Set(nil, []string{"baz"}, strings.NewReader("b")); err != nil {
+		t.Fatal(err)
+	} else if _, err := rp.WriteBlob(strings.NewReader("unreachable")); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := rp.GC(); err != nil {
+		t.Fatal(err)
+	} else if removed != 2 {
+		t.Fatalf("bad removed count: %d", removed)
+	} else if after, err := Fingerprint(rp); err != nil {
+		t.Fatal(err)
+	} else if !after.Equal(before) {
+		t.Fatal("GC changed the reachable objects")
+	}
+}
+
+func TestDirRepo_GCDryRun(t *testing.T) {
+	rp := tmpDirRepo()
+	testCommitSet(t, rp, []string{"foo"}, "head")
+	var want []ID
+	var wantSize int64
+	for _, data := range []string{"a", "b"} {
+		id, err := rp.WriteBlob(strings.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(rp.path(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, id)
+		wantSize += info.Size()
+	}
+	sort.Sort(IDs(want))
+	objects := func() map[string]bool {
+		ids := map[string]bool{}
+		if err := rp.WalkObjects(func(id ID) error {
+			ids[id.String()] = true
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return ids
+	}
+	before := objects()
+	ids, size, err := rp.GCDryRun()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Sort(IDs(ids))
+	if diff := pretty.Compare(ids, want); diff != "" {
+		t.Fatal(diff)
+	} else if size != wantSize {
+		t.Fatalf("bad size: got=%d want=%d", size, wantSize)
+	} else if diff := pretty.Compare(objects(), before); diff != "" {
+		t.Fatalf("dry run removed objects: %s", diff)
+	}
+	if removed, err := rp.GC(); err != nil {
+		t.Fatal(err)
+	} else if removed != len(want) {
+		t.Fatalf("bad removed count: %d", removed)
+	}
+	for _, id := range want {
+		delete(before, id.String())
+	}
+	if diff := pretty.Compare(objects(), before); diff != "" {
+		t.Fatalf("GC did not remove exactly the dry run ids: %s", diff)
+	}
+}
+
+func TestDirRepo_GC_Refs(t *testing.T) {
+	rp := tmpDirRepo()
+	testCommitSet(t, rp, []string{"foo"}, "head")
+	branch := testRefCommit(t, rp, "branches/dev", "dev")
+	if removed, err := rp.GC(); err != nil {
+		t.Fatal(err)
+	} else if removed != 0 {
+		t.Fatalf("GC removed %d objects reachable from a ref", removed)
+	} else if rc, err := NewSugar(rp).GetAt(branch, []string{"foo"}); err != nil {
+		t.Fatal(err)
+	} else {
+		rc.Close()
+	}
+}
+
+func TestDirRepo_GC_WeakRefs(t *testing.T) {
+	rp := tmpDirRepo()
+	testCommitSet(t, rp, []string{"foo"}, "head")
+	strong := testRefCommit(t, rp, "branches/dev", "dev")
+	weak := testRefCommit(t, rp, WeakRefPrefix+"recent", "recent")
+	// A weak ref to a commit that is reachable otherwise is kept.
+	if err := rp.WriteRef(WeakRefPrefix+"dev", strong); err != nil {
+		t.Fatal(err)
+	}
+	if refs, err := rp.Refs(); err != nil {
+		t.Fatal(err)
+	} else if !refs[WeakRefPrefix+"recent"].Equal(weak) {
+		t.Fatalf("weak ref not listed: %v", refs)
+	}
+	// The commit, its tree and its blob.
+	if removed, err := rp.GC(); err != nil {
+		t.Fatal(err)
+	} else if removed != 3 {
+		t.Fatalf("bad removed count: %d", removed)
+	}
+	if ok, err := rp.Exists(weak); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("weak ref target was not removed")
+	} else if _, err := rp.Ref(WeakRefPrefix + "recent"); !IsNotFound(err) {
+		t.Fatalf("expected weak ref to be removed, got: %v", err)
+	}
+	if id, err := rp.Ref(WeakRefPrefix + "dev"); err != nil {
+		t.Fatal(err)
+	} else if !id.Equal(strong) {
+		t.Fatalf("bad weak ref: %s", id)
+	} else if rc, err := NewSugar(rp).GetAt(strong, []string{"foo"}); err != nil {
+		t.Fatal(err)
+	} else {
+		rc.Close()
+	}
+}
+
+// testRefCommit writes a commit that sets the key "foo" to val and points the
+// ref with the given name at it, without changing the head.
+func testRefCommit(t *testing.T, rp Repo, ref, val string) ID {
+	treeID, err := NewSugar(rp).Set(nil, []string{"foo"}, strings.NewReader(val))
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := rp.WriteCommit(Commit{Tree: treeID, Message: []byte(ref)})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := rp.WriteRef(ref, id); err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
@@ -0,0 +1,153 @@
+package can
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ReflogEntry records a single movement of the head from Old to New. Old is
+// nil if there was no head before.
+type ReflogEntry struct {
+	Old  ID
+	New  ID
+	Time time.Time
+}
+
+// Reflog returns the head movements recorded by WriteHead, newest first. A
+// truncated last line, e.g. caused by a crash, is ignored. The reflog grows
+// with every head update and keeps the commits it records from being removed
+// by GC until they are expired with ExpireReflog. The reflog is
+// stored next to HeadFile, with a ".log" suffix, so repos sharing a directory
+// with different head files have separate reflogs. Head updates are only
+// serialized within a DirRepo, so entries written by several DirRepos using
+// the same HeadFile may record an outdated previous head.
+func (d *DirRepo) Reflog() ([]ReflogEntry, error) {
+	file, err := os.Open(d.reflogPath())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var (
+		entries []ReflogEntry
+		b       = bufio.NewReader(file)
+	)
+	for {
+		line, err := b.ReadString('\n')
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		entry, err := parseReflogEntry(line[:len(line)-1])
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+// writeHead sets the head to the given id using write and appends the
+// movement to the reflog. Head updates are serialized so every entry records
+// the head it replaced.
+func (d *DirRepo) writeHead(id ID, write func() error) error {
+	d.headMu.Lock()
+	defer d.headMu.Unlock()
+	old, err := d.Head()
+	if IsNotFound(err) {
+		old = nil
+	} else if err != nil {
+		return err
+	}
+	if err := write(); err != nil {
+		return err
+	}
+	line := formatReflogEntry(ReflogEntry{Old: old, New: id, Time: time.Now()})
+	file, err := os.OpenFile(d.reflogPath(), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(file, line); err != nil {
+		file.Close()
+		return err
+	} else if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// ExpireReflog removes reflog entries, so GC no longer keeps the commits they
+// moved the head to. Only the newest maxEntries entries that are at most
+// maxAge old are kept, and a zero maxEntries or maxAge disables the respective
+// limit. The number of removed entries is returned.
+func (d *DirRepo) ExpireReflog(maxEntries int, maxAge time.Duration) (removed int, err error) {
+	d.headMu.Lock()
+	defer d.headMu.Unlock()
+	entries, err := d.Reflog()
+	if err != nil {
+		return 0, err
+	}
+	var (
+		keep   []string
+		cutoff = time.Now().Add(-maxAge)
+	)
+	for i, entry := range entries {
+		if (maxEntries > 0 && i >= maxEntries) || (maxAge > 0 && entry.Time.Before(cutoff)) {
+			removed++
+			continue
+		}
+		// The reflog file holds the oldest entry first.
+		keep = append([]string{formatReflogEntry(entry)}, keep...)
+	}
+	if removed == 0 {
+		return 0, nil
+	}
+	return removed, d.writeFile(d.reflogPath(), strings.NewReader(strings.Join(keep, "")))
+}
+
+// formatReflogEntry returns the line recording e in the reflog.
+func formatReflogEntry(e ReflogEntry) string {
+	return fmt.Sprintf("%s %s %d\n", e.Old, e.New, e.Time.Unix())
+}
+
+// reflogPath returns the path of the reflog of the head.
+func (d *DirRepo) reflogPath() string {
+	return d.HeadFile + ".log"
+}
+
+func parseReflogEntry(line string) (ReflogEntry, error) {
+	var e ReflogEntry
+	fields := strings.Split(line, " ")
+	if len(fields) != 3 {
+		return e, fmt.Errorf("bad reflog entry: %q", line)
+	}
+	if fields[0] != "" {
+		old, err := ParseID(fields[0])
+		if err != nil {
+			return e, err
+		}
+		e.Old = old
+	}
+	id, err := ParseID(fields[1])
+	if err != nil {
+		return e, err
+	}
+	e.New = id
+	unix, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return e, fmt.Errorf("bad reflog time: %s", err)
+	}
+	e.Time = time.Unix(unix, 0)
+	return e, nil
+}
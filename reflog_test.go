@@ -0,0 +1,132 @@
+package can
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDirRepo_Reflog(t *testing.T) {
+	rp := tmpDirRepo()
+	if entries, err := rp.Reflog(); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 0 {
+		t.Fatalf("unexpected entries: %#v", entries)
+	}
+	start := time.Now().Add(-time.Second)
+	a := testCommitSet(t, rp, []string{"foo"}, "a")
+	b := testCommitSet(t, rp, []string{"foo"}, "b")
+	if err := rp.WriteHead(a); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := rp.Reflog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ReflogEntry{{Old: b, New: a}, {Old: a, New: b}, {Old: nil, New: a}}
+	if len(entries) != len(want) {
+		t.Fatalf("bad reflog length: got=%d want=%d", len(entries), len(want))
+	}
+	for i, entry := range entries {
+		if !entry.Old.Equal(want[i].Old) || !entry.New.Equal(want[i].New) {
+			t.Errorf("entry %d: got=%s %s want=%s %s", i, entry.Old, entry.New, want[i].Old, want[i].New)
+		} else if entry.Time.Before(start) || entry.Time.After(time.Now()) {
+			t.Errorf("entry %d: bad time: %s", i, entry.Time)
+		}
+	}
+}
+
+func TestDirRepo_Reflog_HeadFile(t *testing.T) {
+	a := tmpDirRepo()
+	b := NewDirRepo(filepath.Dir(a.obj))
+	b.HeadFile = filepath.Join(filepath.Dir(a.obj), "other-head")
+	if err := b.Init(); err != nil {
+		t.Fatal(err)
+	}
+	aHead := testCommitSet(t, a, []string{"foo"}, "a")
+	bHead := testCommitSet(t, b, []string{"foo"}, "b")
+	for _, test := range []struct {
+		Repo *DirRepo
+		Head ID
+	}{{a, aHead}, {b, bHead}} {
+		entries, err := test.Repo.Reflog()
+		if err != nil {
+			t.Fatal(err)
+		} else if len(entries) != 1 || !entries[0].New.Equal(test.Head) {
+			t.Fatalf("%s: bad reflog: %#v", test.Repo.HeadFile, entries)
+		}
+	}
+}
+
+func TestDirRepo_GC_Reflog(t *testing.T) {
+	rp := tmpDirRepo()
+	old := testCommitSet(t, rp, []string{"foo"}, "a")
+	// Resetting the head to an unrelated commit leaves old only in the reflog.
+	treeID, err := NewSugar(rp).Set(nil, []string{"bar"}, strings.NewReader("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := rp.WriteCommit(Commit{Tree: treeID})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := rp.WriteHead(head); err != nil {
+		t.Fatal(err)
+	} else if removed, err := rp.GC(); err != nil {
+		t.Fatal(err)
+	} else if removed != 0 {
+		t.Fatalf("GC removed %d objects reachable from the reflog", removed)
+	} else if rc, err := NewSugar(rp).GetAt(old, []string{"foo"}); err != nil {
+		t.Fatal(err)
+	} else {
+		rc.Close()
+	}
+}
+
+func TestDirRepo_ExpireReflog(t *testing.T) {
+	rp := tmpDirRepo()
+	testCommitSet(t, rp, []string{"foo"}, "a")
+	oldBlob, err := rp.WriteBlob(strings.NewReader("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Replace the head with a commit without parents, like a squash does.
+	treeID, err := NewSugar(rp).Set(nil, []string{"foo"}, strings.NewReader("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, err := rp.WriteCommit(Commit{Tree: treeID})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := rp.WriteHead(head); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := rp.ExpireReflog(0, time.Hour); err != nil {
+		t.Fatal(err)
+	} else if removed != 0 {
+		t.Fatalf("expired %d recent entries", removed)
+	} else if removed, err := rp.GC(); err != nil {
+		t.Fatal(err)
+	} else if removed != 0 {
+		t.Fatalf("GC removed %d objects before the reflog expired", removed)
+	}
+	if removed, err := rp.ExpireReflog(1, 0); err != nil {
+		t.Fatal(err)
+	} else if removed != 1 {
+		t.Fatalf("expected 1 expired entry, got: %d", removed)
+	} else if entries, err := rp.Reflog(); err != nil {
+		t.Fatal(err)
+	} else if len(entries) != 1 || !entries[0].New.Equal(head) {
+		t.Fatalf("bad reflog: %#v", entries)
+	}
+	// The old commit, its tree and blob are freed.
+	if removed, err := rp.GC(); err != nil {
+		t.Fatal(err)
+	} else if removed != 3 {
+		t.Fatalf("expected 3 removed objects, got: %d", removed)
+	} else if ok, err := rp.Exists(oldBlob); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("superseded blob was not removed")
+	}
+}
@@ -0,0 +1,108 @@
+package can
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WeakRefPrefix is the prefix of the names of weak refs, which are stored in
+// refs/weak/. Weak refs are listed by Refs like any other ref, but are not GC
+// roots, so GC may remove their targets, and then removes the refs as well.
+const WeakRefPrefix = "weak/"
+
+// IsWeakRef returns true if the ref with the given name is a weak ref.
+func IsWeakRef(name string) bool {
+	return strings.HasPrefix(name, WeakRefPrefix)
+}
+
+// checkRefName returns an error if name is not a valid ref name. Ref names
+// consist of one or more "/" separated components, none of which may be
+// empty, "." or "..", so they can be safely used as relative file paths.
+// Components may not start with the prefix of the temporary files written
+// next to refs either.
+func checkRefName(name string) error {
+	if name == "" {
+		return fmt.Errorf("empty ref name")
+	} else if strings.ContainsAny(name, "\\\x00") {
+		return fmt.Errorf("bad ref name: %q", name)
+	}
+	for _, component := range strings.Split(name, "/") {
+		if component == "" || component == "." || component == ".." || strings.HasPrefix(component, tmpFilePrefix) {
+			return fmt.Errorf("bad ref name: %q", name)
+		}
+	}
+	return nil
+}
+
+// Ref is part of the Repo interface. Refs are stored as files below the refs
+// directory of the repo, and are independent of the head.
+func (d *DirRepo) Ref(name string) (ID, error) {
+	if err := checkRefName(name); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(d.refPath(name))
+	if os.IsNotExist(err) {
+		return nil, notFoundError(fmt.Sprintf("ref not found: %s", name))
+	} else if err != nil {
+		return nil, err
+	}
+	return ParseID(string(data))
+}
+
+// WriteRef is part of the Repo interface. Refs are replaced atomically, see
+// WriteHead.
+func (d *DirRepo) WriteRef(name string, id ID) error {
+	if err := checkRefName(name); err != nil {
+		return err
+	}
+	path := d.refPath(name)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return d.writeFile(path, strings.NewReader(id.String()))
+}
+
+// Refs is part of the Repo interface.
+func (d *DirRepo) Refs() (map[string]ID, error) {
+	refs := map[string]ID{}
+	err := filepath.Walk(d.refs, func(path string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && path == d.refs {
+			return filepath.SkipDir
+		} else if err != nil || info.IsDir() {
+			return err
+		} else if strings.HasPrefix(info.Name(), tmpFilePrefix) {
+			// A ref being written, or left behind by a crash.
+			return nil
+		}
+		rel, err := filepath.Rel(d.refs, path)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(rel)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		} else if refs[name], err = ParseID(string(data)); err != nil {
+			return err
+		}
+		return nil
+	})
+	return refs, err
+}
+
+// removeRef removes the ref with the given name. Removing a missing ref is not
+// an error.
+func (d *DirRepo) removeRef(name string) error {
+	if err := os.Remove(d.refPath(name)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// refPath returns the path of the file holding the ref with the given name.
+func (d *DirRepo) refPath(name string) string {
+	return filepath.Join(d.refs, filepath.FromSlash(name))
+}
@@ -0,0 +1,49 @@
+package can
+
+import (
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestRefs(t *testing.T) {
+	for name, rp := range map[string]Repo{"dir": tmpRepo(), "mem": NewMemRepo()} {
+		if _, err := rp.Ref("main"); !IsNotFound(err) {
+			t.Fatalf("%s: expected not found error, got: %v", name, err)
+		} else if refs, err := rp.Refs(); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		} else if len(refs) != 0 {
+			t.Fatalf("%s: expected no refs, got: %v", name, refs)
+		}
+		want := map[string]ID{
+			"main":         MustID("0123"),
+			"branches/dev": MustID("4567"),
+		}
+		for ref, id := range want {
+			if err := rp.WriteRef(ref, MustID("89ab")); err != nil {
+				t.Fatalf("%s: %s", name, err)
+			} else if err := rp.WriteRef(ref, id); err != nil {
+				t.Fatalf("%s: %s", name, err)
+			} else if got, err := rp.Ref(ref); err != nil {
+				t.Fatalf("%s: %s", name, err)
+			} else if !got.Equal(id) {
+				t.Fatalf("%s: bad ref %q: got=%s want=%s", name, ref, got, id)
+			}
+		}
+		if got, err := rp.Refs(); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		} else if diff := pretty.Compare(got, want); diff != "" {
+			t.Fatalf("%s: %s", name, diff)
+		}
+		for _, ref := range []string{"", "../head", "a//b", "/abs", "a/./b", "a\\b", "a/.tmp-1"} {
+			if err := rp.WriteRef(ref, MustID("0123")); err == nil {
+				t.Fatalf("%s: expected error for ref name %q", name, ref)
+			} else if _, err := rp.Ref(ref); err == nil {
+				t.Fatalf("%s: expected error for ref name %q", name, ref)
+			}
+		}
+		if _, err := rp.Head(); !IsNotFound(err) {
+			t.Fatalf("%s: refs should not affect the head: %v", name, err)
+		}
+	}
+}
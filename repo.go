@@ -2,15 +2,22 @@ package can
 
 import (
 	"bytes"
+	"crypto"
 	"crypto/sha1"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"hash"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -20,6 +27,13 @@ type Repo interface {
 	Head() (ID, error)
 	// WriteHead sets the ID of the head commit.
 	WriteHead(ID) error
+	// Ref returns the ID the ref with the given name points to. Ref names are
+	// "/" separated paths, e.g. "branches/main".
+	Ref(name string) (ID, error)
+	// WriteRef points the ref with the given name at the given ID.
+	WriteRef(name string, id ID) error
+	// Refs returns all refs by name.
+	Refs() (map[string]ID, error)
 	// Blob returns the Blob for the given id.
 	Blob(id ID) (io.ReadCloser, error)
 	// WriteBlob store the given Blob and returns its id.
@@ -32,6 +46,9 @@ type Repo interface {
 	Commit(id ID) (Commit, error)
 	// WriteCommit store the given Commit and returns its id.
 	WriteCommit(Commit) (ID, error)
+	// Exists returns true if an object with the given id is stored. A non-nil
+	// error is only returned if the check itself failed.
+	Exists(id ID) (bool, error)
 }
 
 // ParseID parses the given hex id string into an ID, or returns an error.
@@ -63,11 +80,57 @@ func (id ID) String() string {
 	return fmt.Sprintf("%x", []byte(id))
 }
 
+// Short returns the first 7 hex characters of the id, which are usually
+// enough to identify an object, e.g. for DirRepo.Resolve.
+func (id ID) Short() string {
+	return id.ShortN(7)
+}
+
+// ShortN returns the first n hex characters of the id, or all of them if the
+// id is shorter.
+func (id ID) ShortN(n int) string {
+	s := id.String()
+	if n < 0 {
+		n = 0
+	}
+	if n < len(s) {
+		return s[:n]
+	}
+	return s
+}
+
 // Equal returns true if the id is equal to other.
 func (id ID) Equal(other ID) bool {
 	return bytes.Compare(id, other) == 0
 }
 
+// Compare returns an integer comparing the bytes of the id to those of other.
+// The result is 0 if id == other, -1 if id < other, and +1 if id > other.
+func (id ID) Compare(other ID) int {
+	return bytes.Compare(id, other)
+}
+
+// IDs is a list of ids that sorts in ascending order.
+type IDs []ID
+
+func (ids IDs) Len() int           { return len(ids) }
+func (ids IDs) Less(i, j int) bool { return ids[i].Compare(ids[j]) < 0 }
+func (ids IDs) Swap(i, j int)      { ids[i], ids[j] = ids[j], ids[i] }
+
+// Dedup sorts the ids in place and returns them without duplicates. The
+// returned IDs share the underlying array with ids.
+func (ids IDs) Dedup() IDs {
+	sort.Sort(ids)
+	var n int
+	for i, id := range ids {
+		if i == 0 || !id.Equal(ids[n-1]) {
+			ids[n] = id
+			n++
+		}
+	}
+	return ids[:n]
+}
+
 // Tree holds a list of entries, sorted by name in ascending order.
 type Tree []*Entry
 
@@ -84,16 +147,42 @@ func (t Tree) Get(name string) *Entry {
 	return nil
 }
 
-// Add adds or updates the given entry and returns the resulting tree.
+// Add adds or updates the given entry and returns the resulting tree. New
+// entries are inserted at their sorted position, so a sorted tree remains
+// sorted.
 func (t Tree) Add(entry *Entry) Tree {
-	if i := t.index(entry.Name); i >= 0 {
+	i := sort.Search(len(t), func(i int) bool {
+		return t[i].Name >= entry.Name
+	})
+	if i < len(t) && t[i].Name == entry.Name {
 		t[i] = entry
-	} else {
-		t = append(t, entry)
+		return t
 	}
+	t = append(t, nil)
+	copy(t[i+1:], t[i:])
+	t[i] = entry
 	return t
 }
 
+// AddStrict is like Add, but returns an error instead of replacing an existing
+// entry of a different Kind, e.g. a blob with a tree.
+func (t Tree) AddStrict(entry *Entry) (Tree, error) {
+	if existing := t.Get(entry.Name); existing != nil && existing.Kind != entry.Kind {
+		return t, fmt.Errorf("can not replace %s %q with %s", existing.Kind, entry.Name, entry.Kind)
+	}
+	return t.Add(entry), nil
+}
+
+// Remove returns the tree without the entry with the given name. The given
+// tree is not modified.
+func (t Tree) Remove(name string) Tree {
+	i := t.index(name)
+	if i < 0 {
+		return t
+	}
+	return append(t[:i:i], t[i+1:]...)
+}
+
 func (t Tree) index(name string) int {
 	i := sort.Search(len(t), func(i int) bool {
 		return t[i].Name >= name
@@ -104,16 +193,52 @@ func (t Tree) index(name string) int {
 	return -1
 }
 
+// Validate returns an error if the tree has a nil entry, an entry without an
+// id, an entry of a Kind other than KindBlob, KindTree or KindRef, an entry
+// whose name is not a valid key component, or several entries with the same
+// name. The tree does not need to be sorted.
+func (t Tree) Validate() error {
+	names := make(map[string]bool, len(t))
+	for i, entry := range t {
+		if entry == nil {
+			return fmt.Errorf("bad tree: entry %d is nil", i)
+		} else if len(entry.ID) == 0 {
+			return fmt.Errorf("bad tree: entry %q has no id", entry.Name)
+		} else if !validName(entry.Name) {
+			return fmt.Errorf("bad tree: bad entry name %q", entry.Name)
+		} else if names[entry.Name] {
+			return fmt.Errorf("bad tree: duplicate entry name %q", entry.Name)
+		}
+		switch entry.Kind {
+		case KindBlob, KindTree, KindRef:
+		default:
+			return fmt.Errorf("bad tree: entry %q has unknown kind %q", entry.Name, entry.Kind)
+		}
+		names[entry.Name] = true
+	}
+	return nil
+}
+
 // Entry defines a Tree entry.
 type Entry struct {
 	Kind Kind
+	// Mode holds file mode bits, e.g. ModeExecutable. It is ModeDefault for
+	// regular entries.
+	Mode uint32
 	Name string
 	ID   ID
 }
 
+// Entry modes, modeled after the ones used by git.
+const (
+	ModeDefault    uint32 = 0
+	ModeExecutable uint32 = 0100755
+	ModeSymlink    uint32 = 0120000
+)
+
 // Equal returns if one entry is equal to the another.
 func (e *Entry) Equal(other *Entry) bool {
-	return e.Kind == other.Kind && e.Name == other.Name && e.ID.Equal(other.ID)
+	return e.Kind == other.Kind && e.Mode == other.Mode && e.Name == other.Name && e.ID.Equal(other.ID)
 }
 
 // Kind represents the kind of objects Kit deals with.
@@ -123,14 +248,32 @@ const (
 	KindBlob   Kind = "blob"
 	KindTree   Kind = "tree"
 	KindCommit Kind = "commit"
+	// KindRef is the kind of tree entries that alias another key. The entry
+	// refers to a blob holding the slash separated key of the target, relative
+	// to the root tree, which Sugar.Get resolves.
+	KindRef Kind = "ref"
 )
 
-// Commit defines a commit object.
+// objectKind returns the Kind of the object the entry refers to, which is
+// KindBlob for KindRef entries.
+func (e *Entry) objectKind() Kind {
+	if e.Kind == KindRef {
+		return KindBlob
+	}
+	return e.Kind
+}
+
+// Commit defines a commit object. Author and Committer identify the people
+// who wrote and committed the change, typically as "name <email>", and are
+// optional. Signature is optional as well, see SignCommit.
 type Commit struct {
-	Tree    ID
-	Parents []ID
-	Time    time.Time
-	Message []byte
+	Tree      ID
+	Parents   []ID
+	Author    string
+	Committer string
+	Signature []byte
+	Time      time.Time
+	Message   []byte
 }
 
 func IsNotFound(err error) bool {
@@ -149,135 +292,783 @@ type NotFounder interface {
 	NotFound() bool
 }
 
+// NonCanonicalError is returned for objects that are stored in a valid, but
+// non-canonical encoding, i.e. re-encoding them produces a different id.
+type NonCanonicalError struct {
+	ID        ID
+	Canonical ID
+}
+
+func (n *NonCanonicalError) Error() string {
+	return fmt.Sprintf("non-canonical object: id=%s canonical=%s", n.ID, n.Canonical)
+}
+
+// CorruptError is returned for objects whose stored data does not match their
+// id or cannot be decoded, e.g. because they were truncated. Reading an
+// intact object as the wrong kind returns a *KindError instead.
+type CorruptError struct {
+	ID     ID
+	Reason string
+}
+
+func (c *CorruptError) Error() string {
+	return fmt.Sprintf("corrupt object %s: %s", c.ID, c.Reason)
+}
+
+// IsCorrupt returns true if err is a *CorruptError.
+func IsCorrupt(err error) bool {
+	_, ok := err.(*CorruptError)
+	return ok
+}
+
+// corruptError returns the decode error err as a *CorruptError for the object
+// with the given id. Errors that don't indicate damaged data, i.e. reading
+// the object as the wrong kind or failing to read its file, are returned
+// unchanged, as are errors that are a *CorruptError already.
+func corruptError(id ID, err error) error {
+	switch err.(type) {
+	case *CorruptError, *KindError, *os.PathError, AuthError:
+		return err
+	}
+	return &CorruptError{ID: id, Reason: err.Error()}
+}
+
 func NewDirRepo(path string) *DirRepo {
-	return &DirRepo{
-		tmp:    filepath.Join(path, "tmp"),
-		obj:    filepath.Join(path, "obj"),
-		head:   filepath.Join(path, "head"),
-		format: NewDefaultFormat(),
+	d := &DirRepo{
+		tmp:      filepath.Join(path, "tmp"),
+		obj:      filepath.Join(path, "obj"),
+		format:   filepath.Join(path, "format"),
+		hash:     filepath.Join(path, "hash"),
+		refs:     filepath.Join(path, "refs"),
+		wal:      filepath.Join(path, "wal"),
+		Format:   NewDefaultFormat(),
+		HeadFile: filepath.Join(path, "head"),
+		Verify:   true,
+	}
+	// Existing repos are usually opened without calling Init, so their ids
+	// must be computed with the recorded hash right away.
+	if data, err := ioutil.ReadFile(d.hash); err == nil {
+		if h, err := parseHash(strings.TrimSpace(string(data))); err == nil {
+			d.Hash = h
+		}
 	}
+	return d
 }
 
 // Check Repo interface compliance
 var _ = Repo(&DirRepo{})
 
+// DirRepo is a Repo that stores each object in its own file below a directory.
+// It is safe for concurrent use as every operation works on its own file
+// handles.
 type DirRepo struct {
-	tmp    string
-	obj    string
-	head   string
-	format Format
+	// Format is used to encode and decode objects. It defaults to
+	// NewDefaultFormat and must not be changed once objects have been written.
+	Format Format
+	// Hash is the hash function used to compute object ids. NewDirRepo sets
+	// it to the hash recorded in an existing repo. If it is zero, Init sets it
+	// to crypto.SHA1 for new repos. The hash of a new repo is recorded by Init
+	// and can not be changed afterwards: Init returns an error if Hash does
+	// not match the recorded one. Only DirRepo honours Hash; MemRepo,
+	// NewIDWriter and NewIDVerifier always use sha1.
+	Hash crypto.Hash
+	// HeadFile is the path of the file holding the head. It defaults to the
+	// "head" file inside the repo directory. Repos may share a directory and
+	// objects while using different head files.
+	HeadFile string
+	// StrictTrees makes Tree re-encode every tree it reads and return a
+	// NonCanonicalError if the result does not reproduce the requested id.
+	StrictTrees bool
+	// ValidateReferences makes WriteTree check that every entry refers to an
+	// existing object of the entry's Kind before writing the tree.
+	ValidateReferences bool
+	// CheckCommits makes WriteCommit check that the tree and parents of a
+	// commit exist before writing it. This should be disabled when objects are
+	// written out of order, e.g. when cloning.
+	CheckCommits bool
+	// MissingObjects decides how walks over the repo treat missing objects,
+	// see MissingObjectHandler. If it is nil, walks fail on missing objects.
+	MissingObjects MissingObjectHandler
+	// Mmap makes reads map object files into memory instead of reading them
+	// through a file handle, falling back to the latter on platforms without
+	// mmap support and for very large files. Mapped objects are verified in
+	// full when they are first read, after which their id is trusted.
+	Mmap bool
+	// WAL enables an append-only log of object and head writes, which allows
+	// ReplayWAL to find objects that were written without a subsequent head
+	// update, e.g. because of a crash.
+	WAL bool
+	// Verify makes reads check that the contents of every object match its
+	// id, so corruption on disk is detected. It defaults to true and may be
+	// disabled for trusted storage to avoid hashing every byte read. Fsck
+	// always verifies objects.
+	Verify bool
+	// MaxBlobSize is the maximum size of blobs written to the repo in bytes,
+	// or 0 for no limit. Writing a larger blob fails once the limit is
+	// exceeded, without storing any of it.
+	MaxBlobSize int64
+	walMu       sync.Mutex
+	headMu      sync.Mutex
+	verified    sync.Map
+	tmp         string
+	obj         string
+	format      string
+	hash        string
+	refs        string
+	wal         string
 }
 
+// Init creates the repo directories and records the name and version of the
+// repo's Format. It is safe to call Init for an existing repo, in which case
+// an error is returned if the repo was written with a different Format.
 func (d *DirRepo) Init() error {
-	for _, dir := range []string{d.tmp, d.obj} {
+	for _, path := range []string{d.tmp, d.obj, d.format, d.hash, d.refs} {
+		if filepath.Clean(d.HeadFile) == filepath.Clean(path) {
+			return fmt.Errorf("head file conflicts with repo file: %s", d.HeadFile)
+		}
+	}
+	for _, dir := range []string{d.tmp, d.obj, filepath.Dir(d.HeadFile)} {
 		if err := os.MkdirAll(dir, 0700); err != nil {
 			return err
 		}
 	}
+	if err := d.initHash(); err != nil {
+		return err
+	}
+	name, version := formatInfo(d.Format)
+	if _, err := os.Stat(d.format); os.IsNotExist(err) {
+		return ioutil.WriteFile(d.format, []byte(fmt.Sprintf("%s %d\n", name, version)), 0600)
+	} else if err != nil {
+		return err
+	} else if gotName, gotVersion := d.FormatInfo(); gotName != name || gotVersion != version {
+		return fmt.Errorf("format mismatch: repo=%s %d configured=%s %d", gotName, gotVersion, name, version)
+	}
+	return nil
+}
+
+// initHash records the Hash of a new repo, or checks it against the one the
+// repo was created with. Repos created before the hash was recorded use sha1.
+func (d *DirRepo) initHash() error {
+	stored := crypto.SHA1
+	if data, err := ioutil.ReadFile(d.hash); err == nil {
+		if stored, err = parseHash(strings.TrimSpace(string(data))); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	} else if _, err := os.Stat(d.format); os.IsNotExist(err) {
+		if d.Hash == 0 {
+			d.Hash = crypto.SHA1
+		} else if !d.Hash.Available() {
+			return fmt.Errorf("hash not available: %s", d.Hash)
+		}
+		return ioutil.WriteFile(d.hash, []byte(d.Hash.String()+"\n"), 0600)
+	} else if err != nil {
+		return err
+	}
+	if d.Hash == 0 {
+		d.Hash = stored
+	} else if d.Hash != stored {
+		return fmt.Errorf("hash mismatch: repo=%s configured=%s", stored, d.Hash)
+	}
 	return nil
 }
 
+// parseHash returns the available hash with the given name.
+func parseHash(name string) (crypto.Hash, error) {
+	for h := crypto.MD4; h <= crypto.BLAKE2b_512; h++ {
+		if h.Available() && h.String() == name {
+			return h, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown hash: %q", name)
+}
+
+// newHash returns a new hash.Hash for computing object ids.
+func (d *DirRepo) newHash() hash.Hash {
+	if d.Hash == 0 {
+		return sha1.New()
+	}
+	return d.Hash.New()
+}
+
+// FormatInfo returns the name and version of the format the repo was
+// initialized with. It returns an empty name and 0 if the format descriptor
+// can not be read.
+func (d *DirRepo) FormatInfo() (name string, version int) {
+	data, err := ioutil.ReadFile(d.format)
+	if err != nil {
+		return "", 0
+	} else if _, err := fmt.Sscanf(string(data), "%s %d\n", &name, &version); err != nil {
+		return "", 0
+	}
+	return name, version
+}
+
 func (d *DirRepo) Head() (ID, error) {
-	if head, err := ioutil.ReadFile(d.head); err != nil {
+	if head, err := ioutil.ReadFile(d.HeadFile); err != nil {
 		return nil, err
 	} else {
 		return ParseID(string(head))
 	}
 }
 
+// WriteHead atomically replaces the head file, so a crash never leaves it
+// partially written. The previous and new head are recorded in the reflog.
 func (d *DirRepo) WriteHead(id ID) error {
-	return ioutil.WriteFile(d.head, []byte(id.String()), 0600)
+	return d.replaceHead(id, nil)
+}
+
+// swapHead is part of the headSwapper interface. The check is atomic with
+// respect to other head updates of d.
+func (d *DirRepo) swapHead(old, id ID) error {
+	return d.replaceHead(id, func() error {
+		head, err := d.Head()
+		if err != nil && !IsNotFound(err) {
+			return err
+		} else if !head.Equal(old) {
+			return ErrHeadMoved
+		}
+		return nil
+	})
+}
+
+// replaceHead implements WriteHead and swapHead. If check is not nil, it is
+// called before replacing the head and its error aborts the update.
+func (d *DirRepo) replaceHead(id ID, check func() error) error {
+	if err := d.writeHead(id, func() error {
+		if check != nil {
+			if err := check(); err != nil {
+				return err
+			}
+		}
+		return d.writeFile(d.HeadFile, strings.NewReader(id.String()))
+	}); err != nil {
+		return err
+	} else if d.WAL {
+		return d.appendWAL(walEntry{Op: walHead, WALEntry: WALEntry{ID: id, Time: time.Now()}})
+	}
+	return nil
+}
+
+// tmpFilePrefix is the name prefix of the temporary files created by
+// writeFile.
+const tmpFilePrefix = ".tmp-"
+
+// writeFile atomically replaces the file at path with the contents of r by
+// writing them to a temporary file first and renaming it to path. The
+// temporary file is created next to path, as renaming across file systems
+// fails, e.g. if HeadFile is not on the file system of the repo.
+func (d *DirRepo) writeFile(path string, r io.Reader) error {
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), tmpFilePrefix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+	if _, err := io.Copy(tmpFile, r); err != nil {
+		tmpFile.Close()
+		return err
+	} else if err := tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	} else if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	err = os.Rename(tmpFile.Name(), path)
+	if err != nil && runtime.GOOS == "windows" {
+		// Windows can not rename over an existing file.
+		if rmErr := os.Remove(path); rmErr == nil || os.IsNotExist(rmErr) {
+			err = os.Rename(tmpFile.Name(), path)
+		}
+	}
+	return err
+}
+
+func (d *DirRepo) createHead(id ID) error {
+	return d.writeHead(id, func() error {
+		return d.createHeadFile(id)
+	})
+}
+
+func (d *DirRepo) createHeadFile(id ID) error {
+	file, err := os.OpenFile(d.HeadFile, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if os.IsExist(err) {
+		return ErrAlreadyInitialized
+	} else if err != nil {
+		return err
+	}
+	if _, err := file.WriteString(id.String()); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
 }
 
 func (d *DirRepo) Blob(id ID) (io.ReadCloser, error) {
-	file, err := os.Open(d.path(id))
+	rc, format, err := d.open(id)
 	if err != nil {
 		return nil, err
 	}
-	iv := NewIDVerifier(file, id)
-	r, err := d.format.DecodeBlob(iv)
+	r, err := format.DecodeBlob(rc)
 	if err != nil {
-		file.Close()
-		return nil, err
+		rc.Close()
+		return nil, corruptError(id, err)
 	}
-	return NewReadCloser(r, file), nil
+	return NewReadCloser(r, rc), nil
 }
 
 func (d *DirRepo) WriteBlob(r io.Reader) (ID, error) {
 	return d.write(r)
 }
 
-func (d *DirRepo) Tree(id ID) (Tree, error) {
-	file, err := os.Open(d.path(id))
+// WriteBlobFile stores the contents of the file at path as a blob. The file is
+// hashed in place first, so it is only copied into the repo if the blob does
+// not exist yet. Stored objects begin with the encoding of the format, which
+// rules out hard-linking the file, so it is copied like WriteBlob does.
+func (d *DirRepo) WriteBlobFile(path string) (ID, error) {
+	file, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
-	iv := NewIDVerifier(file, id)
-	tree, err := d.format.DecodeTree(iv)
+	format := d.Format
+	if s, ok := format.(Sealer); ok {
+		format = s.Unsealed()
+	}
+	iw := newIDWriter(ioutil.Discard, d.newHash())
+	if err := format.EncodeBlob(iw, file); err != nil {
+		return nil, err
+	}
+	id := iw.ID()
+	if ok, err := d.Exists(id); err != nil {
+		return nil, err
+	} else if ok {
+		return id, nil
+	} else if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	} else if written, err := d.write(file); err != nil {
+		return nil, err
+	} else if !written.Equal(id) {
+		return nil, fmt.Errorf("file changed while writing: %s", path)
+	}
+	return id, nil
+}
+
+// BlobWriter is an io.WriteCloser for a blob. Closing it stores the blob,
+// after which ID returns its id. Abort discards the blob instead.
+type BlobWriter interface {
+	io.WriteCloser
+	// ID returns the id of the blob after a successful Close, or nil.
+	ID() ID
+	// Abort discards the data written so far without storing the blob.
+	Abort() error
+}
+
+// errBlobAborted is passed to the pipe of an aborted BlobWriter.
+var errBlobAborted = errors.New("blob writer aborted")
+
+// NewBlobWriter returns a BlobWriter that streams the blob written to it to
+// a temporary file, like WriteBlob does.
+func (d *DirRepo) NewBlobWriter() (BlobWriter, error) {
+	return newStreamWriter(func(r io.Reader) (ID, error) { return d.write(r) }), nil
+}
+
+// newStreamWriter returns a streamWriter whose data is consumed by fn in a new
+// goroutine.
+func newStreamWriter(fn func(r io.Reader) (ID, error)) *streamWriter {
+	pr, pw := io.Pipe()
+	sw := &streamWriter{PipeWriter: pw, done: make(chan struct{})}
+	go func() {
+		defer close(sw.done)
+		sw.id, sw.err = fn(pr)
+		// Unblock the writer if fn failed before reading everything.
+		pr.CloseWithError(sw.err)
+	}()
+	return sw
+}
+
+// streamWriter implements the BlobWriter interface for NewBlobWriter and
+// SetStream.
+type streamWriter struct {
+	*io.PipeWriter
+	done chan struct{}
+	id   ID
+	err  error
+}
+
+// Close finishes the data and waits for it to be consumed.
+func (s *streamWriter) Close() error {
+	s.PipeWriter.Close()
+	_, err := s.wait()
+	return err
+}
+
+func (s *streamWriter) Abort() error {
+	s.PipeWriter.CloseWithError(errBlobAborted)
+	s.wait()
+	return nil
+}
+
+func (s *streamWriter) ID() ID {
+	select {
+	case <-s.done:
+		if s.err == nil {
+			return s.id
+		}
+	default:
+	}
+	return nil
+}
+
+// wait waits for the data to be consumed and returns the result.
+func (s *streamWriter) wait() (ID, error) {
+	<-s.done
+	return s.id, s.err
+}
+
+func (d *DirRepo) Tree(id ID) (Tree, error) {
+	rc, format, err := d.open(id)
 	if err != nil {
 		return nil, err
 	}
+	defer rc.Close()
+	tree, err := format.DecodeTree(rc)
+	if err != nil {
+		return nil, corruptError(id, err)
+	}
+	if d.StrictTrees {
+		iw := newIDWriter(ioutil.Discard, d.newHash())
+		if err := format.EncodeTree(iw, tree); err != nil {
+			return nil, err
+		} else if canonical := iw.ID(); !canonical.Equal(id) {
+			return nil, &NonCanonicalError{ID: id, Canonical: canonical}
+		}
+	}
 	return tree, nil
 }
 
+// TreeEntries calls fn for each entry of the tree with the given id, without
+// reading the whole tree into memory. As the id of the tree is verified once it
+// has been read completely, fn may be called for entries of a corrupt tree
+// before the error is returned. StrictTrees is not enforced.
+func (d *DirRepo) TreeEntries(id ID, fn func(*Entry) error) error {
+	rc, format, err := d.open(id)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return DecodeTreeEntries(format, rc, fn)
+}
+
 func (d *DirRepo) WriteTree(t Tree) (ID, error) {
+	if err := d.checkTree(t); err != nil {
+		return nil, err
+	}
 	return d.write(t)
 }
 
+// checkTree validates t and implements ValidateReferences.
+func (d *DirRepo) checkTree(t Tree) error {
+	if err := t.Validate(); err != nil {
+		return err
+	} else if !d.ValidateReferences {
+		return nil
+	}
+	for _, entry := range t {
+		if kind, err := objectKind(d, entry.ID); err != nil {
+			return fmt.Errorf("bad tree entry %q: %s", entry.Name, err)
+		} else if kind != entry.objectKind() {
+			return fmt.Errorf("bad tree entry %q: %s is a %s, not a %s", entry.Name, entry.ID, kind, entry.objectKind())
+		}
+	}
+	return nil
+}
+
 func (d *DirRepo) Commit(id ID) (Commit, error) {
-	file, err := os.Open(d.path(id))
+	rc, format, err := d.open(id)
 	if err != nil {
 		return Commit{}, err
 	}
-	defer file.Close()
-	iv := NewIDVerifier(file, id)
-	commit, err := d.format.DecodeCommit(iv)
+	defer rc.Close()
+	commit, err := format.DecodeCommit(rc)
 	if err != nil {
-		return Commit{}, err
+		return Commit{}, corruptError(id, err)
 	}
 	return commit, nil
 }
 
+// CommitMessage returns a ReadCloser for the message of the commit with the
+// given id. If the repo's Format implements CommitStreamer, the message is
+// streamed from disk rather than read into memory.
+func (d *DirRepo) CommitMessage(id ID) (io.ReadCloser, error) {
+	rc, format, err := d.open(id)
+	if err != nil {
+		return nil, err
+	}
+	cs, ok := format.(CommitStreamer)
+	if !ok {
+		defer rc.Close()
+		commit, err := format.DecodeCommit(rc)
+		if err != nil {
+			return nil, corruptError(id, err)
+		}
+		return ioutil.NopCloser(bytes.NewReader(commit.Message)), nil
+	}
+	_, mr, err := cs.DecodeCommitHeader(rc)
+	if err != nil {
+		rc.Close()
+		return nil, corruptError(id, err)
+	}
+	return NewReadCloser(mr, rc), nil
+}
+
+// CommitMessageReader returns a ReadCloser for the message of the commit with
+// the given id. The message is streamed if rp supports it, e.g. for DirRepo.
+func CommitMessageReader(rp Repo, id ID) (io.ReadCloser, error) {
+	if cm, ok := rp.(commitMessager); ok {
+		return cm.CommitMessage(id)
+	}
+	commit, err := rp.Commit(id)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(commit.Message)), nil
+}
+
+// commitMessager is implemented by Repos that can stream commit messages.
+type commitMessager interface {
+	CommitMessage(id ID) (io.ReadCloser, error)
+}
+
 func (d *DirRepo) WriteCommit(c Commit) (ID, error) {
+	if err := d.checkCommit(c); err != nil {
+		return nil, err
+	}
 	return d.write(c)
 }
 
+// checkCommit implements CheckCommits.
+func (d *DirRepo) checkCommit(c Commit) error {
+	if !d.CheckCommits {
+		return nil
+	}
+	if ok, err := d.Exists(c.Tree); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("missing tree: %s", c.Tree)
+	}
+	for _, parent := range c.Parents {
+		if ok, err := d.Exists(parent); err != nil {
+			return err
+		} else if !ok {
+			return fmt.Errorf("missing parent: %s", parent)
+		}
+	}
+	return nil
+}
+
+// Exists is part of the Repo interface. It only stats the object file and
+// does not verify its contents.
+func (d *DirRepo) Exists(id ID) (bool, error) {
+	if len(id) == 0 {
+		return false, nil
+	} else if _, err := os.Stat(d.path(id)); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WalkObjects calls fn with the id of every object stored in the repo, in
+// ascending order, and stops at the first error returned by fn. Files in the
+// object directory that don't match its layout are skipped.
+func (d *DirRepo) WalkObjects(fn func(ID) error) error {
+	dirs, err := ioutil.ReadDir(d.obj)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() || len(dir.Name()) != 2 {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(d.obj, dir.Name()))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			name := dir.Name() + file.Name()
+			id, err := ParseID(name)
+			if err != nil || file.IsDir() || id.String() != name {
+				continue
+			} else if err := fn(id); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Objects returns the ids of all objects stored in the repo, see WalkObjects.
+func (d *DirRepo) Objects() ([]ID, error) {
+	var ids []ID
+	err := d.WalkObjects(func(id ID) error {
+		ids = append(ids, id)
+		return nil
+	})
+	return ids, err
+}
+
+// Resolve returns the id of the only object whose hex id starts with the given
+// prefix of at least 4 characters. A not found error is returned if no object
+// matches, and an error listing the candidates if several objects match.
+func (d *DirRepo) Resolve(prefix string) (ID, error) {
+	prefix = strings.ToLower(prefix)
+	if len(prefix) < 4 {
+		return nil, fmt.Errorf("prefix too short: %q", prefix)
+	} else if strings.Trim(prefix, "0123456789abcdef") != "" {
+		return nil, fmt.Errorf("bad prefix: %q", prefix)
+	}
+	files, err := ioutil.ReadDir(filepath.Join(d.obj, prefix[:2]))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var candidates []string
+	for _, file := range files {
+		if name := prefix[:2] + file.Name(); strings.HasPrefix(name, prefix) {
+			candidates = append(candidates, name)
+		}
+	}
+	switch len(candidates) {
+	case 0:
+		return nil, notFoundError(fmt.Sprintf("no object matches prefix: %s", prefix))
+	case 1:
+		return ParseID(candidates[0])
+	default:
+		return nil, fmt.Errorf("ambiguous prefix: %s: %s", prefix, strings.Join(candidates, ", "))
+	}
+}
+
 func (d *DirRepo) write(o interface{}) (ID, error) {
+	return d.writeObject(o, nil)
+}
+
+// writeObject implements write. If dirs is not nil, it records the object
+// directories that exist, so they are only created once.
+func (d *DirRepo) writeObject(o interface{}, dirs map[string]bool) (ID, error) {
 	tmpFile, err := ioutil.TempFile(d.tmp, "")
 	if err != nil {
 		return nil, err
 	}
 	defer tmpFile.Close()
 	defer os.Remove(tmpFile.Name())
-	iw := NewIDWriter(tmpFile)
+	var (
+		w      io.Writer = tmpFile
+		sw     io.WriteCloser
+		format = d.Format
+	)
+	// Sealed formats are hashed before sealing, see Sealer.
+	if s, ok := format.(Sealer); ok {
+		sw = s.Seal(tmpFile)
+		w = sw
+		format = s.Unsealed()
+	}
+	iw := newIDWriter(w, d.newHash())
+	var kind Kind
 	switch t := o.(type) {
 	case Tree:
-		if err := d.format.EncodeTree(iw, t); err != nil {
+		kind = KindTree
+		if err := format.EncodeTree(iw, t); err != nil {
 			return nil, err
 		}
 	case Commit:
-		if err := d.format.EncodeCommit(iw, t); err != nil {
+		kind = KindCommit
+		if err := format.EncodeCommit(iw, t); err != nil {
 			return nil, err
 		}
 	case io.Reader:
-		if err := d.format.EncodeBlob(iw, t); err != nil {
+		kind = KindBlob
+		if d.MaxBlobSize > 0 {
+			t = &maxSizeReader{r: t, max: d.MaxBlobSize}
+		}
+		if err := format.EncodeBlob(iw, t); err != nil {
 			return nil, err
 		}
 	default:
 		return nil, fmt.Errorf("bad type: %#v", t)
 	}
+	if sw != nil {
+		if err := sw.Close(); err != nil {
+			return nil, err
+		}
+	}
 	id := iw.ID()
 	path := d.path(id)
-	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+	if dir := filepath.Dir(path); !dirs[dir] {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		} else if dirs != nil {
+			dirs[dir] = true
+		}
+	}
+	if d.WAL {
+		info, err := tmpFile.Stat()
+		if err != nil {
+			return nil, err
+		}
+		entry := WALEntry{Kind: kind, ID: id, Size: info.Size(), Time: time.Now()}
+		if err := d.appendWAL(walEntry{Op: walObject, WALEntry: entry}); err != nil {
+			return nil, err
+		}
+	}
+	if err := tmpFile.Close(); err != nil {
 		return nil, err
 	}
+	// Objects are immutable, so if another writer stored the same object
+	// first, e.g. on platforms that can't rename over existing files, the
+	// rename has nothing left to do.
 	if err := os.Rename(tmpFile.Name(), path); err != nil {
-		return nil, err
+		if _, statErr := os.Stat(path); statErr != nil {
+			return nil, err
+		}
 	}
 	return id, nil
 }
 
+// open returns a reader for the encoded object with the given id, as well as
+// the Format to decode it with. The reader verifies the id if d.Verify is set.
+func (d *DirRepo) open(id ID) (io.ReadCloser, Format, error) {
+	return d.openObject(id, d.Verify)
+}
+
+// openObject is like open, but verifies the id only if verify is true.
+func (d *DirRepo) openObject(id ID, verify bool) (io.ReadCloser, Format, error) {
+	if d.Mmap {
+		if rc, format, err := d.openMmap(id, verify); err != errMmapUnsupported {
+			return rc, format, err
+		}
+	}
+	file, err := os.Open(d.path(id))
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		r      io.Reader = file
+		format           = d.Format
+	)
+	if s, ok := format.(Sealer); ok {
+		if r, err = s.Unseal(file); err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		format = s.Unsealed()
+	}
+	if verify {
+		r = newIDVerifier(r, id, d.newHash())
+	}
+	return NewReadCloser(r, file), format, nil
+}
+
 func (d *DirRepo) path(id ID) string {
 	s := id.String()
 	return filepath.Join(d.obj, s[0:2], s[2:])
@@ -288,8 +1079,14 @@ type IDWriter interface {
 	ID() ID
 }
 
+// NewIDWriter returns an IDWriter that computes sha1 ids, i.e. the ids of a
+// DirRepo using the default Hash.
 func NewIDWriter(w io.Writer) IDWriter {
-	return &idWriter{w: w, h: sha1.New()}
+	return newIDWriter(w, sha1.New())
+}
+
+func newIDWriter(w io.Writer, h hash.Hash) IDWriter {
+	return &idWriter{w: w, h: h}
 }
 
 type idWriter struct {
@@ -309,8 +1106,14 @@ func (w *idWriter) ID() ID {
 	return w.h.Sum(nil)
 }
 
+// NewIDVerifier returns a reader that fails if the data read from r does not
+// have the sha1 id id.
 func NewIDVerifier(r io.Reader, id ID) io.Reader {
-	return &idVerifier{r: r, want: id, h: sha1.New()}
+	return newIDVerifier(r, id, sha1.New())
+}
+
+func newIDVerifier(r io.Reader, id ID, h hash.Hash) io.Reader {
+	return &idVerifier{r: r, want: id, h: h}
 }
 
 type idVerifier struct {
@@ -326,12 +1129,28 @@ func (v *idVerifier) Read(p []byte) (int, error) {
 	}
 	if err == io.EOF {
 		if got := ID(v.h.Sum(nil)); !got.Equal(v.want) {
-			return n, fmt.Errorf("bad id: got=%s want=%s", got, v.want)
+			return n, &CorruptError{ID: v.want, Reason: fmt.Sprintf("bad id: got=%s", got)}
 		}
 	}
 	return n, err
 }
 
+// maxSizeReader reads from r, and returns an error once more than max bytes
+// have been read.
+type maxSizeReader struct {
+	r   io.Reader
+	max int64
+	n   int64
+}
+
+func (m *maxSizeReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	if m.n += int64(n); m.n > m.max {
+		return n, fmt.Errorf("blob exceeds MaxBlobSize of %d bytes", m.max)
+	}
+	return n, err
+}
+
 func NewReadCloser(r io.Reader, c io.Closer) io.ReadCloser {
 	return &readCloser{r, c}
 }
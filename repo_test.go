@@ -2,8 +2,16 @@ package can
 
 import (
 	"bytes"
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"os"
+	"path/filepath"
 	"sort"
+	"strings"
+	"sync"
 
 	"github.com/kylelemons/godebug/pretty"
 )
@@ -103,3 +111,832 @@ func testCommit(t *testing.T, k Repo, in Commit, wantID ID) {
 		t.Fatalf("%s", diff)
 	}
 }
+
+func TestDirRepo_Concurrent(t *testing.T) {
+	const workers = 20
+	var (
+		rp   = tmpRepo()
+		wg   sync.WaitGroup
+		errs = make(chan error, workers)
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- func() error {
+				data := []byte(fmt.Sprintf("blob %d", i))
+				blobID, err := rp.WriteBlob(bytes.NewReader(data))
+				if err != nil {
+					return err
+				}
+				tree := Tree{{Kind: KindBlob, Name: fmt.Sprintf("%d", i), ID: blobID}}
+				treeID, err := rp.WriteTree(tree)
+				if err != nil {
+					return err
+				}
+				commitID, err := rp.WriteCommit(Commit{Tree: treeID})
+				if err != nil {
+					return err
+				}
+				if r, err := rp.Blob(blobID); err != nil {
+					return err
+				} else if got, err := ioutil.ReadAll(r); err != nil {
+					return err
+				} else if err := r.Close(); err != nil {
+					return err
+				} else if !bytes.Equal(got, data) {
+					return fmt.Errorf("bad blob: got=%q want=%q", got, data)
+				}
+				if got, err := rp.Tree(treeID); err != nil {
+					return err
+				} else if diff := pretty.Compare(got, tree); diff != "" {
+					return fmt.Errorf("bad tree: %s", diff)
+				}
+				if got, err := rp.Commit(commitID); err != nil {
+					return err
+				} else if !got.Tree.Equal(treeID) {
+					return fmt.Errorf("bad commit tree: got=%s want=%s", got.Tree, treeID)
+				}
+				return nil
+			}()
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestDirRepo_FormatInfo(t *testing.T) {
+	rp := tmpDirRepo()
+	if name, version := rp.FormatInfo(); name != "default" || version != 1 {
+		t.Fatalf("bad format info: name=%q version=%d", name, version)
+	}
+	other := NewDirRepo(filepath.Dir(rp.obj))
+	other.Format = NewSortedParentsFormat(NewDefaultFormat())
+	if err := other.Init(); err == nil {
+		t.Fatal("expected error when opening repo with a different format")
+	} else if err := NewDirRepo(filepath.Dir(rp.obj)).Init(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTree_Add(t *testing.T) {
+	var tree Tree
+	names := []string{"e", "d", "c", "b", "a"}
+	for _, name := range names {
+		tree = tree.Add(&Entry{Kind: KindBlob, Name: name, ID: MustID("0123")})
+	}
+	tree = tree.Add(&Entry{Kind: KindBlob, Name: "c", ID: MustID("4567")})
+	if len(tree) != len(names) {
+		t.Fatalf("bad tree length: %d", len(tree))
+	} else if !sort.IsSorted(tree) {
+		t.Fatalf("tree not sorted: %#v", tree)
+	}
+	for _, name := range names {
+		want := MustID("0123")
+		if name == "c" {
+			want = MustID("4567")
+		}
+		if entry := tree.Get(name); entry == nil {
+			t.Fatalf("entry %q not found", name)
+		} else if !entry.ID.Equal(want) {
+			t.Fatalf("bad id for %q: got=%s want=%s", name, entry.ID, want)
+		}
+	}
+}
+
+func TestTree_AddStrict(t *testing.T) {
+	tree := Tree{{Kind: KindTree, Name: "foo", ID: MustID("0123")}}
+	if _, err := tree.AddStrict(&Entry{Kind: KindBlob, Name: "foo", ID: MustID("4567")}); err == nil {
+		t.Fatal("expected error when replacing a tree with a blob")
+	} else if got := tree.Get("foo"); got.Kind != KindTree || !got.ID.Equal(MustID("0123")) {
+		t.Fatalf("tree was modified: %#v", got)
+	}
+	tree, err := tree.AddStrict(&Entry{Kind: KindTree, Name: "foo", ID: MustID("89ab")})
+	if err != nil {
+		t.Fatal(err)
+	} else if got := tree.Get("foo"); !got.ID.Equal(MustID("89ab")) {
+		t.Fatalf("bad entry: %#v", got)
+	}
+}
+
+func TestTree_Validate(t *testing.T) {
+	var (
+		a = MustID("0123")
+		b = MustID("4567")
+	)
+	for _, test := range []struct {
+		Name  string
+		Tree  Tree
+		Valid bool
+	}{
+		{Name: "empty", Tree: Tree{}, Valid: true},
+		{Name: "valid", Tree: Tree{{Kind: KindTree, Name: "b", ID: a}, {Kind: KindBlob, Name: "a", ID: b}, {Kind: KindRef, Name: "c", ID: b}}, Valid: true},
+		{Name: "duplicate", Tree: Tree{{Kind: KindBlob, Name: "a", ID: a}, {Kind: KindTree, Name: "a", ID: b}}},
+		{Name: "unknown kind", Tree: Tree{{Kind: "link", Name: "a", ID: a}}},
+		{Name: "commit kind", Tree: Tree{{Kind: KindCommit, Name: "a", ID: a}}},
+		{Name: "empty name", Tree: Tree{{Kind: KindBlob, Name: "", ID: a}}},
+		{Name: "dot name", Tree: Tree{{Kind: KindBlob, Name: "..", ID: a}}},
+		{Name: "slash name", Tree: Tree{{Kind: KindBlob, Name: "a/b", ID: a}}},
+		{Name: "no id", Tree: Tree{{Kind: KindBlob, Name: "a"}}},
+		{Name: "nil entry", Tree: Tree{nil}},
+	} {
+		if err := test.Tree.Validate(); test.Valid && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.Name, err)
+		} else if !test.Valid && err == nil {
+			t.Errorf("%s: expected error", test.Name)
+		}
+	}
+	for _, rp := range []Repo{tmpDirRepo(), NewMemRepo()} {
+		blob, err := rp.WriteBlob(strings.NewReader("a"))
+		if err != nil {
+			t.Fatal(err)
+		} else if _, err := rp.WriteTree(Tree{{Kind: KindBlob, Name: "a", ID: blob}}); err != nil {
+			t.Fatal(err)
+		} else if _, err := rp.WriteTree(Tree{{Kind: KindBlob, Name: "a", ID: blob}, {Kind: KindBlob, Name: "a", ID: blob}}); err == nil {
+			t.Fatalf("%T: expected error for duplicate entries", rp)
+		}
+	}
+}
+
+func TestDirRepo_StrictTrees(t *testing.T) {
+	rp := tmpDirRepo()
+	// Entries in reverse order are accepted by DecodeTree, but EncodeTree
+	// always sorts them.
+	raw := []byte("tree\nblob 0123 1 b\nblob 4567 1 a\n")
+	iw := NewIDWriter(ioutil.Discard)
+	iw.Write(raw)
+	id := iw.ID()
+	if err := os.MkdirAll(filepath.Dir(rp.path(id)), 0700); err != nil {
+		t.Fatal(err)
+	} else if err := ioutil.WriteFile(rp.path(id), raw, 0600); err != nil {
+		t.Fatal(err)
+	} else if _, err := rp.Tree(id); err != nil {
+		t.Fatal(err)
+	}
+	rp.StrictTrees = true
+	if _, err := rp.Tree(id); err == nil {
+		t.Fatal("expected error for non-canonical tree")
+	} else if _, ok := err.(*NonCanonicalError); !ok {
+		t.Fatalf("expected NonCanonicalError, got: %#v", err)
+	}
+	if id, err := rp.WriteTree(Tree{{Kind: KindBlob, Name: "a", ID: MustID("4567")}}); err != nil {
+		t.Fatal(err)
+	} else if _, err := rp.Tree(id); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCommitMessageReader(t *testing.T) {
+	rp := tmpDirRepo()
+	commit := Commit{
+		Tree:    MustID("0123"),
+		Message: bytes.Repeat([]byte("a large commit message\n"), 1<<16),
+	}
+	id, err := rp.WriteCommit(commit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	observed, _ := NewObservedRepo(rp)
+	for _, r := range []Repo{rp, observed} {
+		if rc, err := CommitMessageReader(r, id); err != nil {
+			t.Fatal(err)
+		} else if msg, err := ioutil.ReadAll(rc); err != nil {
+			t.Fatal(err)
+		} else if err := rc.Close(); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(msg, commit.Message) {
+			t.Fatalf("bad message: got=%d bytes want=%d bytes", len(msg), len(commit.Message))
+		}
+	}
+	raw, err := ioutil.ReadFile(rp.path(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw[len(raw)-1] = 'X'
+	if err := ioutil.WriteFile(rp.path(id), raw, 0600); err != nil {
+		t.Fatal(err)
+	} else if rc, err := CommitMessageReader(rp, id); err != nil {
+		t.Fatal(err)
+	} else if _, err := ioutil.ReadAll(rc); err == nil {
+		t.Fatal("expected error for corrupt message")
+	}
+}
+
+func TestDirRepo_ValidateReferences(t *testing.T) {
+	rp := tmpDirRepo()
+	blobID, err := rp.WriteBlob(bytes.NewReader([]byte("Hello")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		valid      = Tree{{Kind: KindBlob, Name: "hello", ID: blobID}}
+		mislabeled = Tree{{Kind: KindTree, Name: "hello", ID: blobID}}
+		missing    = Tree{{Kind: KindBlob, Name: "missing", ID: MustID("0123")}}
+	)
+	if _, err := rp.WriteTree(mislabeled); err != nil {
+		t.Fatalf("validation should be off by default: %s", err)
+	}
+	rp.ValidateReferences = true
+	for _, tree := range []Tree{mislabeled, missing} {
+		if _, err := rp.WriteTree(tree); err == nil {
+			t.Errorf("expected error for tree: %s", pretty.Sprint(tree))
+		}
+	}
+	if _, err := rp.WriteTree(valid); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDirRepo_CheckCommits(t *testing.T) {
+	rp := tmpDirRepo()
+	treeID, err := rp.WriteTree(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var (
+		missingTree   = Commit{Tree: MustID("0123")}
+		missingParent = Commit{Tree: treeID, Parents: []ID{MustID("4567")}}
+	)
+	if _, err := rp.WriteCommit(missingTree); err != nil {
+		t.Fatalf("check should be off by default: %s", err)
+	}
+	rp.CheckCommits = true
+	for _, commit := range []Commit{missingTree, missingParent} {
+		if _, err := rp.WriteCommit(commit); err == nil {
+			t.Errorf("expected error for commit: %#v", commit)
+		}
+	}
+	root, err := rp.WriteCommit(Commit{Tree: treeID})
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := rp.WriteCommit(Commit{Tree: treeID, Parents: []ID{root}}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDirRepo_HeadFile(t *testing.T) {
+	var (
+		a     = tmpDirRepo()
+		dir   = filepath.Dir(a.obj)
+		b     = NewDirRepo(dir)
+		bHead = filepath.Join(dir, "heads", "b")
+	)
+	b.HeadFile = bHead
+	if err := b.Init(); err != nil {
+		t.Fatal(err)
+	}
+	aID := testCommitSet(t, a, []string{"foo"}, "a")
+	bID := testCommitSet(t, b, []string{"foo"}, "b")
+	if head, err := a.Head(); err != nil {
+		t.Fatal(err)
+	} else if !head.Equal(aID) {
+		t.Fatalf("bad head for a: got=%s want=%s", head, aID)
+	} else if head, err := b.Head(); err != nil {
+		t.Fatal(err)
+	} else if !head.Equal(bID) {
+		t.Fatalf("bad head for b: got=%s want=%s", head, bID)
+	} else if data, err := ioutil.ReadFile(bHead); err != nil {
+		t.Fatal(err)
+	} else if string(data) != bID.String() {
+		t.Fatalf("bad head file: %q", data)
+	} else if _, err := b.Commit(aID); err != nil {
+		t.Fatalf("objects should be shared: %s", err)
+	}
+	c := NewDirRepo(dir)
+	c.HeadFile = filepath.Join(dir, "format")
+	if err := c.Init(); err == nil {
+		t.Fatal("expected error for conflicting head file")
+	}
+}
+
+func TestDirRepo_WriteHead_Atomic(t *testing.T) {
+	rp := tmpDirRepo()
+	want := MustID("0cd5a7d8dc5a48bb59c0205146e4aac675dfe74a")
+	if err := rp.WriteHead(want); err != nil {
+		t.Fatal(err)
+	}
+	// Simulate a write that is interrupted after a few bytes.
+	r := io.MultiReader(strings.NewReader("054f"), &errReader{errors.New("interrupted")})
+	if err := rp.writeFile(rp.HeadFile, r); err == nil {
+		t.Fatal("expected error")
+	} else if head, err := rp.Head(); err != nil {
+		t.Fatal(err)
+	} else if !head.Equal(want) {
+		t.Fatalf("bad head: got=%s want=%s", head, want)
+	} else if files, err := filepath.Glob(filepath.Join(filepath.Dir(rp.HeadFile), tmpFilePrefix+"*")); err != nil {
+		t.Fatal(err)
+	} else if len(files) != 0 {
+		t.Fatalf("temporary files left behind: %d", len(files))
+	}
+}
+
+type errReader struct {
+	err error
+}
+
+func (e *errReader) Read(p []byte) (int, error) {
+	return 0, e.err
+}
+
+func TestExists(t *testing.T) {
+	for name, rp := range map[string]Repo{"dir": tmpRepo(), "mem": NewMemRepo()} {
+		id, err := rp.WriteBlob(strings.NewReader("Hello"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := rp.Exists(id); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		} else if !ok {
+			t.Fatalf("%s: expected blob to exist", name)
+		}
+		if ok, err := rp.Exists(MustID("0123456789")); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		} else if ok {
+			t.Fatalf("%s: expected missing object to not exist", name)
+		}
+	}
+}
+
+func TestDirRepo_Objects(t *testing.T) {
+	rp := tmpDirRepo()
+	for _, val := range []string{"a", "b", "c"} {
+		testCommitSet(t, rp, []string{"foo", val}, val)
+	}
+	head, err := rp.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []string
+	if err := walkReachable(rp, []ID{head}, func(id ID, _ Kind) error {
+		want = append(want, id.String())
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	id, err := rp.WriteBlob(strings.NewReader("unreferenced"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, id.String())
+	sort.Strings(want)
+	junk := []string{
+		filepath.Join(rp.obj, "README"),
+		filepath.Join(rp.obj, "zz", "not-hex"),
+		filepath.Join(rp.obj, "abc", "0123"),
+	}
+	for _, path := range junk {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		} else if err := ioutil.WriteFile(path, nil, 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids, err := rp.Objects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, id := range ids {
+		got = append(got, id.String())
+	}
+	if diff := pretty.Compare(got, want); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestDirRepo_Hash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rp := NewDirRepo(dir)
+	rp.Hash = crypto.SHA256
+	if err := rp.Init(); err != nil {
+		t.Fatal(err)
+	}
+	id, err := rp.WriteBlob(strings.NewReader("Hello"))
+	if err != nil {
+		t.Fatal(err)
+	} else if want := MustID("3e0e4a4850c3043bed5f08441ae2b0bb3394e4ae1e30a7adced4b63d2bb54d84"); !id.Equal(want) {
+		t.Fatalf("bad id: got=%s want=%s", id, want)
+	}
+	// Existing repos are opened without Init.
+	opened := NewDirRepo(dir)
+	if opened.Hash != crypto.SHA256 {
+		t.Fatalf("bad hash: %s", opened.Hash)
+	}
+	testBlob(t, opened, []byte("Hello"), id)
+	reopened := NewDirRepo(dir)
+	if err := reopened.Init(); err != nil {
+		t.Fatal(err)
+	} else if reopened.Hash != crypto.SHA256 {
+		t.Fatalf("bad hash: %s", reopened.Hash)
+	}
+	testBlob(t, reopened, []byte("Hello"), id)
+	mismatch := NewDirRepo(dir)
+	mismatch.Hash = crypto.SHA512
+	if err := mismatch.Init(); err == nil {
+		t.Fatal("expected hash mismatch error")
+	}
+	// Repos without a recorded hash predate the option and use sha1.
+	legacy := tmpDirRepo()
+	if err := os.Remove(legacy.hash); err != nil {
+		t.Fatal(err)
+	}
+	legacy.Hash = crypto.SHA256
+	if err := legacy.Init(); err == nil {
+		t.Fatal("expected hash mismatch error for legacy repo")
+	}
+}
+
+func TestDirRepo_Resolve(t *testing.T) {
+	rp := tmpDirRepo()
+	var ids []ID
+	for _, val := range []string{"Hello", "World"} {
+		id, err := rp.WriteBlob(strings.NewReader(val))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	for _, id := range ids {
+		if got, err := rp.Resolve(id.String()[:6]); err != nil {
+			t.Fatal(err)
+		} else if !got.Equal(id) {
+			t.Fatalf("bad id: got=%s want=%s", got, id)
+		} else if got, err := rp.Resolve(strings.ToUpper(id.String())); err != nil {
+			t.Fatal(err)
+		} else if !got.Equal(id) {
+			t.Fatalf("bad id: got=%s want=%s", got, id)
+		}
+	}
+	// Add an object sharing the prefix "0cd5" with the id of "Hello".
+	other := filepath.Join(rp.obj, "0c", "d5ffffffffffffffffffffffffffffffffffff")
+	if err := ioutil.WriteFile(other, nil, 0666); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rp.Resolve("0cd5"); err == nil || !strings.Contains(err.Error(), "ambiguous") {
+		t.Fatalf("expected ambiguous prefix error, got: %v", err)
+	} else if got, err := rp.Resolve("0cd5a"); err != nil {
+		t.Fatal(err)
+	} else if !got.Equal(ids[0]) {
+		t.Fatalf("bad id: got=%s want=%s", got, ids[0])
+	}
+	if _, err := rp.Resolve("ffff"); !IsNotFound(err) {
+		t.Fatalf("expected not found error, got: %v", err)
+	}
+	for _, prefix := range []string{"", "0cd", "xyz0"} {
+		if _, err := rp.Resolve(prefix); err == nil || IsNotFound(err) {
+			t.Fatalf("expected error for prefix %q, got: %v", prefix, err)
+		}
+	}
+}
+
+func TestDirRepo_NewBlobWriter(t *testing.T) {
+	rp := tmpDirRepo()
+	bw, err := rp.NewBlobWriter()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"Hel", "lo"} {
+		if _, err := io.WriteString(bw, s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if bw.ID() != nil {
+		t.Fatal("expected nil id before Close")
+	} else if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := MustID("0cd5a7d8dc5a48bb59c0205146e4aac675dfe74a")
+	if got := bw.ID(); !got.Equal(want) {
+		t.Fatalf("bad id: got=%s want=%s", got, want)
+	}
+	testBlob(t, rp, []byte("Hello"), want)
+
+	bw, err = rp.NewBlobWriter()
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := io.WriteString(bw, "World"); err != nil {
+		t.Fatal(err)
+	} else if err := bw.Abort(); err != nil {
+		t.Fatal(err)
+	} else if bw.ID() != nil {
+		t.Fatal("expected nil id after Abort")
+	} else if ok, err := rp.Exists(MustID("054f22c17948d775ac4b327c7987c7acff4b8d64")); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("aborted blob was stored")
+	} else if files, err := ioutil.ReadDir(rp.tmp); err != nil {
+		t.Fatal(err)
+	} else if len(files) != 0 {
+		t.Fatalf("temp files left behind: %d", len(files))
+	}
+}
+
+func TestDirRepo_ConcurrentWrites(t *testing.T) {
+	rp := tmpDirRepo()
+	const workers = 50
+	var (
+		wg   sync.WaitGroup
+		ids  = make([]ID, workers)
+		errs = make([]error, workers)
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Even workers write the same blob, odd workers distinct ones.
+			val := "same"
+			if i%2 == 1 {
+				val = fmt.Sprintf("blob %d", i)
+			}
+			ids[i], errs[i] = rp.WriteBlob(strings.NewReader(val))
+		}(i)
+	}
+	wg.Wait()
+	for i := 0; i < workers; i++ {
+		val := "same"
+		if i%2 == 1 {
+			val = fmt.Sprintf("blob %d", i)
+		}
+		if errs[i] != nil {
+			t.Fatalf("worker %d: %s", i, errs[i])
+		}
+		testBlob(t, rp, []byte(val), ids[i])
+	}
+	if files, err := ioutil.ReadDir(rp.tmp); err != nil {
+		t.Fatal(err)
+	} else if len(files) != 0 {
+		t.Fatalf("temp files left behind: %d", len(files))
+	}
+}
+
+func TestDirRepo_TreeEntries(t *testing.T) {
+	rp := tmpDirRepo()
+	tree := Tree{
+		{Kind: KindBlob, Name: "b", ID: MustID("1234")},
+		{Kind: KindBlob, Name: "a", ID: MustID("5678")},
+	}
+	id, err := rp.WriteTree(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got Tree
+	if err := rp.TreeEntries(id, func(entry *Entry) error {
+		got = append(got, entry)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	} else if diff := pretty.Compare(got, tree); diff != "" {
+		t.Fatalf("%s", diff)
+	}
+}
+
+func TestDirRepo_WriteBlobFile(t *testing.T) {
+	rp := tmpDirRepo()
+	path := filepath.Join(rp.tmp, "file")
+	data := strings.Repeat("Hello World\n", 1000)
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	id, err := rp.WriteBlobFile(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if want, err := NewMemRepo().WriteBlob(strings.NewReader(data)); err != nil {
+		t.Fatal(err)
+	} else if !id.Equal(want) {
+		t.Fatalf("got=%s want=%s", id, want)
+	}
+	if r, err := rp.Blob(id); err != nil {
+		t.Fatal(err)
+	} else if got, err := ioutil.ReadAll(r); err != nil {
+		t.Fatal(err)
+	} else if string(got) != data {
+		t.Fatal("bad blob data")
+	}
+	if again, err := rp.WriteBlobFile(path); err != nil {
+		t.Fatal(err)
+	} else if !again.Equal(id) {
+		t.Fatalf("got=%s want=%s", again, id)
+	}
+	if _, err := rp.WriteBlobFile(filepath.Join(rp.tmp, "missing")); err == nil {
+		t.Fatal("expected error for missing file")
+	}
+}
+
+func TestDirRepo_Corrupt(t *testing.T) {
+	rp := tmpDirRepo()
+	blobID, err := rp.WriteBlob(strings.NewReader("Hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	treeID, err := rp.WriteTree(Tree{{Kind: KindBlob, Name: "hello", ID: blobID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitID, err := rp.WriteCommit(Commit{Tree: treeID, Message: []byte("hi")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	corrupt := func(id ID, fn func([]byte) []byte) {
+		data, err := ioutil.ReadFile(rp.path(id))
+		if err != nil {
+			t.Fatal(err)
+		} else if err := ioutil.WriteFile(rp.path(id), fn(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := rp.Tree(MustID("0123456789")); err == nil || IsCorrupt(err) {
+		t.Fatalf("expected not found error, got: %v", err)
+	}
+
+	corrupt(blobID, func(data []byte) []byte { return []byte("blob\nJello") })
+	if r, err := rp.Blob(blobID); err != nil {
+		t.Fatal(err)
+	} else if _, err := ioutil.ReadAll(r); !IsCorrupt(err) {
+		t.Fatalf("expected corrupt error for changed blob, got: %v", err)
+	}
+	corrupt(treeID, func(data []byte) []byte { return data[:len(data)-3] })
+	if _, err := rp.Tree(treeID); !IsCorrupt(err) {
+		t.Fatalf("expected corrupt error for truncated tree, got: %v", err)
+	}
+	corrupt(commitID, func(data []byte) []byte { return []byte("tree\n") })
+	if _, err := rp.Commit(commitID); !IsCorrupt(err) {
+		t.Fatalf("expected corrupt error for bad commit, got: %v", err)
+	} else if !err.(*CorruptError).ID.Equal(commitID) {
+		t.Fatalf("bad id in error: %v", err)
+	}
+}
+
+func TestDirRepo_Corrupt_Truncated(t *testing.T) {
+	rp := tmpDirRepo()
+	// Without verification, truncated files reach the decoder.
+	rp.Verify = false
+	blobID, err := rp.WriteBlob(strings.NewReader("Hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	treeID, err := rp.WriteTree(Tree{{Kind: KindBlob, Name: "hello", ID: blobID}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitID, err := rp.WriteCommit(Commit{Tree: treeID, Message: []byte("hi")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rp.Blob(treeID); err == nil || IsCorrupt(err) {
+		t.Fatalf("expected kind error for reading a tree as a blob, got: %v", err)
+	} else if ke, ok := err.(*KindError); !ok || ke.Got != KindTree || ke.Want != KindBlob {
+		t.Fatalf("bad kind error: %#v", err)
+	} else if _, err := rp.Tree(commitID); err == nil || IsCorrupt(err) {
+		t.Fatalf("expected kind error for reading a commit as a tree, got: %v", err)
+	}
+	for _, id := range []ID{treeID, commitID} {
+		data, err := ioutil.ReadFile(rp.path(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, n := range []int{len(data) - 4, 12, 8, 3} {
+			if err := ioutil.WriteFile(rp.path(id), data[:n], 0600); err != nil {
+				t.Fatal(err)
+			}
+			if id.Equal(treeID) {
+				_, err = rp.Tree(id)
+			} else {
+				_, err = rp.Commit(id)
+			}
+			if !IsCorrupt(err) {
+				t.Fatalf("expected corrupt error for %q, got: %v", data[:n], err)
+			}
+		}
+	}
+}
+
+func TestID_Short(t *testing.T) {
+	for _, test := range []struct {
+		ID   ID
+		N    int
+		Want string
+	}{
+		{ID: MustID("0cd5a7d8dc5a48bb59c0205146e4aac675dfe74a"), N: 7, Want: "0cd5a7d"},
+		{ID: MustID("0cd5a7d8dc5a48bb59c0205146e4aac675dfe74a"), N: 12, Want: "0cd5a7d8dc5a"},
+		{ID: MustID("0cd5a7d8dc5a48bb59c0205146e4aac675dfe74a"), N: 100, Want: "0cd5a7d8dc5a48bb59c0205146e4aac675dfe74a"},
+		{ID: MustID("0cd5"), N: 7, Want: "0cd5"},
+		{ID: MustID("0cd5"), N: -1, Want: ""},
+		{ID: nil, N: 7, Want: ""},
+	} {
+		if got := test.ID.ShortN(test.N); got != test.Want {
+			t.Errorf("ShortN(%d) of %q: got=%q want=%q", test.N, test.ID, got, test.Want)
+		} else if test.N == 7 && test.ID.Short() != test.Want {
+			t.Errorf("Short of %q: got=%q want=%q", test.ID, test.ID.Short(), test.Want)
+		}
+	}
+}
+
+func TestIDs(t *testing.T) {
+	if got := MustID("01").Compare(MustID("0100")); got != -1 {
+		t.Fatalf("bad compare for prefix: %d", got)
+	} else if got := MustID("ff").Compare(MustID("0100")); got != 1 {
+		t.Fatalf("bad compare: %d", got)
+	} else if got := MustID("0100").Compare(MustID("0100")); got != 0 {
+		t.Fatalf("bad compare for equal ids: %d", got)
+	}
+	want := IDs{nil, MustID("01"), MustID("0100"), MustID("02"), MustID("ff00")}
+	inputs := []IDs{
+		{MustID("ff00"), MustID("02"), MustID("0100"), MustID("01"), nil},
+		{MustID("0100"), nil, MustID("ff00"), MustID("01"), MustID("02")},
+	}
+	for _, ids := range inputs {
+		sort.Sort(ids)
+		if diff := pretty.Compare(ids, want); diff != "" {
+			t.Fatalf("%s", diff)
+		}
+	}
+	dups := IDs{MustID("02"), MustID("01"), MustID("0100"), MustID("02"), MustID("01"), MustID("ff00"), nil, MustID("02"), nil}
+	if diff := pretty.Compare(dups.Dedup(), want); diff != "" {
+		t.Fatalf("%s", diff)
+	} else if got := (IDs{}).Dedup(); len(got) != 0 {
+		t.Fatalf("bad dedup of empty ids: %v", got)
+	}
+}
+
+func TestDirRepo_MaxBlobSize(t *testing.T) {
+	rp := tmpDirRepo()
+	rp.MaxBlobSize = 10
+	if _, err := rp.WriteBlob(strings.NewReader(strings.Repeat("a", 10))); err != nil {
+		t.Fatalf("expected blob at the limit to be written, got: %v", err)
+	}
+	before, err := rp.Objects()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rp.WriteBlob(strings.NewReader(strings.Repeat("a", 11))); err == nil || !strings.Contains(err.Error(), "MaxBlobSize") {
+		t.Fatalf("expected MaxBlobSize error, got: %v", err)
+	} else if after, err := rp.Objects(); err != nil {
+		t.Fatal(err)
+	} else if len(after) != len(before) {
+		t.Fatal("blob over the limit was stored")
+	} else if tmp, err := ioutil.ReadDir(rp.tmp); err != nil {
+		t.Fatal(err)
+	} else if len(tmp) != 0 {
+		t.Fatalf("temp files were left behind: %d", len(tmp))
+	}
+	rp.MaxBlobSize = 0
+	if _, err := rp.WriteBlob(strings.NewReader(strings.Repeat("a", 11))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDirRepo_Verify(t *testing.T) {
+	for _, mmap := range []bool{false, true} {
+		rp := tmpDirRepo()
+		rp.Mmap = mmap
+		id, err := rp.WriteBlob(strings.NewReader("Hello"))
+		if err != nil {
+			t.Fatal(err)
+		} else if err := ioutil.WriteFile(rp.path(id), []byte("blob\nJello"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		read := func() ([]byte, error) {
+			r, err := rp.Blob(id)
+			if err != nil {
+				return nil, err
+			}
+			defer r.Close()
+			return ioutil.ReadAll(r)
+		}
+		rp.Verify = false
+		if data, err := read(); err != nil {
+			t.Fatalf("mmap=%t: unexpected error with verification disabled: %s", mmap, err)
+		} else if string(data) != "Jello" {
+			t.Fatalf("mmap=%t: got=%q want=%q", mmap, data, "Jello")
+		} else if errs := rp.Fsck(); len(errs) != 1 || !IsCorrupt(errs[0]) {
+			t.Fatalf("mmap=%t: expected fsck to report the corrupt object, got: %v", mmap, errs)
+		}
+		rp.Verify = true
+		if _, err := read(); !IsCorrupt(err) {
+			t.Fatalf("mmap=%t: expected corrupt error with verification enabled, got: %v", mmap, err)
+		}
+
+		// Truncated objects fail to decode, even without verification.
+		rp.Verify = false
+		treeID, err := rp.WriteTree(Tree{{Kind: KindBlob, Name: "hello", ID: id}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(rp.path(treeID))
+		if err != nil {
+			t.Fatal(err)
+		} else if err := ioutil.WriteFile(rp.path(treeID), data[:len(data)-3], 0600); err != nil {
+			t.Fatal(err)
+		} else if _, err := rp.Tree(treeID); err == nil {
+			t.Fatalf("mmap=%t: expected error for truncated tree", mmap)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package can
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// NewShardedRepo returns a Repo that distributes objects over the given
+// shards. pick returns the index of the shard for the object with the given
+// id, and must always return the same index for the same id. Reading or
+// writing an object fails if pick returns an index out of range for it. The
+// head and refs are stored on the first shard.
+//
+// Object IDs are computed before writing like SetDryRun does, i.e. with the
+// Format and Hash of the first shard if it is a *DirRepo, and with the default
+// format and sha1 otherwise. All shards must use the same format and hash,
+// writes fail if a shard stores an object under another id. Blobs are
+// buffered in memory to compute their ID.
+func NewShardedRepo(shards []Repo, pick func(id ID) int) Repo {
+	return &shardedRepo{shards: shards, pick: pick}
+}
+
+// Check Repo interface compliance
+var _ = Repo(&shardedRepo{})
+
+type shardedRepo struct {
+	shards []Repo
+	pick   func(id ID) int
+}
+
+func (s *shardedRepo) Head() (ID, error) {
+	return s.shards[0].Head()
+}
+
+func (s *shardedRepo) WriteHead(id ID) error {
+	return s.shards[0].WriteHead(id)
+}
+
+func (s *shardedRepo) Ref(name string) (ID, error) {
+	return s.shards[0].Ref(name)
+}
+
+func (s *shardedRepo) WriteRef(name string, id ID) error {
+	return s.shards[0].WriteRef(name, id)
+}
+
+func (s *shardedRepo) Refs() (map[string]ID, error) {
+	return s.shards[0].Refs()
+}
+
+func (s *shardedRepo) Blob(id ID) (io.ReadCloser, error) {
+	shard, err := s.shard(id)
+	if err != nil {
+		return nil, err
+	}
+	return shard.Blob(id)
+}
+
+func (s *shardedRepo) WriteBlob(r io.Reader) (ID, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	id, err := s.ids().WriteBlob(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	shard, err := s.shard(id)
+	if err != nil {
+		return nil, err
+	}
+	return s.check(id)(shard.WriteBlob(bytes.NewReader(data)))
+}
+
+func (s *shardedRepo) Tree(id ID) (Tree, error) {
+	shard, err := s.shard(id)
+	if err != nil {
+		return nil, err
+	}
+	return shard.Tree(id)
+}
+
+func (s *shardedRepo) WriteTree(t Tree) (ID, error) {
+	id, err := s.ids().WriteTree(t)
+	if err != nil {
+		return nil, err
+	}
+	shard, err := s.shard(id)
+	if err != nil {
+		return nil, err
+	}
+	return s.check(id)(shard.WriteTree(t))
+}
+
+func (s *shardedRepo) Commit(id ID) (Commit, error) {
+	shard, err := s.shard(id)
+	if err != nil {
+		return Commit{}, err
+	}
+	return shard.Commit(id)
+}
+
+func (s *shardedRepo) WriteCommit(c Commit) (ID, error) {
+	id, err := s.ids().WriteCommit(c)
+	if err != nil {
+		return nil, err
+	}
+	shard, err := s.shard(id)
+	if err != nil {
+		return nil, err
+	}
+	return s.check(id)(shard.WriteCommit(c))
+}
+
+func (s *shardedRepo) Exists(id ID) (bool, error) {
+	shard, err := s.shard(id)
+	if err != nil {
+		return false, err
+	}
+	return shard.Exists(id)
+}
+
+// ids returns a Repo whose writes only compute the id an object would have.
+// It is created on every write so changes to the Format or Hash of the first
+// shard are picked up.
+func (s *shardedRepo) ids() Repo {
+	return newDryRunRepo(s.shards[0])
+}
+
+// shard returns the shard responsible for the given id, or an error if pick
+// returns an index out of range.
+func (s *shardedRepo) shard(id ID) (Repo, error) {
+	i := s.pick(id)
+	if i < 0 || i >= len(s.shards) {
+		return nil, fmt.Errorf("bad shard index for %s: %d of %d shards", id, i, len(s.shards))
+	}
+	return s.shards[i], nil
+}
+
+// check returns a function that passes through the results of a shard write,
+// or returns an error if the shard stored the object under another id than
+// the one that was used to pick the shard.
+func (s *shardedRepo) check(want ID) func(ID, error) (ID, error) {
+	return func(got ID, err error) (ID, error) {
+		if err != nil {
+			return nil, err
+		} else if !got.Equal(want) {
+			return nil, fmt.Errorf("shard id mismatch: got=%s want=%s", got, want)
+		}
+		return got, nil
+	}
+}
@@ -0,0 +1,94 @@
+package can
+
+import (
+	"crypto"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestShardedRepo(t *testing.T) {
+	var (
+		shards = []Repo{tmpRepo(), tmpRepo(), tmpRepo()}
+		pick   = func(id ID) int { return int(id[0]) % len(shards) }
+		rp     = NewShardedRepo(shards, pick)
+		ids    []ID
+	)
+	for _, val := range []string{"a", "b", "c", "d", "e", "f"} {
+		ids = append(ids, testCommitSet(t, rp, []string{"foo", val}, val))
+	}
+	for _, id := range ids {
+		for i, shard := range shards {
+			_, err := shard.Commit(id)
+			if i == pick(id) && err != nil {
+				t.Fatalf("commit %s missing from shard %d: %s", id, i, err)
+			} else if i != pick(id) && err == nil {
+				t.Fatalf("commit %s unexpectedly found on shard %d", id, i)
+			}
+		}
+	}
+	s := NewSugar(rp)
+	for _, val := range []string{"a", "f"} {
+		if rc, err := s.Get([]string{"foo", val}); err != nil {
+			t.Fatal(err)
+		} else {
+			rc.Close()
+		}
+	}
+	if head, err := shards[0].Head(); err != nil {
+		t.Fatal(err)
+	} else if !head.Equal(ids[len(ids)-1]) {
+		t.Fatalf("bad head: got=%s want=%s", head, ids[len(ids)-1])
+	}
+	blobID, err := rp.WriteBlob(strings.NewReader("Hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testBlob(t, shards[pick(blobID)], []byte("Hello"), blobID)
+}
+
+func TestShardedRepo_Hash(t *testing.T) {
+	var shards []Repo
+	for i := 0; i < 2; i++ {
+		dir, err := ioutil.TempDir("", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		shard := NewDirRepo(dir)
+		shard.Format = NewJSONFormat()
+		shard.Hash = crypto.SHA256
+		if err := shard.Init(); err != nil {
+			t.Fatal(err)
+		}
+		shards = append(shards, shard)
+	}
+	rp := NewShardedRepo(shards, func(id ID) int { return int(id[0]) % len(shards) })
+	for _, val := range []string{"a", "b", "c", "d"} {
+		if id := testCommitSet(t, rp, []string{"foo", val}, val); len(id) != crypto.SHA256.Size() {
+			t.Fatalf("bad id length: %s", id)
+		}
+	}
+	// Shards that disagree with the first one are detected on write.
+	shards[1].(*DirRepo).Format = NewDefaultFormat()
+	var failed bool
+	for _, val := range []string{"a", "b", "c", "d"} {
+		if _, err := rp.WriteBlob(strings.NewReader(val)); err != nil {
+			failed = true
+		}
+	}
+	if !failed {
+		t.Fatal("expected shard id mismatch")
+	}
+}
+
+func TestShardedRepo_BadPick(t *testing.T) {
+	for _, i := range []int{-1, 2} {
+		i := i
+		rp := NewShardedRepo([]Repo{tmpRepo(), tmpRepo()}, func(ID) int { return i })
+		if _, err := rp.WriteBlob(strings.NewReader("a")); err == nil {
+			t.Fatalf("%d: expected error for bad shard index", i)
+		} else if _, err := rp.Exists(MustID("0123")); err == nil {
+			t.Fatalf("%d: expected error for bad shard index", i)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package can
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// SignCommit sets the Signature of c to the result of calling sign with the
+// canonical encoding of c. The canonical encoding is the encoding of c by the
+// default format without a signature, so it does not depend on the Format of
+// the repo the commit is stored in.
+func SignCommit(c *Commit, sign func(canonical []byte) ([]byte, error)) error {
+	canonical, err := canonicalCommit(*c)
+	if err != nil {
+		return err
+	}
+	sig, err := sign(canonical)
+	if err != nil {
+		return err
+	}
+	c.Signature = sig
+	return nil
+}
+
+// VerifyCommit calls verify with the canonical encoding and the signature of
+// the commit with the given id, and returns its error. An error is returned
+// without calling verify if the commit is not signed.
+func VerifyCommit(rp Repo, id ID, verify func(canonical, sig []byte) error) error {
+	commit, err := rp.Commit(id)
+	if err != nil {
+		return err
+	} else if len(commit.Signature) == 0 {
+		return fmt.Errorf("commit %s is not signed", id)
+	}
+	canonical, err := canonicalCommit(commit)
+	if err != nil {
+		return err
+	}
+	return verify(canonical, commit.Signature)
+}
+
+// canonicalCommit returns the bytes of c that are signed, see SignCommit.
+func canonicalCommit(c Commit) ([]byte, error) {
+	c.Signature = nil
+	buf := &bytes.Buffer{}
+	if err := NewDefaultFormat().EncodeCommit(buf, c); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,62 @@
+package can
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestVerifyCommit(t *testing.T) {
+	key := []byte("secret")
+	sign := func(canonical []byte) ([]byte, error) {
+		mac := hmac.New(sha256.New, key)
+		mac.Write(canonical)
+		return mac.Sum(nil), nil
+	}
+	errBadSignature := errors.New("bad signature")
+	verify := func(canonical, sig []byte) error {
+		if want, _ := sign(canonical); !hmac.Equal(sig, want) {
+			return errBadSignature
+		}
+		return nil
+	}
+	rp := tmpRepo()
+	treeID, err := rp.WriteTree(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := Commit{Tree: treeID, Time: time.Unix(1234, 0), Message: []byte("signed")}
+	if err := SignCommit(&commit, sign); err != nil {
+		t.Fatal(err)
+	} else if len(commit.Signature) == 0 {
+		t.Fatal("commit was not signed")
+	}
+	good, err := rp.WriteCommit(commit)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := VerifyCommit(rp, good, verify); err != nil {
+		t.Fatalf("expected good signature, got: %v", err)
+	}
+
+	tampered := commit
+	tampered.Message = []byte("tampered")
+	forged := commit
+	forged.Signature = append([]byte(nil), commit.Signature...)
+	forged.Signature[0] ^= 0xff
+	for _, c := range []Commit{tampered, forged} {
+		if id, err := rp.WriteCommit(c); err != nil {
+			t.Fatal(err)
+		} else if err := VerifyCommit(rp, id, verify); err != errBadSignature {
+			t.Fatalf("expected %v, got: %v", errBadSignature, err)
+		}
+	}
+
+	commit.Signature = nil
+	if id, err := rp.WriteCommit(commit); err != nil {
+		t.Fatal(err)
+	} else if err := VerifyCommit(rp, id, verify); err == nil {
+		t.Fatal("expected error for unsigned commit")
+	}
+}
@@ -0,0 +1,80 @@
+package can
+
+import (
+	"os"
+	"sort"
+)
+
+// statsLargestBlobs is the number of blobs reported in RepoStats.LargestBlobs.
+const statsLargestBlobs = 10
+
+// RepoStats holds statistics about the objects stored in a repo.
+type RepoStats struct {
+	// Objects is the number of distinct objects.
+	Objects int
+	// Bytes is the total size of all object files.
+	Bytes int64
+	// Kinds holds the statistics per object kind.
+	Kinds map[Kind]KindStats
+	// LargestBlobs holds the largest blobs, largest first.
+	LargestBlobs []ObjectSize
+}
+
+// KindStats holds statistics about the objects of a kind.
+type KindStats struct {
+	Objects int
+	Bytes   int64
+}
+
+// ObjectSize holds the size of the object file with the given id.
+type ObjectSize struct {
+	ID   ID
+	Size int64
+}
+
+// Stats returns statistics about all objects stored in the repo, including
+// unreachable ones. Sizes are the sizes of the object files, and therefore
+// depend on the Format.
+func (d *DirRepo) Stats() (RepoStats, error) {
+	stats := RepoStats{Kinds: map[Kind]KindStats{}}
+	err := d.WalkObjects(func(id ID) error {
+		info, err := os.Stat(d.path(id))
+		if err != nil {
+			return err
+		}
+		kind, err := objectKind(d, id)
+		if err != nil {
+			return err
+		}
+		size := info.Size()
+		stats.Objects++
+		stats.Bytes += size
+		ks := stats.Kinds[kind]
+		ks.Objects++
+		ks.Bytes += size
+		stats.Kinds[kind] = ks
+		if kind == KindBlob {
+			stats.LargestBlobs = addLargest(stats.LargestBlobs, ObjectSize{ID: id, Size: size})
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// addLargest adds o to the given objects, which are sorted by size, largest
+// first, and keeps the statsLargestBlobs largest ones.
+func addLargest(objects []ObjectSize, o ObjectSize) []ObjectSize {
+	i := sort.Search(len(objects), func(i int) bool {
+		return objects[i].Size < o.Size
+	})
+	if i >= statsLargestBlobs {
+		return objects
+	}
+	objects = append(objects, ObjectSize{})
+	copy(objects[i+1:], objects[i:])
+	objects[i] = o
+	if len(objects) > statsLargestBlobs {
+		objects = objects[:statsLargestBlobs]
+	}
+	return objects
+}
@@ -0,0 +1,68 @@
+package can
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestDirRepo_Stats(t *testing.T) {
+	rp := tmpDirRepo()
+	// Writing the same blob twice stores it once.
+	for i := 0; i < 2; i++ {
+		if _, err := rp.WriteBlob(strings.NewReader("Hello")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var want []ID
+	for i := 0; i < statsLargestBlobs+2; i++ {
+		id, err := rp.WriteBlob(strings.NewReader(strings.Repeat("x", 100+i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		want = append([]ID{id}, want...)
+	}
+	want = want[:statsLargestBlobs]
+	treeID, err := rp.WriteTree(Tree{{Kind: KindBlob, Name: "hi", ID: want[0]}})
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := rp.WriteCommit(Commit{Tree: treeID}); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := rp.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobs := statsLargestBlobs + 3
+	if stats.Objects != blobs+2 {
+		t.Fatalf("bad object count: %d", stats.Objects)
+	} else if got := stats.Kinds[KindBlob].Objects; got != blobs {
+		t.Fatalf("bad blob count: %d", got)
+	} else if got := stats.Kinds[KindTree].Objects; got != 1 {
+		t.Fatalf("bad tree count: %d", got)
+	} else if got := stats.Kinds[KindCommit].Objects; got != 1 {
+		t.Fatalf("bad commit count: %d", got)
+	}
+	// Blobs are encoded as "blob\n" followed by their data.
+	blobBytes := int64(len(blobPrefix)*blobs + len("Hello"))
+	for i := 0; i < statsLargestBlobs+2; i++ {
+		blobBytes += int64(100 + i)
+	}
+	if got := stats.Kinds[KindBlob].Bytes; got != blobBytes {
+		t.Fatalf("bad blob bytes: got=%d want=%d", got, blobBytes)
+	}
+	var total int64
+	for _, ks := range stats.Kinds {
+		total += ks.Bytes
+	}
+	if stats.Bytes != total {
+		t.Fatalf("bad total bytes: got=%d want=%d", stats.Bytes, total)
+	}
+	var got []string
+	for _, o := range stats.LargestBlobs {
+		got = append(got, o.ID.String())
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("bad largest blobs: got=%v want=%v", got, want)
+	}
+}
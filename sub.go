@@ -0,0 +1,132 @@
+package can
+
+import "io"
+
+// Sub returns a Sugar that prepends the given prefix to the keys of all
+// operations, so the tree below the prefix appears as the root tree. Tree and
+// commit ids, as well as the head, are shared with s. Trees left empty by
+// Delete or Move are removed up to the root, including the prefix.
+func (s *sugar) Sub(prefix []string) Sugar {
+	return &subSugar{Sugar: s, prefix: append([]string(nil), prefix...)}
+}
+
+// subSugar implements Sub by rewriting the keys passed to Sugar.
+type subSugar struct {
+	Sugar
+	prefix []string
+}
+
+// Sub is part of the Sugar interface.
+func (s *subSugar) Sub(prefix []string) Sugar {
+	return &subSugar{Sugar: s.Sugar, prefix: s.key(prefix)}
+}
+
+// key returns key below the prefix of s. Empty keys remain empty, so they are
+// rejected like they are without the prefix.
+func (s *subSugar) key(key []string) []string {
+	if len(key) == 0 {
+		return nil
+	}
+	return append(append([]string(nil), s.prefix...), key...)
+}
+
+// Keys is part of the Sugar interface. The prefix of s is removed from the
+// returned keys.
+func (s *subSugar) Keys(treeID ID, prefix []string) (KeyIterator, error) {
+	it, err := s.Sugar.Keys(treeID, append(append([]string(nil), s.prefix...), prefix...))
+	if err != nil {
+		return nil, err
+	}
+	return &subKeyIterator{it: it, n: len(s.prefix)}, nil
+}
+
+// WalkKeys is part of the Sugar interface.
+func (s *subSugar) WalkKeys(treeID ID, prefix []string, fn func(key []string, blob ID) error) error {
+	it, err := s.Keys(treeID, prefix)
+	if err != nil {
+		return err
+	}
+	return walkKeys(it, fn)
+}
+
+// ListKeys is part of the Sugar interface.
+func (s *subSugar) ListKeys(treeID ID, prefix []string) ([][]string, error) {
+	it, err := s.Keys(treeID, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return listKeys(it)
+}
+
+// Get is part of the Sugar interface.
+func (s *subSugar) Get(key []string) (io.ReadCloser, error) {
+	return s.Sugar.Get(s.key(key))
+}
+
+// Open is part of the Sugar interface.
+func (s *subSugar) Open(key []string) (io.ReadCloser, int64, error) {
+	return s.Sugar.Open(s.key(key))
+}
+
+// GetAt is part of the Sugar interface.
+func (s *subSugar) GetAt(commitID ID, key []string) (io.ReadCloser, error) {
+	return s.Sugar.GetAt(commitID, s.key(key))
+}
+
+// Has is part of the Sugar interface.
+func (s *subSugar) Has(treeID ID, key []string) (bool, Kind, error) {
+	return s.Sugar.Has(treeID, s.key(key))
+}
+
+// Set is part of the Sugar interface.
+func (s *subSugar) Set(treeID ID, key []string, blob io.Reader) (ID, error) {
+	return s.Sugar.Set(treeID, s.key(key), blob)
+}
+
+// SetDryRun is part of the Sugar interface.
+func (s *subSugar) SetDryRun(treeID ID, key []string, blob io.Reader) (bool, ID, error) {
+	return s.Sugar.SetDryRun(treeID, s.key(key), blob)
+}
+
+// Delete is part of the Sugar interface.
+func (s *subSugar) Delete(treeID ID, key []string) (ID, error) {
+	return s.Sugar.Delete(treeID, s.key(key))
+}
+
+// Move is part of the Sugar interface.
+func (s *subSugar) Move(treeID ID, from, to []string) (ID, error) {
+	return s.Sugar.Move(treeID, s.key(from), s.key(to))
+}
+
+// SetStream is part of the Sugar interface.
+func (s *subSugar) SetStream(key []string, c *Commit) (io.WriteCloser, func() (ID, error), error) {
+	return s.Sugar.SetStream(s.key(key), c)
+}
+
+// ExportTar is part of the Sugar interface. Only the tree below the prefix of
+// s is exported.
+func (s *subSugar) ExportTar(commitID ID, w io.Writer) error {
+	// Sub always wraps the *sugar returned by NewSugar.
+	return s.Sugar.(*sugar).exportTar(commitID, s.prefix, w)
+}
+
+// Batch is part of the Sugar interface.
+func (s *subSugar) Batch() *Batch {
+	b := s.Sugar.Batch()
+	b.prefix = s.prefix
+	return b
+}
+
+// subKeyIterator removes the first n components of the keys returned by it.
+type subKeyIterator struct {
+	it KeyIterator
+	n  int
+}
+
+func (s *subKeyIterator) Next() ([]string, ID, error) {
+	key, id, err := s.it.Next()
+	if err != nil {
+		return nil, nil, err
+	}
+	return key[s.n:], id, nil
+}
@@ -0,0 +1,54 @@
+package can
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestSugar_Sub(t *testing.T) {
+	rp := tmpRepo()
+	s := NewSugar(rp)
+	sub := s.Sub([]string{"ns", "a"})
+	treeID, err := sub.Set(nil, []string{"x", "y"}, strings.NewReader("1"))
+	if err != nil {
+		t.Fatal(err)
+	} else if treeID, err = s.Set(treeID, []string{"ns", "b"}, strings.NewReader("2")); err != nil {
+		t.Fatal(err)
+	} else if commitID, err := rp.WriteCommit(Commit{Tree: treeID}); err != nil {
+		t.Fatal(err)
+	} else if err := rp.WriteHead(commitID); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		Sugar Sugar
+		Key   []string
+	}{
+		{Sugar: s, Key: []string{"ns", "a", "x", "y"}},
+		{Sugar: sub, Key: []string{"x", "y"}},
+		{Sugar: s.Sub([]string{"ns"}).Sub([]string{"a", "x"}), Key: []string{"y"}},
+	} {
+		rc, err := test.Sugar.Get(test.Key)
+		if err != nil {
+			t.Fatalf("%#v: %s", test.Key, err)
+		}
+		got, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		} else if string(got) != "1" {
+			t.Fatalf("%#v: got=%q want=%q", test.Key, got, "1")
+		}
+	}
+	if keys, err := sub.ListKeys(treeID, nil); err != nil {
+		t.Fatal(err)
+	} else if diff := pretty.Compare(keys, [][]string{{"x", "y"}}); diff != "" {
+		t.Fatal(diff)
+	} else if _, err := sub.Get(nil); err == nil {
+		t.Fatal("expected error for empty key")
+	} else if _, err := sub.Get([]string{"ns", "b"}); !IsNotFound(err) {
+		t.Fatalf("expected not found error outside of the prefix, got: %v", err)
+	}
+}
@@ -4,6 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
 )
 
 func NewSugar(rp Repo) Sugar {
@@ -14,8 +17,22 @@ type Sugar interface {
 	Repo
 	HeadCommit() (Commit, error)
 	Keys(treeID ID, prefix []string) (KeyIterator, error)
+	WalkKeys(treeID ID, prefix []string, fn func(key []string, blob ID) error) error
+	ListKeys(treeID ID, prefix []string) ([][]string, error)
 	Get(key []string) (io.ReadCloser, error)
+	Open(key []string) (io.ReadCloser, int64, error)
+	GetAt(commitID ID, key []string) (io.ReadCloser, error)
+	Has(treeID ID, key []string) (bool, Kind, error)
 	Set(treeID ID, key []string, blob io.Reader) (ID, error)
+	SetDryRun(treeID ID, key []string, blob io.Reader) (wouldChange bool, newRootEstimate ID, err error)
+	Delete(treeID ID, key []string) (ID, error)
+	Move(treeID ID, from, to []string) (ID, error)
+	Merge(base, ours, theirs ID) (ID, []Conflict, error)
+	Squash(from, to ID, msg []byte) (ID, error)
+	SetStream(key []string, c *Commit) (io.WriteCloser, func() (ID, error), error)
+	Batch() *Batch
+	Sub(prefix []string) Sugar
+	ExportTar(commitID ID, w io.Writer) error
 }
 
 type sugar struct {
@@ -31,15 +48,17 @@ func (s *sugar) HeadCommit() (Commit, error) {
 	}
 }
 
+// Keys returns an iterator over the keys of all blobs below the given prefix
+// of the tree with the given id. Keys are returned in ascending order,
+// comparing them component by component. Keys of KindRef entries are skipped.
+// A nil treeID is treated as an empty tree.
 func (s *sugar) Keys(treeID ID, prefix []string) (KeyIterator, error) {
-	var (
-		tree Tree
-		err  error
-	)
 	for _, name := range prefix {
-		if tree, err = s.Tree(treeID); err != nil {
+		if treeID == nil {
+			return nil, notFoundError(fmt.Sprintf("entry %q not found for prefix: %#v", name, prefix))
+		} else if tree, err := s.Tree(treeID); err != nil {
 			return nil, err
-		} else if entry := tree.Get(name); entry == nil {
+		} else if entry := sortedTree(tree).Get(name); entry == nil {
 			return nil, notFoundError(fmt.Sprintf("entry %q not found for prefix: %#v", name, prefix))
 		} else if entry.Kind != KindTree {
 			return nil, notFoundError(fmt.Sprintf("entry %q is %s for prefix: %#v", name, entry.Kind, prefix))
@@ -47,13 +66,72 @@ func (s *sugar) Keys(treeID ID, prefix []string) (KeyIterator, error) {
 			treeID = entry.ID
 		}
 	}
-	return &keyIterator{key: prefix, rp: s.Repo, stack: []Tree{tree}}, nil
+	var tree Tree
+	if treeID != nil {
+		var err error
+		if tree, err = s.Tree(treeID); err != nil {
+			return nil, err
+		}
+	}
+	key := append([]string(nil), prefix...)
+	return &keyIterator{key: key, rp: s.Repo, stack: []Tree{sortedTree(tree)}}, nil
+}
+
+// WalkKeys calls fn for every key returned by Keys, together with the id of
+// its blob, and stops at the first error returned by fn.
+func (s *sugar) WalkKeys(treeID ID, prefix []string, fn func(key []string, blob ID) error) error {
+	it, err := s.Keys(treeID, prefix)
+	if err != nil {
+		return err
+	}
+	return walkKeys(it, fn)
+}
+
+// walkKeys calls fn for every key returned by it, and stops at the first
+// error returned by fn.
+func walkKeys(it KeyIterator, fn func(key []string, blob ID) error) error {
+	for {
+		key, id, err := it.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		} else if err := fn(key, id); err != nil {
+			return err
+		}
+	}
+}
+
+// ListKeys returns all keys returned by Keys.
+func (s *sugar) ListKeys(treeID ID, prefix []string) ([][]string, error) {
+	it, err := s.Keys(treeID, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return listKeys(it)
+}
+
+// listKeys returns all keys returned by it.
+func listKeys(it KeyIterator) ([][]string, error) {
+	var keys [][]string
+	err := walkKeys(it, func(key []string, _ ID) error {
+		keys = append(keys, key)
+		return nil
+	})
+	return keys, err
 }
 
+// KeyIterator iterates over keys.
 type KeyIterator interface {
+	// Next returns the next key and the id of its blob, or io.EOF once there
+	// are no more keys. The returned key may be retained by the caller.
 	Next() ([]string, ID, error)
 }
 
+// keyIterator walks trees depth first. The top of the stack holds the
+// remaining entries of the current tree, and key holds the names of the trees
+// on the stack, excluding the root. Trees are sorted before they are pushed,
+// as Repos are not required to return sorted trees.
 type keyIterator struct {
 	key   []string
 	rp    Repo
@@ -75,38 +153,162 @@ func (k *keyIterator) Next() ([]string, ID, error) {
 			if tree, err := k.rp.Tree(entry.ID); err != nil {
 				return nil, nil, err
 			} else {
-				k.stack = append(k.stack, tree)
+				k.stack = append(k.stack, sortedTree(tree))
 				k.key = append(k.key, entry.Name)
 			}
+		} else if entry.Kind == KindRef {
+			k.stack[len(k.stack)-1] = tree[1:]
 		} else if entry.Kind == KindBlob {
 			k.stack[len(k.stack)-1] = tree[1:]
-			return append(k.key, entry.Name), entry.ID, nil
+			key := make([]string, len(k.key)+1)
+			copy(key, k.key)
+			key[len(k.key)] = entry.Name
+			return key, entry.ID, nil
 		} else {
 			return nil, nil, fmt.Errorf("corrupt tree: %s", entry.ID)
 		}
 	}
 }
 
+// sortedTree returns a sorted copy of t, leaving t unmodified.
+func sortedTree(t Tree) Tree {
+	sorted := append(Tree(nil), t...)
+	sort.Sort(sorted)
+	return sorted
+}
+
+// checkKey returns an error if key is empty or has a component that is empty,
+// "." or "..", or that contains a slash or NUL byte.
+func checkKey(key []string) error {
+	if len(key) == 0 {
+		return errors.New("empty key")
+	}
+	for _, name := range key {
+		if !validName(name) {
+			return fmt.Errorf("bad key component %q in key %#v", name, key)
+		}
+	}
+	return nil
+}
+
+// validName returns whether name is a valid key component and tree entry
+// name.
+func validName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\x00")
+}
+
 // Get returns a read closer for the Blob with the given key.
 func (s *sugar) Get(key []string) (io.ReadCloser, error) {
 	head, err := s.Head()
 	if err != nil {
 		return nil, err
 	}
-	commit, err := s.Commit(head)
+	return s.GetAt(head, key)
+}
+
+// GetAt is like Get, but returns the Blob for the given key as of the commit
+// with the given id. KindRef entries are followed to their target, up to
+// maxRefDepth times.
+func (s *sugar) GetAt(commitID ID, key []string) (io.ReadCloser, error) {
+	id, err := s.resolveKey(commitID, key)
 	if err != nil {
 		return nil, err
 	}
-	treeID := commit.Tree
-	for i, k := range key {
+	return s.Blob(id)
+}
+
+// Has returns whether the given key exists in the tree with the given id, and
+// the Kind of its entry if so. KindRef entries are followed like in GetAt, so
+// the Kind is that of the ref's target. Only the trees along the key's path
+// and refs are read, and blobs are not opened. A missing key, including the
+// target of a dangling ref, is not an error.
+func (s *sugar) Has(treeID ID, key []string) (bool, Kind, error) {
+	entry, err := s.resolve(treeID, key)
+	if err != nil || entry == nil {
+		return false, "", err
+	}
+	return true, entry.Kind, nil
+}
+
+// Open is like Get, but also returns the size of the blob, or -1 if the repo
+// can not tell it without reading the blob. The size is known for a DirRepo
+// using the default format.
+func (s *sugar) Open(key []string) (io.ReadCloser, int64, error) {
+	head, err := s.Head()
+	if err != nil {
+		return nil, 0, err
+	}
+	id, err := s.resolveKey(head, key)
+	if err != nil {
+		return nil, 0, err
+	}
+	size := int64(-1)
+	if bs, ok := s.Repo.(blobSizer); ok {
+		if size, err = bs.BlobSize(id); err != nil {
+			return nil, 0, err
+		}
+	}
+	rc, err := s.Blob(id)
+	if err != nil {
+		return nil, 0, err
+	}
+	return rc, size, nil
+}
+
+// resolveKey returns the id of the blob for the given key as of the commit
+// with the given id, following KindRef entries. Unlike lookup, it starts at a
+// commit and returns an error if the key does not exist.
+func (s *sugar) resolveKey(commitID ID, key []string) (ID, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	commit, err := s.Commit(commitID)
+	if err != nil {
+		return nil, err
+	}
+	entry, err := s.resolve(commit.Tree, key)
+	if err != nil {
+		return nil, err
+	} else if entry == nil {
+		return nil, notFoundError(fmt.Sprintf("key not found: %#v", key))
+	}
+	return entry.ID, nil
+}
+
+// resolve is like lookup, but follows KindRef entries, up to maxRefDepth
+// times. Refs are resolved relative to the tree with the given id. A nil
+// treeID is treated as an empty tree.
+func (s *sugar) resolve(treeID ID, key []string) (*Entry, error) {
+	if len(key) == 0 {
+		return nil, errors.New("empty key")
+	} else if treeID == nil {
+		return nil, nil
+	}
+	rootID := treeID
+	for i, refs := 0, 0; i < len(key); i++ {
 		tree, err := s.Tree(treeID)
 		if err != nil {
 			return nil, err
 		}
-		if entry := tree.Get(k); entry == nil {
-			return nil, notFoundError(fmt.Sprintf("entry for %q not found for key %#v", k, key))
+		entry := tree.Get(key[i])
+		if entry == nil {
+			return nil, nil
+		} else if entry.Kind == KindRef {
+			// Continue with the remaining components below the target of the
+			// ref, starting over at the root tree.
+			if refs++; refs > maxRefDepth {
+				return nil, fmt.Errorf("too many refs resolving key %#v", key)
+			}
+			target, err := s.readRef(entry.ID)
+			if err != nil {
+				return nil, err
+			}
+			key = append(target, key[i+1:]...)
+			treeID, i = rootID, -1
 		} else if i == len(key)-1 {
-			return s.Blob(entry.ID)
+			return entry, nil
+		} else if entry.Kind != KindTree {
+			return nil, nil
 		} else {
 			treeID = entry.ID
 		}
@@ -114,17 +316,54 @@ func (s *sugar) Get(key []string) (io.ReadCloser, error) {
 	panic("unreachable")
 }
 
+// maxRefDepth is the maximum number of KindRef entries followed when
+// resolving a key, which guards against cycles.
+const maxRefDepth = 40
+
+// readRef returns the target key of the KindRef entry with the given id.
+func (s *sugar) readRef(id ID) ([]string, error) {
+	rc, err := s.Blob(id)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	target := strings.Split(string(data), "/")
+	if err := checkKey(target); err != nil {
+		return nil, fmt.Errorf("bad ref %s: %s", id, err)
+	}
+	return target, nil
+}
+
 // Set commits the given key and blob value using the given commit details and
 // returns the ID of the new head. It's ok for the underlaying repo to not have
 // a head prior to calling Set. Set may return neither ID nor error, which
 // means that no commit was created because the repo already had the desired
 // key value pair.
 func (s *sugar) Set(treeID ID, key []string, blob io.Reader) (ID, error) {
-	if len(key) == 0 {
-		return nil, errors.New("empty key")
+	if err := checkKey(key); err != nil {
+		return nil, err
 	}
 	// First we try to fetch the current head and all existing trees that we have
 	// need to merge with.
+	trees, err := s.pathTrees(treeID, key)
+	if err != nil {
+		return nil, err
+	}
+	// Then we create the blob
+	blobID, err := s.WriteBlob(blob)
+	if err != nil {
+		return nil, err
+	}
+	return s.setEntry(key, trees, &Entry{Kind: KindBlob, ID: blobID})
+}
+
+// pathTrees returns the existing trees along the path of key, starting with
+// the tree with the given id, which may be nil.
+func (s *sugar) pathTrees(treeID ID, key []string) ([]Tree, error) {
 	var trees []Tree
 	if treeID != nil {
 		for _, k := range key {
@@ -133,26 +372,29 @@ func (s *sugar) Set(treeID ID, key []string, blob io.Reader) (ID, error) {
 				return nil, err
 			}
 			trees = append(trees, tree)
-			if entry := tree.Get(k); entry == nil || entry.Kind == KindBlob {
+			if entry := tree.Get(k); entry == nil || entry.Kind != KindTree {
 				break
 			} else {
 				treeID = entry.ID
 			}
 		}
 	}
-	// Then we create the blob
-	blobID, err := s.WriteBlob(blob)
-	if err != nil {
-		return nil, err
-	}
-	// And finally we iterate over all keys backwards to create or update the
+	return trees, nil
+}
+
+// setEntry sets the given entry as the value of key, and writes the trees
+// along its path, which are based on the given existing trees. It returns the
+// id of the new root tree, or nil if the entry was set already.
+func (s *sugar) setEntry(key []string, trees []Tree, leaf *Entry) (ID, error) {
+	var err error
+	// We iterate over all keys backwards to create or update the
 	// trees.
 	var prevTreeID ID
 	for i := len(key) - 1; i >= 0; i-- {
 		var entry *Entry
 		// The first entry is the one pointing to our blob.
 		if prevTreeID == nil {
-			entry = &Entry{Name: key[i], Kind: KindBlob, ID: blobID}
+			entry = &Entry{Name: key[i], Kind: leaf.Kind, Mode: leaf.Mode, ID: leaf.ID}
 			// All others are trees pointing to the prevTreeID tree.
 		} else {
 			entry = &Entry{Name: key[i], Kind: KindTree, ID: prevTreeID}
@@ -185,3 +427,204 @@ func (s *sugar) Set(treeID ID, key []string, blob io.Reader) (ID, error) {
 	}
 	return prevTreeID, nil
 }
+
+// Delete removes the entry for the given key from the tree with the given id
+// and returns the id of the resulting tree. Trees left empty by the removal
+// are removed from their parents as well, except for the root tree. A not
+// found error is returned if the key does not exist, so unlike Set, Delete
+// never returns a nil id without an error.
+func (s *sugar) Delete(treeID ID, key []string) (ID, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+	var trees []Tree
+	for i, k := range key {
+		if treeID == nil {
+			return nil, notFoundError(fmt.Sprintf("key not found: %#v", key))
+		}
+		tree, err := s.Tree(treeID)
+		if err != nil {
+			return nil, err
+		}
+		trees = append(trees, tree)
+		if entry := tree.Get(k); entry == nil || (i < len(key)-1 && entry.Kind != KindTree) {
+			return nil, notFoundError(fmt.Sprintf("key not found: %#v", key))
+		} else {
+			treeID = entry.ID
+		}
+	}
+	// Remove the entry, and the entries of any trees that become empty.
+	i := len(key) - 1
+	tree := trees[i].Remove(key[i])
+	for len(tree) == 0 && i > 0 {
+		i--
+		tree = trees[i].Remove(key[i])
+	}
+	// Write the remaining trees up to the root.
+	for {
+		id, err := s.WriteTree(tree)
+		if err != nil {
+			return nil, err
+		} else if i == 0 {
+			return id, nil
+		}
+		i--
+		tree = trees[i].Add(&Entry{Name: key[i], Kind: KindTree, ID: id})
+	}
+}
+
+// Move moves the entry for the key from to the key to in the tree with the
+// given id, and returns the id of the resulting tree. The entry keeps its id,
+// so no blobs are written, and only the trees along both keys are rewritten.
+// Trees left empty are removed like Delete does. A not found error is
+// returned if from does not exist, and an error if to exists already or is
+// below from.
+func (s *sugar) Move(treeID ID, from, to []string) (ID, error) {
+	if err := checkKey(from); err != nil {
+		return nil, err
+	} else if err := checkKey(to); err != nil {
+		return nil, err
+	} else if len(to) > len(from) && strings.Join(to[:len(from)], "/") == strings.Join(from, "/") {
+		return nil, fmt.Errorf("can not move %#v below itself to %#v", from, to)
+	}
+	// The trees along the common prefix of both keys are only rewritten once,
+	// after the entry has been moved within the tree below the prefix.
+	var (
+		prefix []string
+		trees  []Tree
+	)
+	for len(prefix) < len(from)-1 && len(prefix) < len(to)-1 && from[len(prefix)] == to[len(prefix)] {
+		name := from[len(prefix)]
+		tree, err := s.Tree(treeID)
+		if err != nil {
+			return nil, err
+		}
+		entry := tree.Get(name)
+		if entry == nil || entry.Kind != KindTree {
+			return nil, notFoundError(fmt.Sprintf("key not found: %#v", from))
+		}
+		trees = append(trees, tree)
+		prefix = append(prefix, name)
+		treeID = entry.ID
+	}
+	from, to = from[len(prefix):], to[len(prefix):]
+	full := func(key []string) []string {
+		return append(append([]string(nil), prefix...), key...)
+	}
+	if entry, err := lookup(s, treeID, from); err != nil {
+		return nil, err
+	} else if entry == nil {
+		return nil, notFoundError(fmt.Sprintf("key not found: %#v", full(from)))
+	} else if existing, err := lookup(s, treeID, to); err != nil {
+		return nil, err
+	} else if existing != nil {
+		return nil, fmt.Errorf("key exists already: %#v", full(to))
+	} else if toTrees, err := s.pathTrees(treeID, to); err != nil {
+		return nil, err
+	} else if n := len(toTrees); n > 0 && n < len(to) && toTrees[n-1].Get(to[n-1]) != nil {
+		return nil, fmt.Errorf("key %#v is below the %s %#v", full(to), toTrees[n-1].Get(to[n-1]).Kind, full(to[:n]))
+	} else if treeID, err = s.Delete(treeID, from); err != nil {
+		return nil, err
+	} else if toTrees, err := s.pathTrees(treeID, to); err != nil {
+		return nil, err
+	} else if treeID, err = s.setEntry(to, toTrees, entry); err != nil {
+		return nil, err
+	}
+	// Write the trees along the common prefix up to the root.
+	for i := len(prefix) - 1; i >= 0; i-- {
+		var err error
+		if treeID, err = s.WriteTree(trees[i].Add(&Entry{Name: prefix[i], Kind: KindTree, ID: treeID})); err != nil {
+			return nil, err
+		}
+	}
+	return treeID, nil
+}
+
+// SetStream returns a WriteCloser for the blob value of the given key. Once it
+// is closed, the key is set on top of the head's tree and a commit is created
+// from the given details, with the head as its parent. A nil c is treated like
+// a zero Commit. The commit becomes the new head. The returned function waits
+// for this to complete and returns the id of the new head, or nil if the key
+// already had the written value.
+func (s *sugar) SetStream(key []string, c *Commit) (io.WriteCloser, func() (ID, error), error) {
+	if err := checkKey(key); err != nil {
+		return nil, nil, err
+	}
+	head, treeID, err := s.head()
+	if err != nil {
+		return nil, nil, err
+	}
+	sw := newStreamWriter(func(r io.Reader) (ID, error) {
+		return s.commitSet(head, treeID, key, r, c)
+	})
+	return sw, sw.wait, nil
+}
+
+// commitSet sets key to blob on top of the given tree and commits the result
+// as the new head, using head as its parent. It returns nil if the tree was
+// not changed.
+func (s *sugar) commitSet(head, treeID ID, key []string, blob io.Reader, c *Commit) (ID, error) {
+	newTreeID, err := s.Set(treeID, key, blob)
+	if err != nil || newTreeID == nil {
+		return nil, err
+	}
+	var commit Commit
+	if c != nil {
+		commit = *c
+	}
+	commit.Tree = newTreeID
+	commit.Parents = nil
+	if head != nil {
+		commit.Parents = []ID{head}
+	}
+	id, err := s.WriteCommit(commit)
+	if err != nil {
+		return nil, err
+	} else if err := s.WriteHead(id); err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// head returns the id of the head commit and of its tree, or nil ids if the
+// repo has no head yet.
+func (s *sugar) head() (ID, ID, error) {
+	head, err := s.Head()
+	if IsNotFound(err) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	commit, err := s.Commit(head)
+	if err != nil {
+		return nil, nil, err
+	}
+	return head, commit.Tree, nil
+}
+
+// lookup returns the Entry for key within the tree with the given id, or nil
+// if the key does not exist. Only the trees along the key's path are read.
+func lookup(rp Repo, treeID ID, key []string) (*Entry, error) {
+	if len(key) == 0 {
+		return nil, errors.New("empty key")
+	}
+	for i, k := range key {
+		if treeID == nil {
+			return nil, nil
+		}
+		tree, err := rp.Tree(treeID)
+		if err != nil {
+			return nil, err
+		}
+		entry := tree.Get(k)
+		if entry == nil {
+			return nil, nil
+		} else if i == len(key)-1 {
+			return entry, nil
+		} else if entry.Kind != KindTree {
+			return nil, nil
+		}
+		treeID = entry.ID
+	}
+	panic("unreachable")
+}
@@ -2,20 +2,22 @@ package can
 
 import (
 	"bytes"
+	"errors"
 	"io"
+	"io/ioutil"
 	"strings"
 	"testing"
+
+	"github.com/kylelemons/godebug/pretty"
 )
 
 func TestSugar_Get_Set(t *testing.T) {
 	var (
-		crp      = newCountingRepo(tmpRepo())
+		crp, m   = NewObservedRepo(tmpRepo())
 		s        = NewSugar(crp)
 		checkSet = func(key []string, val string) func() {
 			return func() {
-				if _, err := s.Set(key, strings.NewReader(val), &Commit{}); err != nil {
-					t.Errorf("checkSet: %s for key=%#v and val=%s", err, key, val)
-				}
+				testCommitSet(t, crp, key, val)
 			}
 		}
 		checkGet = func(key []string, val string) func() {
@@ -30,9 +32,9 @@ func TestSugar_Get_Set(t *testing.T) {
 				}
 			}
 		}
-		checkCount = func(want int) func() {
+		checkCount = func(want int64) func() {
 			return func() {
-				if got := crp.WriteTreeCount; got != want {
+				if got := m.Calls("WriteTree"); got != want {
 					t.Errorf("checkCount: got=%d want=%d", got, want)
 				}
 			}
@@ -62,16 +64,585 @@ func TestSugar_Get_Set(t *testing.T) {
 	}
 }
 
-func newCountingRepo(rp Repo) *countingRepo {
-	return &countingRepo{Repo: rp}
+func TestSugar_Keys(t *testing.T) {
+	rp := tmpRepo()
+	for _, key := range [][]string{
+		{"c"},
+		{"b", "y", "z"},
+		{"a"},
+		{"b", "x"},
+		{"b", "y", "a"},
+		{"b0"},
+	} {
+		testCommitSet(t, rp, key, strings.Join(key, "/"))
+	}
+	s := NewSugar(rp)
+	head, err := s.HeadCommit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		Prefix []string
+		Want   [][]string
+	}{
+		{
+			Prefix: nil,
+			Want: [][]string{
+				{"a"},
+				{"b", "x"},
+				{"b", "y", "a"},
+				{"b", "y", "z"},
+				{"b0"},
+				{"c"},
+			},
+		},
+		{
+			Prefix: []string{"b"},
+			Want: [][]string{
+				{"b", "x"},
+				{"b", "y", "a"},
+				{"b", "y", "z"},
+			},
+		},
+		{
+			Prefix: []string{"b", "y"},
+			Want: [][]string{
+				{"b", "y", "a"},
+				{"b", "y", "z"},
+			},
+		},
+	}
+	for _, test := range tests {
+		it, err := s.Keys(head.Tree, test.Prefix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got [][]string
+		for {
+			key, id, err := it.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			} else if id == nil {
+				t.Fatalf("missing id for key %#v", key)
+			}
+			got = append(got, key)
+		}
+		if diff := pretty.Compare(got, test.Want); diff != "" {
+			t.Errorf("prefix=%#v: %s", test.Prefix, diff)
+		}
+	}
+	if _, err := s.Keys(head.Tree, []string{"missing"}); !IsNotFound(err) {
+		t.Fatalf("expected not found error, got: %v", err)
+	}
+}
+
+func TestSugar_SetStream(t *testing.T) {
+	rp := tmpRepo()
+	parent := testCommitSet(t, rp, []string{"foo"}, "a")
+	s := NewSugar(rp)
+	w, commit, err := s.SetStream([]string{"big", "value"}, &Commit{Message: []byte("streamed")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &bytes.Buffer{}
+	chunk := bytes.Repeat([]byte("0123456789"), 1000)
+	for i := 0; i < 100; i++ {
+		want.Write(chunk)
+		if _, err := w.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	id, err := commit()
+	if err != nil {
+		t.Fatal(err)
+	} else if head, err := rp.Head(); err != nil {
+		t.Fatal(err)
+	} else if !head.Equal(id) {
+		t.Fatalf("bad head: got=%s want=%s", head, id)
+	} else if c, err := rp.Commit(id); err != nil {
+		t.Fatal(err)
+	} else if len(c.Parents) != 1 || !c.Parents[0].Equal(parent) || string(c.Message) != "streamed" {
+		t.Fatalf("bad commit: %#v", c)
+	}
+	got := &bytes.Buffer{}
+	if rc, err := s.Get([]string{"big", "value"}); err != nil {
+		t.Fatal(err)
+	} else if _, err := io.Copy(got, rc); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(got.Bytes(), want.Bytes()) {
+		t.Fatalf("bad value: got=%d bytes want=%d bytes", got.Len(), want.Len())
+	}
+	if rc, err := s.Get([]string{"foo"}); err != nil {
+		t.Fatal(err)
+	} else {
+		rc.Close()
+	}
+	w, commit, err = s.SetStream([]string{"foo"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := io.WriteString(w, "b"); err != nil {
+		t.Fatal(err)
+	} else if err := w.Close(); err != nil {
+		t.Fatal(err)
+	} else if id, err := commit(); err != nil {
+		t.Fatal(err)
+	} else if c, err := rp.Commit(id); err != nil {
+		t.Fatal(err)
+	} else if len(c.Parents) != 1 || len(c.Message) != 0 {
+		t.Fatalf("bad commit: %#v", c)
+	}
+}
+
+func TestSugar_Delete(t *testing.T) {
+	rp := tmpRepo()
+	s := NewSugar(rp)
+	set := func(treeID ID, key []string, val string) ID {
+		id, err := s.Set(treeID, key, strings.NewReader(val))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	treeID := set(nil, []string{"a", "b", "c"}, "1")
+	treeID = set(treeID, []string{"a", "d"}, "2")
+	want := set(nil, []string{"a", "d"}, "2")
+	got, err := s.Delete(treeID, []string{"a", "b", "c"})
+	if err != nil {
+		t.Fatal(err)
+	} else if !got.Equal(want) {
+		t.Fatalf("bad tree: got=%s want=%s", got, want)
+	}
+	for _, key := range [][]string{{"a", "b", "c"}, {"x"}, {"a", "d", "e"}} {
+		if _, err := s.Delete(got, key); !IsNotFound(err) {
+			t.Fatalf("expected not found error for %#v, got: %v", key, err)
+		}
+	}
+	if _, err := s.Delete(nil, []string{"a"}); !IsNotFound(err) {
+		t.Fatalf("expected not found error for nil tree, got: %v", err)
+	}
+	empty, err := s.Delete(got, []string{"a", "d"})
+	if err != nil {
+		t.Fatal(err)
+	} else if tree, err := rp.Tree(empty); err != nil {
+		t.Fatal(err)
+	} else if len(tree) != 0 {
+		t.Fatalf("expected empty root tree, got: %#v", tree)
+	}
+}
+
+func TestSugar_GetAt(t *testing.T) {
+	rp := tmpRepo()
+	s := NewSugar(rp)
+	first := testCommitSet(t, rp, []string{"foo", "bar"}, "a")
+	second := testCommitSet(t, rp, []string{"foo", "bar"}, "b")
+	for _, test := range []struct {
+		Commit ID
+		Want   string
+	}{{first, "a"}, {second, "b"}} {
+		rc, err := s.GetAt(test.Commit, []string{"foo", "bar"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		} else if string(data) != test.Want {
+			t.Fatalf("bad value at %s: got=%q want=%q", test.Commit, data, test.Want)
+		}
+	}
+	if _, err := s.GetAt(first, []string{"foo", "baz"}); !IsNotFound(err) {
+		t.Fatalf("expected not found error, got: %v", err)
+	}
+}
+
+func TestSugar_Has(t *testing.T) {
+	rp := tmpRepo()
+	s := NewSugar(rp)
+	testCommitSet(t, rp, []string{"foo", "bar"}, "a")
+	head, err := s.HeadCommit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		Key  []string
+		Has  bool
+		Kind Kind
+	}{
+		{Key: []string{"foo", "bar"}, Has: true, Kind: KindBlob},
+		{Key: []string{"foo"}, Has: true, Kind: KindTree},
+		{Key: []string{"foo", "baz"}},
+		{Key: []string{"foo", "bar", "baz"}},
+		{Key: []string{"nope", "bar"}},
+	} {
+		if has, kind, err := s.Has(head.Tree, test.Key); err != nil {
+			t.Fatalf("%#v: %s", test.Key, err)
+		} else if has != test.Has || kind != test.Kind {
+			t.Errorf("%#v: got=%t %q want=%t %q", test.Key, has, kind, test.Has, test.Kind)
+		}
+	}
+	if _, _, err := s.Has(head.Tree, nil); err == nil {
+		t.Fatal("expected error for empty key")
+	}
+	if has, kind, err := NewSugar(tmpDirRepo()).Has(nil, []string{"foo"}); err != nil {
+		t.Fatal(err)
+	} else if has || kind != "" {
+		t.Fatalf("nil tree: got=%t %q", has, kind)
+	}
+}
+
+func TestSugar_ListKeys(t *testing.T) {
+	rp := tmpRepo()
+	for _, key := range [][]string{{"b", "y"}, {"a"}, {"b", "x", "z"}, {"c"}} {
+		testCommitSet(t, rp, key, strings.Join(key, "/"))
+	}
+	s := NewSugar(rp)
+	head, err := s.HeadCommit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	it, err := s.Keys(head.Tree, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want [][]string
+	for {
+		key, _, err := it.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		want = append(want, key)
+	}
+	if got, err := s.ListKeys(head.Tree, nil); err != nil {
+		t.Fatal(err)
+	} else if diff := pretty.Compare(got, want); diff != "" {
+		t.Fatal(diff)
+	}
+	stop := errors.New("stop")
+	var walked [][]string
+	if err := s.WalkKeys(head.Tree, []string{"b"}, func(key []string, id ID) error {
+		if id == nil {
+			t.Fatalf("missing id for key %#v", key)
+		}
+		walked = append(walked, key)
+		if len(walked) == 1 {
+			return stop
+		}
+		return nil
+	}); err != stop {
+		t.Fatalf("expected stop error, got: %v", err)
+	} else if diff := pretty.Compare(walked, [][]string{{"b", "x", "z"}}); diff != "" {
+		t.Fatal(diff)
+	}
+	if _, err := s.ListKeys(head.Tree, []string{"missing"}); !IsNotFound(err) {
+		t.Fatalf("expected not found error, got: %v", err)
+	}
+}
+
+func TestSugar_ListKeys_NilTree(t *testing.T) {
+	s := NewSugar(tmpDirRepo())
+	if got, err := s.ListKeys(nil, nil); err != nil {
+		t.Fatal(err)
+	} else if len(got) != 0 {
+		t.Fatalf("expected no keys, got: %#v", got)
+	}
+	if err := s.WalkKeys(nil, nil, func(key []string, id ID) error {
+		t.Fatalf("unexpected key: %#v", key)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.ListKeys(nil, []string{"a"}); !IsNotFound(err) {
+		t.Fatalf("expected not found error, got: %v", err)
+	}
+	if _, err := s.Sub([]string{"a"}).ListKeys(nil, nil); !IsNotFound(err) {
+		t.Fatalf("expected not found error, got: %v", err)
+	}
 }
 
-type countingRepo struct {
-	WriteTreeCount int
+// reversingRepo returns trees with their entries in reverse order.
+type reversingRepo struct {
 	Repo
 }
 
-func (c *countingRepo) WriteTree(tree Tree) (ID, error) {
-	c.WriteTreeCount++
-	return c.Repo.WriteTree(tree)
+func (r *reversingRepo) Tree(id ID) (Tree, error) {
+	tree, err := r.Repo.Tree(id)
+	for i, j := 0, len(tree)-1; i < j; i, j = i+1, j-1 {
+		tree[i], tree[j] = tree[j], tree[i]
+	}
+	return tree, err
+}
+
+func TestSugar_Keys_Unsorted(t *testing.T) {
+	rp := tmpRepo()
+	for _, key := range [][]string{{"a"}, {"b", "x"}, {"b", "y", "z"}, {"b", "y", "a"}, {"c"}} {
+		testCommitSet(t, rp, key, strings.Join(key, "/"))
+	}
+	head, err := NewSugar(rp).HeadCommit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSugar(&reversingRepo{Repo: rp})
+	got, err := s.ListKeys(head.Tree, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]string{{"a"}, {"b", "x"}, {"b", "y", "a"}, {"b", "y", "z"}, {"c"}}
+	if diff := pretty.Compare(got, want); diff != "" {
+		t.Fatal(diff)
+	}
+	if got, err := s.ListKeys(head.Tree, []string{"b", "y"}); err != nil {
+		t.Fatal(err)
+	} else if diff := pretty.Compare(got, want[2:4]); diff != "" {
+		t.Fatal(diff)
+	}
+}
+
+func TestSugar_BadKeys(t *testing.T) {
+	rp := tmpRepo()
+	head := testCommitSet(t, rp, []string{"ok"}, "a")
+	commit, err := rp.Commit(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewSugar(rp)
+	for _, key := range [][]string{
+		nil,
+		{""},
+		{"a", ""},
+		{"."},
+		{"a", ".."},
+		{"a/b"},
+		{"a\x00b"},
+	} {
+		if _, err := s.Set(commit.Tree, key, strings.NewReader("x")); err == nil {
+			t.Fatalf("Set: expected error for key %#v", key)
+		} else if _, err := s.Get(key); err == nil || IsNotFound(err) {
+			t.Fatalf("Get: expected error for key %#v, got: %v", key, err)
+		} else if _, err := s.Delete(commit.Tree, key); err == nil || IsNotFound(err) {
+			t.Fatalf("Delete: expected error for key %#v, got: %v", key, err)
+		}
+	}
+	key := []string{"日本語", "naïve ...name"}
+	testCommitSet(t, rp, key, "unicode")
+	rc, err := s.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if data, err := ioutil.ReadAll(rc); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "unicode" {
+		t.Fatalf("bad value: %q", data)
+	}
+}
+
+func TestSugar_Get_Ref(t *testing.T) {
+	rp := tmpRepo()
+	s := NewSugar(rp)
+	treeID, err := s.Set(nil, []string{"dir", "value"}, strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs := map[string]string{
+		"alias":    "dir/value",
+		"chain":    "alias",
+		"dangling": "nope",
+		"link":     "dir",
+		"loop-a":   "loop-b",
+		"loop-b":   "loop-a",
+	}
+	root, err := rp.Tree(treeID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, target := range refs {
+		id, err := rp.WriteBlob(strings.NewReader(target))
+		if err != nil {
+			t.Fatal(err)
+		}
+		root = root.Add(&Entry{Kind: KindRef, Name: name, ID: id})
+	}
+	if treeID, err = rp.WriteTree(root); err != nil {
+		t.Fatal(err)
+	} else if commitID, err := rp.WriteCommit(Commit{Tree: treeID}); err != nil {
+		t.Fatal(err)
+	} else if err := rp.WriteHead(commitID); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range [][]string{{"alias"}, {"chain"}, {"link", "value"}} {
+		rc, err := s.Get(key)
+		if err != nil {
+			t.Fatalf("%#v: %s", key, err)
+		}
+		got, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		} else if string(got) != "hello" {
+			t.Fatalf("%#v: got=%q want=%q", key, got, "hello")
+		}
+	}
+	for _, test := range []struct {
+		Key  []string
+		Has  bool
+		Kind Kind
+	}{
+		{Key: []string{"alias"}, Has: true, Kind: KindBlob},
+		{Key: []string{"link"}, Has: true, Kind: KindTree},
+		{Key: []string{"link", "value"}, Has: true, Kind: KindBlob},
+		{Key: []string{"link", "nope"}},
+		{Key: []string{"dangling"}},
+	} {
+		if has, kind, err := s.Has(treeID, test.Key); err != nil {
+			t.Fatalf("%#v: %s", test.Key, err)
+		} else if has != test.Has || kind != test.Kind {
+			t.Errorf("%#v: got=%t %q want=%t %q", test.Key, has, kind, test.Has, test.Kind)
+		}
+	}
+	if _, _, err := s.Has(treeID, []string{"loop-a"}); err == nil {
+		t.Fatal("expected error for ref cycle")
+	}
+	if _, err := s.Get([]string{"loop-a"}); err == nil || !strings.Contains(err.Error(), "too many refs") {
+		t.Fatalf("expected error for ref cycle, got: %v", err)
+	} else if keys, err := s.ListKeys(treeID, nil); err != nil {
+		t.Fatal(err)
+	} else if diff := pretty.Compare(keys, [][]string{{"dir", "value"}}); diff != "" {
+		t.Fatalf("%s", diff)
+	}
+}
+
+func TestSugar_Open(t *testing.T) {
+	big := strings.Repeat("0123456789", 10000)
+	for _, test := range []struct {
+		Repo    Repo
+		Unknown bool
+	}{
+		{Repo: tmpDirRepo()},
+		{Repo: tmpEncryptedRepo(t), Unknown: true},
+		{Repo: NewMemRepo(), Unknown: true},
+	} {
+		s := NewSugar(test.Repo)
+		for _, val := range []string{"", "hello", big} {
+			testCommitSet(t, test.Repo, []string{"a", "b"}, val)
+			rc, size, err := s.Open([]string{"a", "b"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := ioutil.ReadAll(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			} else if string(got) != val {
+				t.Fatalf("bad value of length %d", len(got))
+			}
+			want := int64(len(val))
+			if test.Unknown {
+				want = -1
+			}
+			if size != want {
+				t.Fatalf("bad size: got=%d want=%d", size, want)
+			}
+		}
+		if _, _, err := s.Open([]string{"missing"}); !IsNotFound(err) {
+			t.Fatalf("expected not found error, got: %v", err)
+		}
+	}
+}
+
+func TestSugar_Move(t *testing.T) {
+	rp := tmpRepo()
+	s := NewSugar(rp)
+	set := func(treeID ID, key []string, val string) ID {
+		id, err := s.Set(treeID, key, strings.NewReader(val))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	treeID := set(nil, []string{"a", "b", "c"}, "1")
+	treeID = set(treeID, []string{"a", "b", "d"}, "2")
+	treeID = set(treeID, []string{"x"}, "3")
+	tests := []struct {
+		From, To []string
+		Want     func() ID
+	}{
+		{
+			From: []string{"a", "b", "c"},
+			To:   []string{"a", "b", "e"},
+			Want: func() ID {
+				id := set(nil, []string{"a", "b", "e"}, "1")
+				id = set(id, []string{"a", "b", "d"}, "2")
+				return set(id, []string{"x"}, "3")
+			},
+		},
+		{
+			From: []string{"a", "b", "c"},
+			To:   []string{"y", "z"},
+			Want: func() ID {
+				id := set(nil, []string{"y", "z"}, "1")
+				id = set(id, []string{"a", "b", "d"}, "2")
+				return set(id, []string{"x"}, "3")
+			},
+		},
+		{
+			From: []string{"a", "b"},
+			To:   []string{"b"},
+			Want: func() ID {
+				id := set(nil, []string{"b", "c"}, "1")
+				id = set(id, []string{"b", "d"}, "2")
+				return set(id, []string{"x"}, "3")
+			},
+		},
+		{
+			From: []string{"x"},
+			To:   []string{"a", "x"},
+			Want: func() ID {
+				id := set(nil, []string{"a", "b", "c"}, "1")
+				id = set(id, []string{"a", "b", "d"}, "2")
+				return set(id, []string{"a", "x"}, "3")
+			},
+		},
+	}
+	for _, test := range tests {
+		before, err := rp.(*DirRepo).Objects()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.Move(treeID, test.From, test.To)
+		if err != nil {
+			t.Fatalf("%#v -> %#v: %s", test.From, test.To, err)
+		} else if after, err := rp.(*DirRepo).Objects(); err != nil {
+			t.Fatal(err)
+		} else if len(after)-len(before) > len(test.From)+len(test.To) {
+			t.Fatalf("%#v -> %#v: too many objects written: %d", test.From, test.To, len(after)-len(before))
+		} else if want := test.Want(); !got.Equal(want) {
+			t.Fatalf("%#v -> %#v: got=%s want=%s", test.From, test.To, got, want)
+		}
+	}
+	for _, keys := range [][2][]string{
+		{{"missing"}, {"y"}},
+		{{"x", "y"}, {"y"}},
+	} {
+		if _, err := s.Move(treeID, keys[0], keys[1]); !IsNotFound(err) {
+			t.Fatalf("%#v: expected not found error, got: %v", keys, err)
+		}
+	}
+	for _, keys := range [][2][]string{
+		{{"x"}, {"a", "b", "c"}},
+		{{"x"}, {"x"}},
+		{{"a"}, {"a", "b", "z"}},
+		{{"a", "b", "c"}, {"x", "y"}},
+	} {
+		if _, err := s.Move(treeID, keys[0], keys[1]); err == nil || IsNotFound(err) {
+			t.Fatalf("%#v: expected error, got: %v", keys, err)
+		}
+	}
 }
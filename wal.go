@@ -0,0 +1,172 @@
+package can
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// WALEntry describes an object write recorded in the write-ahead log.
+type WALEntry struct {
+	Kind Kind
+	ID   ID
+	Size int64
+	Time time.Time
+}
+
+const (
+	walObject = "object"
+	walHead   = "head"
+)
+
+// walEntry is a single line of the write-ahead log. Object entries are
+// written before the object is moved into place, head entries after the head
+// has been written.
+type walEntry struct {
+	Op string
+	WALEntry
+}
+
+// ReplayWAL returns the objects that were written after the last head update
+// recorded in the write-ahead log, and that are not reachable from the
+// current head. Such objects are left behind when a process crashes between
+// writing objects and advancing the head. Afterwards the log is truncated.
+func (d *DirRepo) ReplayWAL() ([]WALEntry, error) {
+	d.walMu.Lock()
+	defer d.walMu.Unlock()
+	entries, err := d.readWAL()
+	if err != nil {
+		return nil, err
+	}
+	var pending []walEntry
+	for _, entry := range entries {
+		if entry.Op == walHead {
+			pending = nil
+		} else {
+			pending = append(pending, entry)
+		}
+	}
+	reachable := map[string]bool{}
+	if len(pending) > 0 {
+		var roots []ID
+		if head, err := d.Head(); err == nil {
+			roots = append(roots, head)
+		} else if !IsNotFound(err) {
+			return nil, err
+		}
+		if err := walkReachable(d, roots, func(id ID, kind Kind) error {
+			reachable[string(id)] = true
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+	var dangling []WALEntry
+	for _, entry := range pending {
+		if reachable[string(entry.ID)] {
+			continue
+		} else if ok, err := d.Exists(entry.ID); err != nil {
+			return nil, err
+		} else if ok {
+			dangling = append(dangling, entry.WALEntry)
+			reachable[string(entry.ID)] = true
+		}
+	}
+	if err := os.Truncate(d.wal, 0); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return dangling, nil
+}
+
+// appendWAL appends the given entry to the write-ahead log.
+func (d *DirRepo) appendWAL(e walEntry) error {
+	var line string
+	switch e.Op {
+	case walObject:
+		line = fmt.Sprintf("%s %s %s %d %d\n", e.Op, e.Kind, e.ID, e.Size, e.Time.Unix())
+	case walHead:
+		line = fmt.Sprintf("%s %s %d\n", e.Op, e.ID, e.Time.Unix())
+	default:
+		return fmt.Errorf("bad wal op: %q", e.Op)
+	}
+	d.walMu.Lock()
+	defer d.walMu.Unlock()
+	file, err := os.OpenFile(d.wal, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.WriteString(file, line); err != nil {
+		file.Close()
+		return err
+	} else if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// readWAL returns all entries of the write-ahead log. A truncated last line,
+// e.g. caused by a crash, is ignored.
+func (d *DirRepo) readWAL() ([]walEntry, error) {
+	file, err := os.Open(d.wal)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var (
+		entries []walEntry
+		b       = bufio.NewReader(file)
+	)
+	for {
+		line, err := b.ReadString('\n')
+		if err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+		entry, err := parseWALEntry(line[:len(line)-1])
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+}
+
+func parseWALEntry(line string) (walEntry, error) {
+	var (
+		e      walEntry
+		fields = strings.Split(line, " ")
+		idS    string
+		timeS  string
+	)
+	switch e.Op = fields[0]; {
+	case e.Op == walObject && len(fields) == 5:
+		e.Kind, idS, timeS = Kind(fields[1]), fields[2], fields[4]
+		size, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return e, fmt.Errorf("bad wal size: %s", err)
+		}
+		e.Size = size
+	case e.Op == walHead && len(fields) == 3:
+		idS, timeS = fields[1], fields[2]
+	default:
+		return e, fmt.Errorf("bad wal entry: %q", line)
+	}
+	id, err := ParseID(idS)
+	if err != nil {
+		return e, err
+	}
+	e.ID = id
+	unix, err := strconv.ParseInt(timeS, 10, 64)
+	if err != nil {
+		return e, fmt.Errorf("bad wal time: %s", err)
+	}
+	e.Time = time.Unix(unix, 0)
+	return e, nil
+}
@@ -0,0 +1,59 @@
+package can
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDirRepo_WAL(t *testing.T) {
+	rp := tmpDirRepo()
+	rp.WAL = true
+	head := testCommitSet(t, rp, []string{"foo"}, "a")
+	entries, err := rp.readWAL()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, e.Op+" "+string(e.Kind))
+	}
+	if want := []string{"object blob", "object tree", "object commit", "head "}; strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Fatalf("bad wal: got=%q want=%q", got, want)
+	} else if last := entries[len(entries)-1]; !last.ID.Equal(head) {
+		t.Fatalf("bad head entry: got=%s want=%s", last.ID, head)
+	} else if entries[0].Size != int64(len("blob\na")) {
+		t.Fatalf("bad blob size: %d", entries[0].Size)
+	}
+	if dangling, err := rp.ReplayWAL(); err != nil {
+		t.Fatal(err)
+	} else if len(dangling) != 0 {
+		t.Fatalf("unexpected dangling objects: %#v", dangling)
+	}
+	// Simulate a crash after writing a new commit, but before the head update.
+	s := NewSugar(rp)
+	commit, err := rp.Commit(head)
+	if err != nil {
+		t.Fatal(err)
+	}
+	treeID, err := s.Set(commit.Tree, []string{"bar"}, strings.NewReader("b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	commitID, err := rp.WriteCommit(Commit{Tree: treeID, Parents: []ID{head}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dangling, err := rp.ReplayWAL()
+	if err != nil {
+		t.Fatal(err)
+	} else if len(dangling) != 3 {
+		t.Fatalf("expected 3 dangling objects, got: %#v", dangling)
+	} else if last := dangling[2]; last.Kind != KindCommit || !last.ID.Equal(commitID) {
+		t.Fatalf("bad dangling commit: %#v", last)
+	}
+	if dangling, err := rp.ReplayWAL(); err != nil {
+		t.Fatal(err)
+	} else if len(dangling) != 0 {
+		t.Fatalf("wal was not truncated: %#v", dangling)
+	}
+}
@@ -0,0 +1,52 @@
+package can
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// PendingObject is an object to be written by WriteBatch. Kind determines
+// which of the other fields holds the object.
+type PendingObject struct {
+	Kind   Kind
+	Blob   []byte
+	Tree   Tree
+	Commit Commit
+}
+
+// WriteBatch writes the given objects in order and returns their ids in the
+// same order. Objects may refer to objects earlier in the batch, e.g. a tree
+// to its blobs. WriteBatch is not atomic: on error, it returns the ids of the
+// objects written before the failing one along with the error, and those
+// objects remain stored.
+func (d *DirRepo) WriteBatch(objs []PendingObject) ([]ID, error) {
+	var (
+		ids  = make([]ID, 0, len(objs))
+		dirs = map[string]bool{}
+	)
+	for i, obj := range objs {
+		var o interface{}
+		switch obj.Kind {
+		case KindBlob:
+			o = bytes.NewReader(obj.Blob)
+		case KindTree:
+			if err := d.checkTree(obj.Tree); err != nil {
+				return ids, err
+			}
+			o = obj.Tree
+		case KindCommit:
+			if err := d.checkCommit(obj.Commit); err != nil {
+				return ids, err
+			}
+			o = obj.Commit
+		default:
+			return ids, fmt.Errorf("bad kind %q for object %d", obj.Kind, i)
+		}
+		id, err := d.writeObject(o, dirs)
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
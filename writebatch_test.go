@@ -0,0 +1,71 @@
+package can
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kylelemons/godebug/pretty"
+)
+
+func TestDirRepo_WriteBatch(t *testing.T) {
+	rp := tmpDirRepo()
+	rp.ValidateReferences = true
+	rp.CheckCommits = true
+	blobID, err := NewMemRepo().WriteBlob(strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree := Tree{{Kind: KindBlob, Name: "hello", ID: blobID}}
+	treeID, err := NewMemRepo().WriteTree(tree)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := Commit{Tree: treeID, Time: time.Date(2015, 2, 20, 13, 14, 33, 0, time.FixedZone("", 3600)), Message: []byte("batch")}
+	ids, err := rp.WriteBatch([]PendingObject{
+		{Kind: KindBlob, Blob: []byte("hello")},
+		{Kind: KindTree, Tree: tree},
+		{Kind: KindCommit, Commit: commit},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(ids) != 3 {
+		t.Fatalf("expected 3 ids, got: %d", len(ids))
+	} else if !ids[0].Equal(blobID) || !ids[1].Equal(treeID) {
+		t.Fatalf("bad ids: %v", ids)
+	}
+	if r, err := rp.Blob(ids[0]); err != nil {
+		t.Fatal(err)
+	} else if data, err := ioutil.ReadAll(r); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "hello" {
+		t.Fatalf("bad blob: %q", data)
+	}
+	if got, err := rp.Tree(ids[1]); err != nil {
+		t.Fatal(err)
+	} else if diff := pretty.Compare(got, tree); diff != "" {
+		t.Fatal(diff)
+	}
+	if got, err := rp.Commit(ids[2]); err != nil {
+		t.Fatal(err)
+	} else if diff := pretty.Compare(got, commit); diff != "" {
+		t.Fatal(diff)
+	}
+
+	if _, err := rp.WriteBatch([]PendingObject{{Kind: KindCommit, Commit: Commit{Tree: MustID("0123")}}}); err == nil {
+		t.Fatal("expected error for commit with missing tree")
+	} else if _, err := rp.WriteBatch([]PendingObject{{Kind: "bad"}}); err == nil {
+		t.Fatal("expected error for bad kind")
+	}
+	partial, err := rp.WriteBatch([]PendingObject{
+		{Kind: KindBlob, Blob: []byte("partial")},
+		{Kind: KindCommit, Commit: Commit{Tree: MustID("0123")}},
+	})
+	if err == nil {
+		t.Fatal("expected error for commit with missing tree")
+	} else if len(partial) != 1 {
+		t.Fatalf("expected 1 id, got: %d", len(partial))
+	}
+	testBlob(t, rp, []byte("partial"), partial[0])
+}